@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// BuildSpec defines a build of the batch build api
+type BuildSpec struct {
+	Pkg    string   `json:"pkg"`
+	Deps   []string `json:"deps,omitempty"`
+	Target string   `json:"target,omitempty"`
+	Dev    bool     `json:"dev,omitempty"`
+	Bundle bool     `json:"bundle,omitempty"`
+}
+
+// BuildResult defines the result of a build spec
+type BuildResult struct {
+	Pkg   string `json:"pkg"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// batchBuild adds the build specs to the queue and waits for all of them,
+// a failed spec doesn't fail the whole batch.
+func batchBuild(queue *buildQueue, specs []BuildSpec) []BuildResult {
+	results := make([]BuildResult, len(specs))
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		wg.Add(1)
+		go func(i int, spec BuildSpec) {
+			defer wg.Done()
+			results[i] = BuildResult{Pkg: spec.Pkg}
+			task, err := spec.task()
+			if err == nil {
+				results[i].ID = task.ID()
+				if _, _, ok := findESM(task.ID()); !ok {
+					output := <-queue.Add(task)
+					err = output.err
+				}
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, spec)
+	}
+	wg.Wait()
+	return results
+}
+
+func (spec BuildSpec) task() (task *buildTask, err error) {
+	reqPkg, err := parsePkg(spec.Pkg)
+	if err != nil {
+		return
+	}
+
+	target := strings.ToLower(strings.TrimSpace(spec.Target))
+	if target == "" {
+		target = config.defaultTarget
+	}
+	if _, ok := targets[target]; !ok {
+		err = fmt.Errorf("invalid target '%s'", spec.Target)
+		return
+	}
+
+	deps := pkgSlice{}
+	for _, dep := range spec.Deps {
+		m, e := parsePkg(dep)
+		if e != nil {
+			err = e
+			return
+		}
+		if !deps.Has(m.name) {
+			deps = append(deps, *m)
+		}
+	}
+
+	task = &buildTask{
+		pkg:    *reqPkg,
+		deps:   deps,
+		target: target,
+		isDev:  spec.Dev,
+		bundle: spec.Bundle,
+	}
+	return
+}
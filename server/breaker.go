@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// circuitBreaker fast-fails the calls after a number of consecutive failures,
+// it half-opens after the cool-down period to let one call test the recovery.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, coolDown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		coolDown:  coolDown,
+	}
+}
+
+// Allow returns `ErrRegistryUnavailable` if the breaker is open, a nil breaker
+// always allows.
+func (b *circuitBreaker) Allow() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if time.Since(b.openedAt) < b.coolDown || b.probing {
+		return withKind(ErrRegistryUnavailable, errors.New("npm registry unavailable, please try later"))
+	}
+	b.probing = true
+	return nil
+}
+
+// Done records the result of an allowed call.
+func (b *circuitBreaker) Done(err error) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the state of the breaker: `closed`, `open` or `half-open`.
+func (b *circuitBreaker) State() string {
+	if b == nil || b.threshold <= 0 {
+		return "closed"
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.threshold {
+		return "closed"
+	}
+	if time.Since(b.openedAt) < b.coolDown {
+		return "open"
+	}
+	return "half-open"
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.Done(errors.New("registry down"))
+	}
+	if err := b.Allow(); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("breaker should be open, got %v", err)
+	}
+	if b.State() != "open" {
+		t.Fatalf("unexpected state %s", b.State())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if b.State() != "half-open" {
+		t.Fatalf("unexpected state %s", b.State())
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	// only one call can test the recovery
+	if err := b.Allow(); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("breaker should reject calls while probing, got %v", err)
+	}
+	b.Done(nil)
+	if b.State() != "closed" || b.Allow() != nil {
+		t.Fatalf("breaker should be closed after recovery")
+	}
+}
@@ -2,15 +2,19 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/evanw/esbuild/pkg/api"
@@ -20,13 +24,93 @@ import (
 )
 
 type buildTask struct {
-	id     string
-	wd     string
-	pkg    pkg
-	deps   pkgSlice
-	target string
-	isDev  bool
-	bundle bool
+	id         string
+	wd         string
+	pkg        pkg
+	deps       pkgSlice
+	exports    []string
+	entry      string
+	inlineSize int64
+	conditions []string
+	comments   string
+	// the name of the externals preset
+	preset string
+	// the version of the `@types` package, like `17.0.11`
+	typesVersion string
+	target       string
+	platform     string
+	isDev        bool
+	bundle       bool
+	standalone   bool
+	noBrowser    bool
+	transform    bool
+	decorators   bool
+	noMinify     bool
+	forceMinify  bool
+	// outputs the non-ASCII characters as they are instead of the escapes
+	utf8 bool
+	// wraps the output into a `System.register` module
+	systemjs  bool
+	typesOnly bool
+	noDts     bool
+	// records the resolve decisions and the details of the esbuild messages
+	// in the build log, the log is saved even if the build succeeds
+	debug bool
+	logID string
+	// the format version of the entry shim, zero for the current `shimFormat`
+	shim int
+}
+
+// standaloneSizeWarning is the size of a standalone bundle to warn
+const standaloneSizeWarning = 1 << 20
+
+// shimFormat is the format version of the entry shim that re-exports the package,
+// bump it when the shape of the shim changes and keep the generator of the previous
+// version in `entryShims`, so the `pin` query can still generate it.
+const shimFormat = 1
+
+// entryShims are the generators of the entry shim by the format version
+var entryShims = map[int]func(task *buildTask, esmeta *ESMeta) string{
+	1: (*buildTask).entryCodeV1,
+}
+
+// shimVersion returns the format version of the entry shim of the build.
+func (task *buildTask) shimVersion() int {
+	if task.shim > 0 {
+		return task.shim
+	}
+	return shimFormat
+}
+
+// outputFlags returns the filename flags of the platform, the minification and
+// the charset, the imports of the build must carry them too.
+func (task *buildTask) outputFlags() string {
+	flags := ""
+	if task.platform == "node" {
+		flags += ".node"
+	}
+	if !task.isDev && task.noMinify {
+		flags += ".nominify"
+	}
+	if task.isDev && task.forceMinify {
+		flags += ".minify"
+	}
+	if task.utf8 {
+		flags += ".utf8"
+	}
+	return flags
+}
+
+// importFlags returns the filename flags of the modules imported by the build.
+func (task *buildTask) importFlags() string {
+	flags := ""
+	if task.isDev {
+		flags += ".development"
+	}
+	if task.bundle {
+		flags += ".bundle"
+	}
+	return flags + task.outputFlags()
 }
 
 func (task *buildTask) ID() string {
@@ -47,94 +131,471 @@ func (task *buildTask) ID() string {
 	if task.bundle {
 		name += ".bundle"
 	}
+	if task.standalone {
+		name += ".standalone"
+	}
+	if task.noBrowser {
+		name += ".nobrowser"
+	}
+	if task.transform {
+		name += ".transform"
+	}
+	if task.decorators {
+		name += ".decorators"
+	}
+	name += task.outputFlags()
+	if task.systemjs {
+		name += ".systemjs"
+	}
+	if task.typesOnly {
+		name += ".types"
+	}
+	if task.noDts && !task.typesOnly {
+		name += ".nodts"
+	}
 	if len(task.deps) > 0 {
 		sort.Sort(task.deps)
 		deps = fmt.Sprintf("deps=%s/", strings.ReplaceAll(task.deps.String(), "/", "_"))
 	}
+	exports := ""
+	if len(task.exports) > 0 {
+		sort.Strings(task.exports)
+		exports = fmt.Sprintf("exports=%s/", strings.Join(task.exports, ","))
+	}
+	entry := ""
+	if task.entry != "" {
+		entry = fmt.Sprintf("entry=%s/", escapeEntryPath(task.entry))
+	}
+	inline := ""
+	if task.inlineSize > 0 {
+		inline = fmt.Sprintf("inline=%d/", task.inlineSize)
+	}
+	conditions := ""
+	if len(task.conditions) > 0 {
+		sort.Strings(task.conditions)
+		conditions = fmt.Sprintf("conditions=%s/", strings.Join(task.conditions, ","))
+	}
+	comments := ""
+	if task.comments != "" {
+		comments = fmt.Sprintf("comments=%s/", task.comments)
+	}
+	// the local and the github builds never collide with the registry ones, the
+	// commit sha is immutable so the github builds are cached permanently
+	source := ""
+	if pkg.local != "" {
+		source = fmt.Sprintf("local=%s/", strings.ReplaceAll(pkg.local, "/", "~"))
+	} else if pkg.git != "" {
+		source = fmt.Sprintf("gh=%s/", strings.ReplaceAll(pkg.git, "/", "~"))
+	}
+	types := ""
+	if task.typesVersion != "" {
+		types = fmt.Sprintf("types=%s/", task.typesVersion)
+	}
+	// changes of the server-side overrides invalidate the cache
+	overrides := ""
+	if o := getBuildOverride(pkg.name); o != nil {
+		overrides = fmt.Sprintf("overrides=%s/", o.Hash())
+	}
+	// the preset hash invalidates the builds when the preset changes
+	preset := ""
+	if p := getPreset(task.preset); p != nil {
+		preset = fmt.Sprintf("preset=%s.%s/", task.preset, p.Hash())
+	}
+	// so does the banner and the footer of the server
+	banner := ""
+	if config.banner != "" || config.footer != "" {
+		banner = fmt.Sprintf("banner=%s/", bannerHash())
+	}
+	shim := fmt.Sprintf("shim=v%d/", task.shimVersion())
 	task.id = fmt.Sprintf(
-		"v%d/%s@%s/%s%s/%s",
+		"v%d/%s@%s/%s%s%s%s%s%s%s%s%s%s%s%s%s/%s",
 		VERSION,
 		pkg.name,
 		pkg.version,
+		source,
 		deps,
+		exports,
+		entry,
+		inline,
+		conditions,
+		comments,
+		types,
+		overrides,
+		preset,
+		banner,
+		shim,
 		target,
 		name,
 	)
 	return task.id
 }
 
+// withBuildTimeout returns a context that is canceled after the `build-timeout`,
+// the zero timeout means no limit.
+func withBuildTimeout() (context.Context, context.CancelFunc) {
+	if config.buildTimeout > 0 {
+		return context.WithTimeout(context.Background(), config.buildTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func (task *buildTask) buildESM() (esm *ESMeta, pkgCSS bool, err error) {
+	defer func() {
+		// the unmarked errors are caused by the server
+		err = withKind(ErrInternal, err)
+	}()
+
 	hasher := sha1.New()
 	hasher.Write([]byte(task.ID()))
+
+	// serialize the builds of other processes that share the storage
+	if config.sharedStorage {
+		var unlock func()
+		unlock, err = lockFile(path.Join(config.storageDir, "locks", hex.EncodeToString(hasher.Sum(nil))+".lock"))
+		if err != nil {
+			return
+		}
+		defer unlock()
+
+		// the build may be done by other process during waiting for the lock
+		if m, css, ok := findESM(task.ID()); ok {
+			return m, css, nil
+		}
+	}
+
+	// the emitted assets are removed with the build files if the build fails
+	var assets []string
+
 	task.wd = path.Join(os.TempDir(), "esm-build-"+hex.EncodeToString(hasher.Sum(nil)))
+	// clean the dir kept by the previous failed build
+	os.RemoveAll(task.wd)
 	ensureDir(task.wd)
-	defer os.RemoveAll(task.wd)
+	defer func() {
+		if err != nil && config.keepBuildDir {
+			log.Warnf("build(%s): keep the build dir %s", task.ID(), task.wd)
+			return
+		}
+		os.RemoveAll(task.wd)
+	}()
 
 	env := "production"
 	if task.isDev {
 		env = "development"
 	}
-	esmeta, err := initBuild(task.wd, task.pkg, true, env)
+	ctx, cancel := withBuildTimeout()
+	defer cancel()
+	blog := newBuildLog()
+	ctx = withBuildLog(ctx, blog)
+	blog.Printf("build %s", task.ID())
+	defer func() {
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = withKind(ErrBuildTimeout, fmt.Errorf("build timeout after %v", config.buildTimeout))
+		}
+		if err != nil {
+			blog.Printf("error: %v", err)
+			if id, e := blog.save(); e == nil {
+				err = &loggedError{withKind(ErrInternal, err), id}
+			} else {
+				log.Errorf("save build log: %v", e)
+			}
+			// remove the files of the failed build
+			getStorage().Delete(path.Join("builds", task.ID()+".js"))
+			getStorage().Delete(path.Join("builds", task.ID()+".js.sig"))
+			getStorage().Delete(path.Join("builds", task.ID()+".css"))
+			getStorage().Delete(path.Join("builds", task.ID()+".metafile.json"))
+			getStorage().Delete(path.Join("builds", task.ID()+".provenance.json"))
+			for _, asset := range assets {
+				getStorage().Delete(path.Join("builds", asset))
+			}
+		} else if task.debug {
+			if id, e := blog.save(); e == nil {
+				task.logID = id
+			} else {
+				log.Errorf("save build log: %v", e)
+			}
+		}
+	}()
+
+	esmeta, err := initBuild(ctx, task.wd, task.pkg, task.deps, true, !task.typesOnly, task.typesVersion, env)
 	if err != nil {
 		return
 	}
 
-	start := time.Now()
-	buf := bytes.NewBuffer(nil)
-	importPath := task.pkg.ImportPath()
-	exports := newStringSet()
-	hasDefaultExport := false
-	for _, name := range esmeta.Exports {
-		if name == "default" {
-			hasDefaultExport = true
-		} else if name != "import" {
-			exports.Add(name)
+	// types-only packages(like `@types/react`) and types-only requests have
+	// nothing to bundle, just copy the declaration files and write a stub module
+	if task.typesOnly || isTypesPackage(task.pkg.name) {
+		err = task.handleDTS(esmeta)
+		if err != nil {
+			return
+		}
+		err = getStorage().Put(path.Join("builds", task.ID()+".js"), strings.NewReader(fmt.Sprintf("/* esm.sh - types only(%s) */\nexport default null;\n", task.pkg.String())))
+		if err != nil {
+			return
+		}
+		err = task.storeESM(esmeta, false)
+		if err != nil {
+			return
 		}
+		esm = esmeta
+		return
 	}
-	if exports.Size() > 0 {
-		fmt.Fprintf(buf, `import * as __star from "%s";%s`, importPath, "\n")
-		fmt.Fprintf(buf, `export const { %s } = __star;%s`, strings.Join(exports.Values(), ","), "\n")
+
+	err = task.checkEntry(esmeta)
+	if err != nil {
+		return
 	}
-	if esmeta.Module == "" || hasDefaultExport {
-		fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
+
+	// parse the exports of the specified entry instead of the package main, the
+	// custom conditions may match an entry other than the default one
+	entry := task.entryFile()
+	if entry == "" && len(task.conditions) > 0 && task.pkg.submodule == "" {
+		if module, _ := esmeta.ResolveExport(".", task.conditions...); module != "" && module != esmeta.Module {
+			entry = strings.TrimPrefix(module, "./")
+		}
+	}
+	if entry != "" {
+		exports, isESM, e := parseESModuleExports(task.wd, path.Join(task.pkg.name, entry))
+		if e != nil && os.IsExist(e) {
+			err = e
+			return
+		}
+		if isESM {
+			esmeta.Module = entry
+			esmeta.Exports = exports
+		} else {
+			var ret cjsModuleLexerResult
+			ret, err = parseCJSModuleExportsContext(ctx, task.wd, path.Join(task.pkg.name, entry), env)
+			if err != nil {
+				return
+			}
+			esmeta.Module = ""
+			esmeta.Exports = ret.Exports
+		}
+	}
+
+	tsconfig, err := task.writeTsconfig()
+	if err != nil {
+		return
+	}
+
+	if task.transform {
+		err = task.transformFile(esmeta, env, tsconfig)
+		if err != nil {
+			return
+		}
+		err = task.handleDTS(esmeta)
+		if err != nil {
+			return
+		}
+		err = task.storeProvenance(esmeta)
+		if err != nil {
+			return
+		}
+		err = task.storeESM(esmeta, false)
+		if err != nil {
+			return
+		}
+		esm = esmeta
+		return
+	}
+
+	// fall back to the exports found by esbuild when nodejs and the static parser
+	// can't tell them, like the esm-only packages can't be required by nodejs
+	if len(esmeta.Exports) == 0 {
+		exports, e := parseModuleExportsByEsbuild(task.wd, task.pkg.ImportPath(), true)
+		if e != nil {
+			blog.Printf("parse exports by esbuild: %v", e)
+		} else if len(exports) > 0 {
+			blog.Printf("parse exports by esbuild: %s", strings.Join(exports, ","))
+			esmeta.Exports = exports
+		}
 	}
+
+	start := time.Now()
 	input := &api.StdinOptions{
-		Contents:   buf.String(),
+		Contents:   task.entryCode(esmeta),
 		ResolveDir: task.wd,
 		Sourcefile: "export.js",
 	}
-	minify := !task.isDev
+	minify := task.shouldMinify()
+	platform := api.PlatformBrowser
+	if task.platform == "node" {
+		platform = api.PlatformNode
+	}
+	esmeta.Platform = task.platform
+	if platform != api.PlatformNode {
+		if warning := checkNodeEngine(esmeta.NpmPackage, task.target); warning != "" {
+			esmeta.Warnings = append(esmeta.Warnings, warning)
+			blog.Printf("warning: %s", warning)
+		}
+	}
+	if message := esmeta.DeprecatedMessage(); message != "" {
+		warning := fmt.Sprintf("package '%s@%s' is deprecated: %s", esmeta.Name, esmeta.Version, message)
+		esmeta.Warnings = append(esmeta.Warnings, warning)
+		blog.Printf("warning: %s", warning)
+	}
 	define := map[string]string{
 		"__filename":                  fmt.Sprintf(`"https://%s/%s.js"`, config.domain, task.ID()),
 		"__dirname":                   fmt.Sprintf(`"https://%s/%s"`, config.domain, path.Dir(task.ID())),
-		"process":                     "__process$",
-		"Buffer":                      "__Buffer$",
-		"setImmediate":                "__setImmediate$",
-		"clearImmediate":              "clearTimeout",
-		"require.resolve":             "__rResolve$",
 		"process.env.NODE_ENV":        fmt.Sprintf(`"%s"`, env),
-		"global":                      "__global$",
-		"global.process":              "__process$",
-		"global.Buffer":               "__Buffer$",
-		"global.setImmediate":         "__setImmediate$",
-		"global.clearImmediate":       "clearTimeout",
-		"global.require.resolve":      "__rResolve$",
 		"global.process.env.NODE_ENV": fmt.Sprintf(`"%s"`, env),
 	}
+	// polyfill the nodejs globals, the node platform doesn't need them
+	polyfillGlobals := map[string]string{
+		"process":                "__process$",
+		"Buffer":                 "__Buffer$",
+		"setImmediate":           "__setImmediate$",
+		"clearImmediate":         "clearTimeout",
+		"require.resolve":        "__rResolve$",
+		"global":                 "__global$",
+		"global.process":         "__process$",
+		"global.Buffer":          "__Buffer$",
+		"global.setImmediate":    "__setImmediate$",
+		"global.clearImmediate":  "clearTimeout",
+		"global.require.resolve": "__rResolve$",
+	}
+	if platform != api.PlatformNode {
+		for k, v := range polyfillGlobals {
+			define[k] = v
+		}
+	}
+	// the umd wrapper registers the module to the amd loader of the page if there
+	// is one, then the `module.exports` is empty; force the commonjs branch
+	if esmeta.Module == "" && isUMDModule(task.mainFile(esmeta)) {
+		define["define"] = "undefined"
+		blog.Printf("umd module detected, use the commonjs interop")
+	}
+	// the main fields and the conditions are configured per platform
+	platformEntry := config.entryResolution.platformEntry(task.entryPlatform())
+	mainFields := make([]string, 0, len(platformEntry.MainFields))
+	for _, name := range platformEntry.MainFields {
+		if name != "browser" || !task.noBrowser {
+			mainFields = append(mainFields, name)
+		}
+	}
+	// esbuild applies the `browser` field of the object form on the browser
+	// platform regardless of the main fields, the neutral platform doesn't
+	if task.noBrowser && platform == api.PlatformBrowser {
+		platform = api.PlatformNeutral
+	}
+	// honor the `browser` field of package.json if it's a main field
+	useBrowserField := false
+	for _, name := range mainFields {
+		if name == "browser" {
+			useBrowserField = true
+		}
+	}
+	browserMap := map[string]interface{}{}
+	if useBrowserField {
+		if m := esmeta.BrowserMap(); m != nil {
+			browserMap = m
+		}
+		if main := esmeta.BrowserMain(); main != "" && task.pkg.submodule == "" {
+			esmeta.Main = main
+		}
+	}
+	var conditions []string
+	conditions = append(conditions, task.conditions...)
+	conditions = append(conditions, platformEntry.Conditions...)
 	external := newStringSet()
 	extraExternal := newStringSet()
+	override := getBuildOverride(task.pkg.name)
+	if override == nil {
+		override = &BuildOverride{}
+	}
+	preset := getPreset(task.preset)
+	for k, v := range override.Define {
+		if _, ok := define[k]; !ok {
+			define[k] = v
+		}
+	}
+	for _, name := range override.External {
+		external.Add(name)
+	}
+	// the asset urls are absolute since the modules are imported by the pages of
+	// other origins usually, the urls are resolved by the origin of the page
+	assetsHost := config.domain
+	if config.cdnDomain != "" {
+		assetsHost = config.cdnDomain
+	}
+	assetsURL := fmt.Sprintf("https://%s%s/%s/", assetsHost, config.basePath, path.Dir(task.ID()))
+	resolveRetries := 0
+	buildTarget := task.target
+	inlined := newStringSet()
+	peerExternals := newStringSet()
+	depSizes := &depSizeCache{wd: task.wd, m: map[string]int64{}}
+	pkgDir := path.Join(task.wd, "node_modules", task.pkg.name)
+	tsPaths := task.readTsconfig().CompilerOptions.Paths
 	esmResolverPlugin := api.Plugin{
 		Name: "esm-resolver",
 		Setup: func(plugin api.PluginBuild) {
 			plugin.OnResolve(
 				api.OnResolveOptions{Filter: ".*"},
-				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+				func(args api.OnResolveArgs) (ret api.OnResolveResult, err error) {
+					if task.debug {
+						defer func() {
+							blog.Printf("resolve '%s' (imported by %s): %s", args.Path, args.Importer, describeResolve(ret))
+						}()
+					}
+
 					p := strings.TrimSuffix(args.Path, "/")
+
+					// remap the modules imported by the package files by its `browser`
+					// field, the relative file mappings are handled by esbuild itself
+					if v, ok := browserMap[p]; ok && !isFileImportPath(p) && strings.HasPrefix(args.Importer, pkgDir+"/") {
+						if to, ok := v.(string); ok && to != "" {
+							if isFileImportPath(to) {
+								sideEffects := api.SideEffectsTrue
+								if !esmeta.HasSideEffects() {
+									sideEffects = api.SideEffectsFalse
+								}
+								return api.OnResolveResult{
+									Path:        path.Join(task.wd, "node_modules", task.pkg.name, to),
+									SideEffects: sideEffects,
+								}, nil
+							}
+							p = to
+						} else if v == false {
+							return api.OnResolveResult{Path: p, Namespace: "browser-ignore"}, nil
+						}
+					}
+
+					// the tsconfig aliases of the package files are resolved by esbuild
+					if strings.HasPrefix(args.Importer, pkgDir+"/") && matchTsconfigPaths(tsPaths, p) {
+						return api.OnResolveResult{}, nil
+					}
+
 					importName := task.pkg.name
 					if s := task.pkg.submodule; s != "" {
 						importName += "/" + s
 					}
 
+					// use the entry specified by the `entry` query or the override
+					if entry := task.entryFile(); p == importName && entry != "" {
+						return api.OnResolveResult{Path: resolveFile(path.Join(task.wd, "node_modules", task.pkg.name, entry))}, nil
+					}
+
+					// the externals of the preset are never bundled, except the package itself
+					if preset != nil && !isFileImportPath(p) && preset.isExternal(p) {
+						if name, _ := splitPkgPath(p); name != task.pkg.name {
+							external.Add(p)
+							return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL__:" + p, External: true}, nil
+						}
+					}
+
+					// the aliased modules are always external
+					if to, ok := override.Alias[p]; ok && p != importName {
+						external.Add(to)
+						return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL__:" + to, External: true}, nil
+					}
+
+					// the global externals are never bundled, including their submodules,
+					// except the modules of the package itself
+					if name, _ := splitPkgPath(p); name != task.pkg.name && isGlobalExternal(p) {
+						external.Add(p)
+						return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL__:" + p, External: true}, nil
+					}
+
 					// should resolve:
 					// 1. current package itself
 					// 2. sub-modules of current package
@@ -146,18 +607,40 @@ func (task *buildTask) buildESM() (esm *ESMeta, pkgCSS bool, err error) {
 						return api.OnResolveResult{}, nil
 					}
 
-					// bundle all deps except peer deps in bundle mode
+					// bundle all deps except peer deps in bundle mode, the standalone mode bundles peer deps too
 					if task.bundle && !builtInNodeModules[p] {
 						_, ok := esmeta.PeerDependencies[p]
-						if !ok {
+						if !ok || task.standalone {
+							return api.OnResolveResult{}, nil
+						}
+					}
+
+					// inline the small deps except peer deps
+					if task.inlineSize > 0 && !builtInNodeModules[p] {
+						_, ok := esmeta.PeerDependencies[p]
+						if size := depSizes.get(p); !ok && size >= 0 && size <= task.inlineSize {
+							inlined.Add(p)
 							return api.OnResolveResult{}, nil
 						}
 					}
 
+					// the peer deps are externalized implicitly, unlike the other deps
+					if (task.bundle || task.inlineSize > 0) && !builtInNodeModules[p] {
+						if _, ok := esmeta.PeerDependencies[p]; ok {
+							peerExternals.Add(p)
+						}
+					}
 					external.Add(p)
 					return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL__:" + p, External: true}, nil
 				},
 			)
+			plugin.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "browser-ignore"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents := "module.exports = {};"
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				},
+			)
 		},
 	}
 	for name := range builtInNodeModules {
@@ -167,35 +650,100 @@ func (task *buildTask) buildESM() (esm *ESMeta, pkgCSS bool, err error) {
 	}
 
 esbuild:
+	// note: the esbuild v0.12 has no context API, the `Incremental` build can only
+	// rebuild with the same options, while the dev/prod and target variants of a
+	// package differ in the options(define, minify, target), so there is nothing
+	// to reuse across builds until esbuild is upgraded.
 	result := api.Build(api.BuildOptions{
 		Stdin:             input,
 		Outdir:            "/esbuild",
 		Write:             false,
 		Bundle:            true,
-		Target:            targets[task.target],
+		Target:            targets[buildTarget],
 		Format:            api.FormatESModule,
-		Platform:          api.PlatformBrowser,
+		Platform:          platform,
+		MainFields:        mainFields,
+		Conditions:        conditions,
 		MinifyWhitespace:  minify,
 		MinifyIdentifiers: minify,
 		MinifySyntax:      minify,
+		Charset:           task.charset(),
 		External:          external.Values(),
 		Define:            define,
 		Plugins:           []api.Plugin{esmResolverPlugin},
+		Tsconfig:          tsconfig,
+		LegalComments:     legalComments[task.comments],
+		Footer:            jsOutputText(config.footer),
+		// the messages are written to the build log rather than the stderr
+		LogLevel: api.LogLevelSilent,
+		// the `.wasm` files are emitted as the assets next to the build file, the imports are
+		// rewritten to the urls of the assets
+		Loader:     map[string]api.Loader{".wasm": api.LoaderFile},
+		AssetNames: "[name]-[hash]",
+		PublicPath: assetsURL,
+		// the metafile doesn't change the output, always generate it for the `analyze` query
+		Metafile: true,
 	})
 
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+
+	blog.Printf("esbuild: %d errors, %d warnings", len(result.Errors), len(result.Warnings))
+	for _, e := range result.Errors {
+		blog.Printf("esbuild error: %s", formatMessage(e))
+	}
+	for _, w := range result.Warnings {
+		blog.Printf("esbuild warning: %s", formatMessage(w))
+	}
+
 	if len(result.Errors) > 0 {
-		// mark the missing module as external to exclude it from the bundle
-		msg := result.Errors[0].Text
-		if strings.HasPrefix(msg, "Could not resolve \"") && strings.Contains(msg, "mark it as external to exclude it from the bundle") {
-			log.Warnf("esbuild(%s): %s", task.ID(), msg)
-			name := strings.Split(msg, "\"")[1]
-			if !extraExternal.Has(name) {
+		// mark the missing modules as external to exclude them from the bundle
+		missing := []string{}
+		for _, e := range result.Errors {
+			msg := e.Text
+			if strings.HasPrefix(msg, "Could not resolve \"") && strings.Contains(msg, "mark it as external to exclude it from the bundle") {
+				log.Warnf("esbuild(%s): %s", task.ID(), msg)
+				name := strings.Split(msg, "\"")[1]
+				if !extraExternal.Has(name) {
+					missing = append(missing, name)
+				}
+			}
+		}
+		if len(missing) > 0 {
+			if resolveRetries >= config.maxResolveRetries {
+				err = withKind(ErrBuildFailed, fmt.Errorf(
+					"esbuild: unresolved modules after %d retries: %s",
+					resolveRetries,
+					strings.Join(append(esmeta.MissingDeps, missing...), ", "),
+				))
+				return
+			}
+			for _, name := range missing {
 				external.Add(name)
 				extraExternal.Add(name)
+			}
+			esmeta.MissingDeps = append(esmeta.MissingDeps, missing...)
+			resolveRetries++
+			goto esbuild
+		}
+		// a dep imports a native addon, no target works
+		if msg := result.Errors[0].Text; strings.HasPrefix(msg, "No loader is configured for \".node\" files") {
+			err = withKind(ErrUnsupportedPackage, fmt.Errorf("a native addon can't be bundled for the browser (%s)", msg))
+			return
+		}
+		// retry with the lower target, the output of a lower target works in the higher one
+		if config.targetFallback {
+			if lower := lowerTarget(buildTarget); lower != "" {
+				log.Warnf("esbuild(%s): build failed with target %s, fall back to %s", task.ID(), buildTarget, lower)
+				blog.Printf("fall back to target %s", lower)
+				buildTarget = lower
+				esmeta.EffectiveTarget = lower
 				goto esbuild
 			}
 		}
-		err = errors.New("esbuild: " + msg)
+		err = withKind(ErrBuildFailed, errors.New("esbuild: "+result.Errors[0].Text))
 		return
 	}
 
@@ -203,6 +751,21 @@ esbuild:
 		log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
 	}
 
+	esmeta.PeerExternals = peerExternals.Values()
+	sort.Strings(esmeta.PeerExternals)
+
+	if task.inlineSize > 0 {
+		esmeta.InlinedDeps = inlined.Values()
+		sort.Strings(esmeta.InlinedDeps)
+		esmeta.ExternalDeps = []string{}
+		for _, name := range external.Values() {
+			if !builtInNodeModules[name] {
+				esmeta.ExternalDeps = append(esmeta.ExternalDeps, name)
+			}
+		}
+		sort.Strings(esmeta.ExternalDeps)
+	}
+
 	cssMark := []byte{0}
 	for _, file := range result.OutputFiles {
 		outputContent := file.Contents
@@ -213,177 +776,56 @@ esbuild:
 				if task.pkg.submodule != "" {
 					s += "/" + task.pkg.submodule
 				}
-				if (!task.isDev && bytes.Contains(outputContent, []byte(fmt.Sprintf("}from\"%s\"", s)))) ||
-					(task.isDev && bytes.Contains(outputContent, []byte(fmt.Sprintf("} from \"%s\"", s)))) {
-					err = errors.New("unexpected esbuild output")
+				if (minify && bytes.Contains(outputContent, []byte(fmt.Sprintf("}from\"%s\"", s)))) ||
+					(!minify && bytes.Contains(outputContent, []byte(fmt.Sprintf("} from \"%s\"", s)))) {
+					err = withKind(ErrBuildFailed, errors.New("unexpected esbuild output"))
 					return
 				}
 			}
 
-			jsHeader := bytes.NewBufferString(fmt.Sprintf(
-				"/* esm.sh - esbuild bundle(%s) %s %s */\n",
-				task.pkg.String(),
-				strings.ToLower(task.target),
-				env,
-			))
+			comment := ""
+			if task.comments != "none" {
+				comment = fmt.Sprintf(
+					"/* esm.sh - esbuild bundle(%s) %s %s */\n",
+					task.pkg.String(),
+					strings.ToLower(buildTarget),
+					env,
+				)
+			}
+			jsHeader := bytes.NewBuffer(nil)
 			eol := "\n"
-			if !task.isDev {
+			if minify {
 				eol = ""
 			}
 
-			// replace external imports/requires
-			for _, name := range external.Values() {
-				var importPath string
-				if name == "buffer" {
-					importPath = fmt.Sprintf("/v%d/node_buffer.js", VERSION)
-				}
-				if importPath == "" && builtInNodeModules[name] {
-					if task.target == "deno" && denoStdNodeModules[name] {
-						importPath = fmt.Sprintf("/v%d/deno_std_node_%s.js", VERSION, name)
-					} else {
-						polyfill, ok := polyfilledBuiltInNodeModules[name]
-						if ok {
-							p, submodule, e := node.getPackageInfo(polyfill, "latest")
-							if e != nil {
-								err = e
-								return
-							}
-							filename := path.Base(p.Name)
-							if submodule != "" {
-								filename = submodule
-							}
-							if task.isDev {
-								filename += ".development"
-							}
-							if task.bundle {
-								filename += ".bundle"
-							}
-							importPath = fmt.Sprintf(
-								"/v%d/%s@%s/%s/%s.js",
-								VERSION,
-								p.Name,
-								p.Version,
-								task.target,
-								filename,
-							)
-						} else {
-							_, err := embedFS.Open(fmt.Sprintf("embed/polyfills/node_%s.js", name))
-							if err == nil {
-								importPath = fmt.Sprintf("/v%d/node_%s.js", VERSION, name)
-							} else {
-								importPath = fmt.Sprintf(
-									"/error.js?type=unsupported-nodejs-builtin-module&name=%s&importer=%s",
-									name,
-									task.pkg.name,
-								)
-							}
-						}
-					}
-				}
-				// get package info via `deps` query
-				if importPath == "" {
-					for _, dep := range task.deps {
-						if name == dep.name {
-							filename := path.Base(dep.name)
-							if dep.submodule != "" {
-								filename = dep.submodule
-							}
-							if task.isDev {
-								filename += ".development"
-							}
-							if task.bundle {
-								filename += ".bundle"
-							}
-							importPath = fmt.Sprintf(
-								"/v%d/%s@%s/%s/%s.js",
-								VERSION,
-								dep.name,
-								dep.version,
-								task.target,
-								filename,
-							)
-							break
-						}
-					}
-				}
-				// get package info from package.json
-				if importPath == "" {
-					packageFile := path.Join(task.wd, "node_modules", name, "package.json")
-					if fileExists(packageFile) {
-						var p NpmPackage
-						if utils.ParseJSONFile(packageFile, &p) == nil {
-							suffix := ""
-							if task.isDev {
-								suffix = ".development"
-							}
-							if task.bundle {
-								suffix = ".bundle"
-							}
-							suffix += ".js"
-							importPath = fmt.Sprintf(
-								"/v%d/%s@%s/%s/%s%s",
-								VERSION,
-								p.Name,
-								p.Version,
-								task.target,
-								path.Base(p.Name),
-								suffix,
-							)
-						}
-					}
-				}
-				// get package info from network
-				if importPath == "" {
-					version := "latest"
-					for n, v := range esmeta.Dependencies {
-						if name == n {
-							version = v
-							break
-						}
+			// replace external imports/requires in one pass, that copies the output only once
+			// for the big bundles, the imports are added to the header in the order they appear
+			if marker := []byte("\"__ESM_SH_EXTERNAL__:"); bytes.Contains(outputContent, marker) {
+				buf := bytes.NewBuffer(make([]byte, 0, len(outputContent)))
+				importPaths := map[string]string{}
+				commonjsImported := newStringSet()
+				commonjsContext := false
+				for {
+					i := bytes.Index(outputContent, marker)
+					if i < 0 {
+						break
 					}
-					if version == "latest" {
-						for n, v := range esmeta.PeerDependencies {
-							if name == n {
-								version = v
-								break
-							}
-						}
+					j := bytes.IndexByte(outputContent[i+len(marker):], '"')
+					if j < 0 {
+						break
 					}
-					p, submodule, e := node.getPackageInfo(name, version)
-					if e == nil {
-						filename := path.Base(p.Name)
-						if submodule != "" {
-							filename = submodule
-						}
-						if task.isDev {
-							filename += ".development"
-						}
-						if task.bundle {
-							filename += ".bundle"
+					p := outputContent[:i]
+					name := string(outputContent[i+len(marker) : i+len(marker)+j])
+					outputContent = outputContent[i+len(marker)+j+1:]
+					importPath, ok := importPaths[name]
+					if !ok {
+						importPath, err = task.resolveExternal(name, esmeta)
+						if err != nil {
+							return
 						}
-						importPath = fmt.Sprintf(
-							"/v%d/%s@%s/%s/%s.js",
-							VERSION,
-							p.Name,
-							p.Version,
-							task.target,
-							filename,
-						)
+						importPaths[name] = importPath
 					}
-				}
-				if importPath == "" {
-					importPath = fmt.Sprintf(
-						"/error.js?type=resolve&name=%s&importer=%s",
-						name,
-						task.pkg.name,
-					)
-				}
-				buf := bytes.NewBuffer(nil)
-				identifier := identify(name)
-				slice := bytes.Split(outputContent, []byte(fmt.Sprintf("\"__ESM_SH_EXTERNAL__:%s\"", name)))
-				commonjsContext := false
-				commonjsImported := false
-				for i, p := range slice {
+					identifier := identify(name)
 					if commonjsContext {
 						p = bytes.TrimPrefix(p, []byte{')'})
 					}
@@ -401,9 +843,9 @@ esbuild:
 						if shift > 0 {
 							p = p[0 : len(p)-(shift+1)]
 						}
-						if !commonjsImported {
+						if !commonjsImported.Has(name) {
 							wrote := false
-							versionPrefx := fmt.Sprintf("/v%d/", VERSION)
+							versionPrefx := withBasePath(fmt.Sprintf("/v%d/", VERSION))
 							if strings.HasPrefix(importPath, versionPrefx) {
 								pkg, err := parsePkg(strings.TrimPrefix(importPath, versionPrefx))
 								if err == nil {
@@ -413,7 +855,7 @@ esbuild:
 									if !installed {
 										_, installed = esmeta.PeerDependencies[name]
 									}
-									meta, err := initBuild(task.wd, *pkg, !installed, env)
+									meta, err := initBuild(ctx, task.wd, *pkg, nil, !installed, true, "", env)
 									if err == nil && meta.Module != "" {
 										hasDefaultExport := false
 										if len(meta.Exports) > 0 {
@@ -434,27 +876,29 @@ esbuild:
 							if !wrote {
 								fmt.Fprintf(jsHeader, `import __%s$ from "%s";%s`, identifier, importPath, eol)
 							}
-							commonjsImported = true
+							commonjsImported.Add(name)
 						}
 					}
 					buf.Write(p)
-					if i < len(slice)-1 {
-						if commonjsContext {
-							buf.WriteString(fmt.Sprintf("__%s$", identifier))
-						} else {
-							buf.WriteString(fmt.Sprintf("\"%s\"", importPath))
-						}
+					if commonjsContext {
+						buf.WriteString(fmt.Sprintf("__%s$", identifier))
+					} else {
+						buf.WriteString(fmt.Sprintf("\"%s\"", importPath))
 					}
 				}
+				if commonjsContext {
+					outputContent = bytes.TrimPrefix(outputContent, []byte{')'})
+				}
+				buf.Write(outputContent)
 				outputContent = buf.Bytes()
 			}
 
 			// add nodejs/deno compatibility
 			if bytes.Contains(outputContent, []byte("__process$")) {
-				fmt.Fprintf(jsHeader, `import __process$ from "/v%d/node_process.js";%s__process$.env.NODE_ENV="%s";%s`, VERSION, eol, env, eol)
+				fmt.Fprintf(jsHeader, `import __process$ from "%s/v%d/node_process.js";%s__process$.env.NODE_ENV="%s";%s`, config.basePath, VERSION, eol, env, eol)
 			}
 			if bytes.Contains(outputContent, []byte("__Buffer$")) {
-				fmt.Fprintf(jsHeader, `import { Buffer as __Buffer$ } from "/v%d/node_buffer.js";%s`, VERSION, eol)
+				fmt.Fprintf(jsHeader, `import { Buffer as __Buffer$ } from "%s/v%d/node_buffer.js";%s`, config.basePath, VERSION, eol)
 			}
 			if bytes.Contains(outputContent, []byte("__global$")) {
 				fmt.Fprintf(jsHeader, `var __global$ = window;%s`, eol)
@@ -466,40 +910,82 @@ esbuild:
 				fmt.Fprintf(jsHeader, `var __rResolve$ = p => p;%s`, eol)
 			}
 
-			saveFilePath := path.Join(config.storageDir, "builds", task.ID()+".js")
-			ensureDir(path.Dir(saveFilePath))
-
-			var file *os.File
-			file, err = os.Create(saveFilePath)
-			if err != nil {
-				return
+			header := jsHeader.Bytes()
+			if task.systemjs {
+				outputContent, err = systemjsModule(append(header, outputContent...), minify)
+				if err != nil {
+					err = withKind(ErrBuildFailed, err)
+					return
+				}
+				header = nil
 			}
-			defer file.Close()
-
-			_, err = io.Copy(file, jsHeader)
-			if err != nil {
-				return
+			header = append([]byte(comment), header...)
+			// the banner goes first, before the imports of the header
+			if config.banner != "" {
+				header = append([]byte(config.banner+"\n"), header...)
 			}
-
-			_, err = io.Copy(file, bytes.NewReader(outputContent))
+			if task.standalone && len(outputContent) > standaloneSizeWarning {
+				warning := fmt.Sprintf("the standalone bundle is %d KB, consider the bundle mode that imports the peer deps", len(outputContent)>>10)
+				log.Warnf("esbuild(%s): %s", task.ID(), warning)
+				esmeta.Warnings = append(esmeta.Warnings, warning)
+			}
+			esmeta.SRI = sriHash(header, outputContent)
+			err = getStorage().Put(path.Join("builds", task.ID()+".js"), io.MultiReader(bytes.NewReader(header), bytes.NewReader(outputContent)))
 			if err != nil {
 				return
 			}
-		} else if strings.HasSuffix(file.Path, ".css") {
-			saveFilePath := path.Join(config.storageDir, "builds", task.ID()+".css")
-			ensureDir(path.Dir(saveFilePath))
-			file, e := os.Create(saveFilePath)
-			if e != nil {
-				err = e
-				return
+			// the `.sig` file is the detached signature of the build file
+			sig := signBuild(header, outputContent)
+			if sig != nil {
+				err = getStorage().Put(path.Join("builds", task.ID()+".js.sig"), bytes.NewReader(sig))
+				if err != nil {
+					return
+				}
 			}
-			defer file.Close()
-
-			_, err = io.Copy(file, bytes.NewReader(outputContent))
+			// the `.mjs` copy is made from the new build file once it's requested
+			getStorage().Delete(path.Join("builds", task.ID()+".mjs"))
+			// the content-addressed copy gets a new url once the output changes, the old copies are kept
+			// for the cached imports
+			if config.contentHash {
+				hashedPath := fmt.Sprintf("%s.%s.js", task.ID(), contentHash(header, outputContent))
+				err = getStorage().Put(path.Join("builds", hashedPath), io.MultiReader(bytes.NewReader(header), bytes.NewReader(outputContent)))
+				if err != nil {
+					return
+				}
+				if sig != nil {
+					err = getStorage().Put(path.Join("builds", hashedPath+".sig"), bytes.NewReader(sig))
+					if err != nil {
+						return
+					}
+				}
+				esmeta.HashedPath = "/" + hashedPath
+			}
+		} else if strings.HasSuffix(file.Path, ".css") {
+			err = getStorage().Put(path.Join("builds", task.ID()+".css"), bytes.NewReader(outputContent))
 			if err != nil {
 				return
 			}
 			cssMark = []byte{1}
+		} else if strings.HasSuffix(file.Path, ".wasm") {
+			asset := path.Join(path.Dir(task.ID()), path.Base(file.Path))
+			assets = append(assets, asset)
+			err = getStorage().Put(path.Join("builds", asset), bytes.NewReader(outputContent))
+			if err != nil {
+				return
+			}
+			esmeta.Assets = append(esmeta.Assets, "/"+asset)
+		} else if strings.HasSuffix(file.Path, ".LEGAL.txt") {
+			err = getStorage().Put(path.Join("builds", task.ID()+".js.LEGAL.txt"), bytes.NewReader(outputContent))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if result.Metafile != "" {
+		err = getStorage().Put(path.Join("builds", task.ID()+".metafile.json"), strings.NewReader(result.Metafile))
+		if err != nil {
+			return
 		}
 	}
 
@@ -510,6 +996,31 @@ esbuild:
 		return
 	}
 
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+
+	err = task.storeProvenance(esmeta)
+	if err != nil {
+		return
+	}
+
+	err = task.storeESM(esmeta, cssMark[0] == 1)
+	if err != nil {
+		return
+	}
+
+	esm = esmeta
+	pkgCSS = cssMark[0] == 1
+	return
+}
+
+func (task *buildTask) storeESM(esmeta *ESMeta, pkgCSS bool) (err error) {
+	cssMark := []byte{0}
+	if pkgCSS {
+		cssMark = []byte{1}
+	}
 	_, err = db.Put(
 		q.Alias(task.ID()),
 		q.KV{
@@ -520,32 +1031,610 @@ esbuild:
 	if err != nil && err == postdb.ErrDuplicateAlias {
 		err = nil
 	}
-	if err != nil {
+	return
+}
+
+// legalComments maps the `comments` query to the esbuild option, the `none`
+// mode removes the esm.sh header comment too.
+var legalComments = map[string]api.LegalComments{
+	"none":     api.LegalCommentsNone,
+	"inline":   api.LegalCommentsInline,
+	"eof":      api.LegalCommentsEndOfFile,
+	"external": api.LegalCommentsExternal,
+}
+
+// shouldMinify returns true if the output should be minified, the output is
+// minified in production and not in development by default.
+func (task *buildTask) shouldMinify() bool {
+	if task.isDev {
+		return task.forceMinify
+	}
+	return !task.noMinify
+}
+
+// charset returns the esbuild charset option, the non-ASCII characters are
+// escaped by default that keeps the output working with any encoding.
+func (task *buildTask) charset() api.Charset {
+	if task.utf8 {
+		return api.CharsetUTF8
+	}
+	return api.CharsetDefault
+}
+
+// escapeEntryPath escapes the entry path as a segment of the build id like the
+// json pointer, the file names may contain both `~` and `_`, so `~` is escaped
+// as `~0` and `/` as `~1`.
+func escapeEntryPath(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// unescapeEntryPath reverts the `escapeEntryPath`.
+func unescapeEntryPath(s string) string {
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(s)
+}
+
+// bannerHash returns a short hash of the banner and the footer that is used as
+// a part of the build id.
+func bannerHash() string {
+	sum := sha1.Sum([]byte(config.banner + "\x00" + config.footer))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// jsOutputText returns the esbuild banner/footer option of js output.
+func jsOutputText(text string) map[string]string {
+	if text == "" {
+		return nil
+	}
+	return map[string]string{"js": text}
+}
+
+// entryFile returns the entry file specified by the `entry` query or the build
+// override, the query wins; it's ignored when a submodule is requested.
+func (task *buildTask) entryFile() string {
+	if task.pkg.submodule != "" {
+		return ""
+	}
+	if task.entry != "" {
+		return task.entry
+	}
+	if o := getBuildOverride(task.pkg.name); o != nil {
+		return o.Entry
+	}
+	return ""
+}
+
+// formatMessage formats the esbuild message with the location and the notes.
+func formatMessage(m api.Message) string {
+	buf := strings.Builder{}
+	if l := m.Location; l != nil {
+		fmt.Fprintf(&buf, "%s:%d:%d: ", l.File, l.Line, l.Column)
+	}
+	buf.WriteString(m.Text)
+	for _, n := range m.Notes {
+		buf.WriteString("\n  note: ")
+		if l := n.Location; l != nil {
+			fmt.Fprintf(&buf, "%s:%d:%d: ", l.File, l.Line, l.Column)
+		}
+		buf.WriteString(n.Text)
+	}
+	return buf.String()
+}
+
+// describeResolve describes the resolve result of the esm resolver plugin.
+func describeResolve(ret api.OnResolveResult) string {
+	switch {
+	case ret.External:
+		return "external " + strings.TrimPrefix(ret.Path, "__ESM_SH_EXTERNAL__:")
+	case ret.Namespace == "browser-ignore":
+		return "ignored by the browser field"
+	case ret.Path != "":
+		return ret.Path
+	default:
+		return "resolved by esbuild"
+	}
+}
+
+// mainFile returns the path of the file that the build imports, returns empty
+// string if it can't be resolved.
+func (task *buildTask) mainFile(esmeta *ESMeta) string {
+	main := esmeta.Main
+	if entry := task.entryFile(); entry != "" {
+		main = entry
+	} else if task.pkg.submodule != "" {
+		main = task.pkg.submodule
+	}
+	if main == "" {
+		main = "index.js"
+	}
+	return resolveFile(path.Join(task.wd, "node_modules", task.pkg.name, main))
+}
+
+// entryPlatform returns the platform of the entry resolution, the deno target
+// doesn't use the `browser` field by default.
+func (task *buildTask) entryPlatform() string {
+	if task.platform == "node" {
+		return "node"
+	}
+	if task.target == "deno" {
+		return "deno"
+	}
+	return "browser"
+}
+
+// checkEntry ensures the import path resolves to a real file, that reports a
+// clear error instead of the confusing one of esbuild.
+func (task *buildTask) checkEntry(esmeta *ESMeta) error {
+	pkgDir := path.Join(task.wd, "node_modules", task.pkg.name)
+	if entry := task.entryFile(); entry != "" {
+		if resolveFile(path.Join(pkgDir, entry)) == "" {
+			return withKind(ErrPackageNotFound, fmt.Errorf(
+				"entry file '%s' not found in package '%s@%s'",
+				entry,
+				task.pkg.name,
+				task.pkg.version,
+			))
+		}
+		return nil
+	}
+	// the `exports` field is resolved by esbuild
+	if esmeta.DefinedExports != nil {
+		return nil
+	}
+	// no main fields means the `exports` field is enforced
+	if len(config.entryResolution.platformEntry(task.entryPlatform()).MainFields) == 0 {
+		return withKind(ErrUnsupportedPackage, fmt.Errorf(
+			"package '%s@%s' has no exports field, the entries are resolved by the exports field only",
+			task.pkg.name,
+			task.pkg.version,
+		))
+	}
+	var entries []string
+	if task.pkg.submodule != "" {
+		// the module and the main fields are of the package itself if the
+		// submodule is missing, only check the ones resolved for the submodule
+		entries = []string{task.pkg.submodule}
+		for _, entry := range []string{esmeta.Module, esmeta.Main} {
+			if entry == task.pkg.submodule || strings.HasPrefix(entry, task.pkg.submodule+"/") {
+				entries = append(entries, entry)
+			}
+		}
+	} else {
+		entries = []string{esmeta.Module, esmeta.Main, esmeta.BrowserMain(), "index"}
+	}
+	for _, entry := range entries {
+		if entry != "" && resolveFile(path.Join(pkgDir, entry)) != "" {
+			return nil
+		}
+	}
+	return withKind(ErrPackageNotFound, fmt.Errorf(
+		"package '%s@%s' has no entry point for import path '%s'",
+		task.pkg.name,
+		task.pkg.version,
+		task.pkg.ImportPath(),
+	))
+}
+
+// entryCode returns the code of the build entry that re-exports the package.
+func (task *buildTask) entryCode(esmeta *ESMeta) string {
+	return entryShims[task.shimVersion()](task, esmeta)
+}
+
+// entryCodeV1 returns the entry shim of the format version 1.
+func (task *buildTask) entryCodeV1(esmeta *ESMeta) string {
+	buf := bytes.NewBuffer(nil)
+	importPath := task.pkg.ImportPath()
+
+	// re-export the specified exports by name to let esbuild tree-shake the unused
+	// modules, that works best with the packages declaring `"sideEffects": false`
+	if len(task.exports) > 0 {
+		known := newStringSet()
+		for _, name := range esmeta.Exports {
+			known.Add(name)
+		}
+		names := []string{}
+		for _, name := range task.exports {
+			// the exports of cjs module are not always detectable
+			if esmeta.Module == "" || known.Has(name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			fmt.Fprintf(buf, `export { %s } from "%s";%s`, strings.Join(names, ","), importPath, "\n")
+		}
+		return buf.String()
+	}
+
+	exports := newStringSet()
+	hasDefaultExport := false
+	for _, name := range esmeta.Exports {
+		if name == "default" {
+			hasDefaultExport = true
+		} else if name != "import" {
+			exports.Add(name)
+		}
+	}
+	if exports.Size() > 0 {
+		// sort the names to keep the output byte-stable
+		names := exports.Values()
+		sort.Strings(names)
+		fmt.Fprintf(buf, `import * as __star from "%s";%s`, importPath, "\n")
+		fmt.Fprintf(buf, `export const { %s } = __star;%s`, strings.Join(names, ","), "\n")
+	}
+	if esmeta.Module == "" || hasDefaultExport {
+		fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
+	}
+	return buf.String()
+}
+
+// transformFile transforms a single file of the package without bundling,
+// the imports of the file are rewritten to the urls of esm.sh.
+func (task *buildTask) transformFile(esmeta *ESMeta, env string, tsconfig string) (err error) {
+	start := time.Now()
+	pkgDir := path.Join(task.wd, "node_modules", task.pkg.name)
+	entry := esmeta.Module
+	if entry == "" {
+		entry = esmeta.Main
+	}
+	if entry == "" {
+		entry = "index"
+	}
+	entryFile := resolveFile(path.Join(pkgDir, entry))
+	if entryFile == "" {
+		err = withKind(ErrPackageNotFound, fmt.Errorf("file '%s' not found in package '%s'", entry, task.pkg.String()))
 		return
 	}
 
-	esm = esmeta
-	pkgCSS = cssMark[0] == 1
+	suffix := ".transform"
+	if task.isDev {
+		suffix = ".development" + suffix
+	}
+	suffix += task.outputFlags() + ".js"
+	transformPlugin := api.Plugin{
+		Name: "esm-transform",
+		Setup: func(plugin api.PluginBuild) {
+			plugin.OnResolve(
+				api.OnResolveOptions{Filter: ".*"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if args.Kind == api.ResolveEntryPoint {
+						return api.OnResolveResult{}, nil
+					}
+					if isFileImportPath(args.Path) {
+						filename := resolveFile(path.Join(args.ResolveDir, args.Path))
+						if filename == "" || !strings.HasPrefix(filename, pkgDir+"/") {
+							return api.OnResolveResult{Path: args.Path, External: true}, nil
+						}
+						subpath := strings.TrimPrefix(filename, pkgDir+"/")
+						if !endsWith(subpath, ".js", ".mjs", ".cjs") {
+							// non-js files like css are served as raw files
+							return api.OnResolveResult{Path: fmt.Sprintf("%s/%s@%s/%s", config.basePath, task.pkg.name, task.pkg.version, subpath), External: true}, nil
+						}
+						return api.OnResolveResult{Path: fmt.Sprintf(
+							"%s/v%d/%s@%s/%s/%s%s",
+							config.basePath,
+							VERSION,
+							task.pkg.name,
+							task.pkg.version,
+							task.target,
+							trimJSExt(subpath),
+							suffix,
+						), External: true}, nil
+					}
+					importPath, err := task.resolveExternal(strings.TrimSuffix(args.Path, "/"), esmeta)
+					if err != nil {
+						return api.OnResolveResult{}, err
+					}
+					return api.OnResolveResult{Path: importPath, External: true}, nil
+				},
+			)
+		},
+	}
+
+	minify := task.shouldMinify()
+	result := api.Build(api.BuildOptions{
+		EntryPoints:       []string{entryFile},
+		Outdir:            "/esbuild",
+		Write:             false,
+		Bundle:            true,
+		Target:            targets[task.target],
+		Format:            api.FormatESModule,
+		Platform:          api.PlatformBrowser,
+		MinifyWhitespace:  minify,
+		MinifyIdentifiers: minify,
+		MinifySyntax:      minify,
+		Charset:           task.charset(),
+		Define: map[string]string{
+			"process.env.NODE_ENV":        fmt.Sprintf(`"%s"`, env),
+			"global.process.env.NODE_ENV": fmt.Sprintf(`"%s"`, env),
+		},
+		Plugins:       []api.Plugin{transformPlugin},
+		Tsconfig:      tsconfig,
+		LegalComments: legalComments[task.comments],
+		Footer:        jsOutputText(config.footer),
+	})
+	if len(result.Errors) > 0 {
+		err = withKind(ErrBuildFailed, errors.New("esbuild: "+result.Errors[0].Text))
+		return
+	}
+	for _, w := range result.Warnings {
+		log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
+	}
+
+	for _, file := range result.OutputFiles {
+		if strings.HasSuffix(file.Path, ".js") {
+			header := ""
+			if task.comments != "none" {
+				header = fmt.Sprintf(
+					"/* esm.sh - esbuild transform(%s) %s %s */\n",
+					task.pkg.String(),
+					strings.ToLower(task.target),
+					env,
+				)
+			}
+			if config.banner != "" {
+				header = config.banner + "\n" + header
+			}
+			err = getStorage().Put(path.Join("builds", task.ID()+".js"), io.MultiReader(strings.NewReader(header), bytes.NewReader(file.Contents)))
+			if err != nil {
+				return
+			}
+			getStorage().Delete(path.Join("builds", task.ID()+".mjs"))
+		} else if strings.HasSuffix(file.Path, ".LEGAL.txt") {
+			err = getStorage().Put(path.Join("builds", task.ID()+".js.LEGAL.txt"), bytes.NewReader(file.Contents))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	log.Debugf("esbuild transform %s %s %s in %v", task.pkg.String(), task.target, env, time.Now().Sub(start))
+	return
+}
+
+// writeTsconfig writes a tsconfig file to enable the legacy decorators if the `decorators` query
+// is set or the package's tsconfig.json enables `experimentalDecorators`.
+// The `paths` aliases of the tsconfig are resolved against the package dir, that
+// makes the packages shipping the typescript source with aliases work.
+func (task *buildTask) writeTsconfig() (tsconfig string, err error) {
+	pkgTsconfig := task.readTsconfig()
+	compilerOptions := map[string]interface{}{}
+	if task.decorators || pkgTsconfig.CompilerOptions.ExperimentalDecorators {
+		compilerOptions["experimentalDecorators"] = true
+		compilerOptions["useDefineForClassFields"] = false
+	}
+	if paths := pkgTsconfig.CompilerOptions.Paths; len(paths) > 0 {
+		compilerOptions["baseUrl"] = path.Join(task.wd, "node_modules", task.pkg.name, pkgTsconfig.CompilerOptions.BaseURL)
+		compilerOptions["paths"] = paths
+	}
+	if len(compilerOptions) == 0 {
+		return
+	}
+
+	tsconfig = path.Join(task.wd, "tsconfig.esm.json")
+	err = ioutil.WriteFile(tsconfig, utils.MustEncodeJSON(map[string]interface{}{
+		"compilerOptions": compilerOptions,
+	}), 0644)
+	return
+}
+
+type tsconfigJSON struct {
+	CompilerOptions struct {
+		ExperimentalDecorators bool                `json:"experimentalDecorators"`
+		BaseURL                string              `json:"baseUrl"`
+		Paths                  map[string][]string `json:"paths"`
+	} `json:"compilerOptions"`
+}
+
+// readTsconfig reads the tsconfig.json of the package, the tsconfig with
+// comments is not supported.
+func (task *buildTask) readTsconfig() (tsconfig tsconfigJSON) {
+	filename := path.Join(task.wd, "node_modules", task.pkg.name, "tsconfig.json")
+	if fileExists(filename) {
+		utils.ParseJSONFile(filename, &tsconfig)
+	}
+	return
+}
+
+// matchTsconfigPaths checks if the import path matches a pattern of the tsconfig
+// `paths`, like `@/*`.
+func matchTsconfigPaths(paths map[string][]string, importPath string) bool {
+	for pattern := range paths {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(importPath, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if importPath == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExternal returns the import url of the external module.
+func (task *buildTask) resolveExternal(name string, esmeta *ESMeta) (importPath string, err error) {
+	if p := getPreset(task.preset); p != nil && p.isExternal(name) {
+		if url := p.importURL(name); url != "" {
+			importPath = url
+			return
+		}
+	}
+	if config.globalExternalURL != "" && isGlobalExternal(name) {
+		pkgName, _ := splitPkgPath(name)
+		version := "latest"
+		if v, ok := esmeta.Dependencies[pkgName]; ok {
+			version = v
+		} else if v, ok := esmeta.PeerDependencies[pkgName]; ok {
+			version = v
+		}
+		for _, dep := range task.deps {
+			if dep.name == pkgName {
+				version = dep.version
+				break
+			}
+		}
+		p, _, e := getRegistry().PackageInfo(pkgName, version)
+		if e != nil {
+			err = e
+			return
+		}
+		importPath = strings.NewReplacer("{name}", name, "{version}", p.Version).Replace(config.globalExternalURL)
+		return
+	}
+	// keep the builtin modules as they are for the node platform
+	if task.platform == "node" && builtInNodeModules[name] {
+		importPath = name
+		return
+	}
+	if name == "buffer" {
+		importPath = fmt.Sprintf("/v%d/node_buffer.js", VERSION)
+	}
+	if importPath == "" && builtInNodeModules[name] {
+		if task.target == "deno" && denoStdNodeModules[name] {
+			importPath = fmt.Sprintf("/v%d/deno_std_node_%s.js", VERSION, name)
+		} else {
+			polyfill, ok := polyfilledBuiltInNodeModules[name]
+			if ok {
+				p, submodule, e := getRegistry().PackageInfo(polyfill, "latest")
+				if e != nil {
+					err = e
+					return
+				}
+				filename := path.Base(p.Name)
+				if submodule != "" {
+					filename = submodule
+				}
+				filename += task.importFlags()
+				importPath = fmt.Sprintf(
+					"/v%d/%s@%s/%s/%s.js",
+					VERSION,
+					p.Name,
+					p.Version,
+					task.target,
+					filename,
+				)
+			} else {
+				_, err := embedFS.Open(fmt.Sprintf("embed/polyfills/node_%s.js", name))
+				if err == nil {
+					importPath = fmt.Sprintf("/v%d/node_%s.js", VERSION, name)
+				} else {
+					importPath = fmt.Sprintf(
+						"/error.js?type=unsupported-nodejs-builtin-module&name=%s&importer=%s",
+						name,
+						task.pkg.name,
+					)
+				}
+			}
+		}
+	}
+	// get package info via `deps` query
+	if importPath == "" {
+		for _, dep := range task.deps {
+			if name == dep.name {
+				filename := path.Base(dep.name)
+				if dep.submodule != "" {
+					filename = dep.submodule
+				}
+				filename += task.importFlags()
+				importPath = fmt.Sprintf(
+					"/v%d/%s@%s/%s/%s.js",
+					VERSION,
+					dep.name,
+					dep.version,
+					task.target,
+					filename,
+				)
+				break
+			}
+		}
+	}
+	// get package info from package.json
+	if importPath == "" {
+		packageFile := path.Join(task.wd, "node_modules", name, "package.json")
+		if fileExists(packageFile) {
+			var p NpmPackage
+			if utils.ParseJSONFile(packageFile, &p) == nil {
+				importPath = fmt.Sprintf(
+					"/v%d/%s@%s/%s/%s%s.js",
+					VERSION,
+					p.Name,
+					p.Version,
+					task.target,
+					path.Base(p.Name),
+					task.importFlags(),
+				)
+			}
+		}
+	}
+	// get package info from network
+	if importPath == "" {
+		version := "latest"
+		for n, v := range esmeta.Dependencies {
+			if name == n {
+				version = v
+				break
+			}
+		}
+		if version == "latest" {
+			for n, v := range esmeta.PeerDependencies {
+				if name == n {
+					version = v
+					break
+				}
+			}
+		}
+		p, submodule, e := getRegistry().PackageInfo(name, version)
+		if e == nil {
+			filename := path.Base(p.Name)
+			if submodule != "" {
+				filename = submodule
+			}
+			filename += task.importFlags()
+			importPath = fmt.Sprintf(
+				"/v%d/%s@%s/%s/%s.js",
+				VERSION,
+				p.Name,
+				p.Version,
+				task.target,
+				filename,
+			)
+		}
+	}
+	if importPath == "" {
+		importPath = fmt.Sprintf(
+			"/error.js?type=resolve&name=%s&importer=%s",
+			name,
+			task.pkg.name,
+		)
+	}
+	importPath = withBasePath(importPath)
 	return
 }
 
 func (task *buildTask) handleDTS(esmeta *ESMeta) (err error) {
+	// the `no-dts` query skips the types, it's ignored by the types-only builds
+	if task.noDts && !task.typesOnly {
+		return
+	}
+
 	start := time.Now()
 	pkg := task.pkg
 	nodeModulesDir := path.Join(task.wd, "node_modules")
 	versionedName := fmt.Sprintf("%s@%s", esmeta.Name, esmeta.Version)
+	typesName := getTypesPackageName(pkg.name)
 
 	var types string
-	if esmeta.Types != "" || esmeta.Typings != "" {
+	if t := esmeta.ResolveExportTypes(pkg.submodule); t != "" && fileExists(path.Join(nodeModulesDir, pkg.name, t)) {
+		// the `types` condition of the `exports` field takes precedence, like typescript does
+		types = fmt.Sprintf("%s/%s", versionedName, strings.TrimPrefix(path.Clean("/"+t), "/"))
+	} else if esmeta.Types != "" || esmeta.Typings != "" {
 		types = getTypesPath(nodeModulesDir, *esmeta.NpmPackage, "")
 	} else if pkg.submodule == "" {
 		if fileExists(path.Join(nodeModulesDir, pkg.name, "index.d.ts")) {
 			types = fmt.Sprintf("%s/%s", versionedName, "index.d.ts")
-		} else if !strings.HasPrefix(pkg.name, "@") {
-			packageFile := path.Join(nodeModulesDir, "@types", pkg.name, "package.json")
+		} else if !isTypesPackage(pkg.name) {
+			packageFile := path.Join(nodeModulesDir, typesName, "package.json")
 			if fileExists(packageFile) {
 				var p NpmPackage
-				err := utils.ParseJSONFile(path.Join(nodeModulesDir, "@types", pkg.name, "package.json"), &p)
+				err := utils.ParseJSONFile(packageFile, &p)
 				if err == nil {
 					types = getTypesPath(nodeModulesDir, p, "")
 				}
@@ -556,10 +1645,10 @@ func (task *buildTask) handleDTS(esmeta *ESMeta) (err error) {
 			types = fmt.Sprintf("%s/%s", versionedName, path.Join(pkg.submodule, "index.d.ts"))
 		} else if fileExists(path.Join(nodeModulesDir, pkg.name, ensureSuffix(pkg.submodule, ".d.ts"))) {
 			types = fmt.Sprintf("%s/%s", versionedName, ensureSuffix(pkg.submodule, ".d.ts"))
-		} else if fileExists(path.Join(nodeModulesDir, "@types", pkg.name, pkg.submodule, "index.d.ts")) {
-			types = fmt.Sprintf("@types/%s/%s", versionedName, path.Join(pkg.submodule, "index.d.ts"))
-		} else if fileExists(path.Join(nodeModulesDir, "@types", pkg.name, ensureSuffix(pkg.submodule, ".d.ts"))) {
-			types = fmt.Sprintf("@types/%s/%s", versionedName, ensureSuffix(pkg.submodule, ".d.ts"))
+		} else if fileExists(path.Join(nodeModulesDir, typesName, pkg.submodule, "index.d.ts")) {
+			types = fmt.Sprintf("%s@%s/%s", typesName, esmeta.Version, path.Join(pkg.submodule, "index.d.ts"))
+		} else if fileExists(path.Join(nodeModulesDir, typesName, ensureSuffix(pkg.submodule, ".d.ts"))) {
+			types = fmt.Sprintf("%s@%s/%s", typesName, esmeta.Version, ensureSuffix(pkg.submodule, ".d.ts"))
 		}
 	}
 	if types != "" {
@@ -578,46 +1667,94 @@ func (task *buildTask) handleDTS(esmeta *ESMeta) (err error) {
 	return
 }
 
-func initBuild(buildDir string, pkg pkg, install bool, env string) (esmeta *ESMeta, err error) {
-	var p NpmPackage
-	p, _, err = node.getPackageInfo(pkg.name, pkg.version)
+// resolvePeerVersion returns the version of the peer dep to install, the version
+// of the deps is used if it's specified, otherwise the range is resolved by the
+// registry. The range is returned as it is if it can't be resolved.
+func resolvePeerVersion(name string, versionRange string, deps pkgSlice) string {
+	for _, dep := range deps {
+		if dep.name == name {
+			return dep.version
+		}
+	}
+	if regFullVersion.MatchString(versionRange) {
+		return versionRange
+	}
+	p, _, err := getRegistry().PackageInfo(name, versionRange)
 	if err != nil {
-		return
+		log.Warnf("resolve peer dep %s@%s: %v", name, versionRange, err)
+		return versionRange
 	}
+	return p.Version
+}
 
-	esmeta = &ESMeta{
-		NpmPackage: &p,
-	}
+// initBuild installs the package and gets the meta, the exports of the cjs module
+// are parsed by nodejs only if the `parseCJS` is true. The `@types` package of
+// the typesVersion is installed if the package has no types, otherwise the one
+// of the same major version as the package, or the latest one. The peer deps are
+// installed with the versions of the deps, or the versions resolved by the registry
+// rather than yarn, that keeps the installed versions the same as the imports.
+func initBuild(ctx context.Context, buildDir string, pkg pkg, deps pkgSlice, install bool, parseCJS bool, typesVersion string, env string) (esmeta *ESMeta, err error) {
+	var p NpmPackage
 	installList := []string{
 		fmt.Sprintf("%s@%s", pkg.name, pkg.version),
 	}
+	if pkg.local != "" {
+		localDir := path.Join(config.localPackagesDir, pkg.local)
+		err = utils.ParseJSONFile(path.Join(localDir, "package.json"), &p)
+		if err != nil {
+			return
+		}
+		installList[0] = fmt.Sprintf("%s@file:%s", pkg.name, localDir)
+	} else if pkg.git != "" {
+		repo, sha := utils.SplitByLastByte(pkg.git, '@')
+		p, err = fetchGitHubPackageJSON(repo, sha)
+		if err != nil {
+			return
+		}
+		installList[0] = fmt.Sprintf("%s@github:%s#%s", pkg.name, repo, sha)
+	} else {
+		p, _, err = getRegistry().PackageInfo(pkg.name, pkg.version)
+		if err != nil {
+			return
+		}
+	}
+
+	esmeta = &ESMeta{
+		NpmPackage: &p,
+	}
 	pkgDir := path.Join(buildDir, "node_modules", esmeta.Name)
-	if esmeta.Types == "" && esmeta.Typings == "" && !strings.HasPrefix(pkg.name, "@") {
+	if esmeta.Types == "" && esmeta.Typings == "" && !isTypesPackage(pkg.name) {
+		typesName := getTypesPackageName(pkg.name)
 		var info NpmPackage
-		info, _, err = node.getPackageInfo("@types/"+pkg.name, "latest")
+		if typesVersion != "" {
+			info, _, err = getRegistry().PackageInfo(typesName, typesVersion)
+			if err != nil {
+				return
+			}
+		} else {
+			// the latest `@types` package may describe a newer api than the package
+			major, _ := utils.SplitByFirstByte(pkg.version, '.')
+			info, _, err = getRegistry().PackageInfo(typesName, "^"+major)
+			if errors.Is(err, ErrPackageNotFound) {
+				info, _, err = getRegistry().PackageInfo(typesName, "latest")
+			}
+		}
 		if err == nil {
 			if info.Types != "" || info.Typings != "" || info.Main != "" {
 				installList = append(installList, fmt.Sprintf("%s@%s", info.Name, info.Version))
+				esmeta.TypesPackage = fmt.Sprintf("%s@%s", info.Name, info.Version)
 			}
-		} else if err.Error() != fmt.Sprintf("npm: package '@types/%s' not found", pkg.name) {
+		} else if !errors.Is(err, ErrPackageNotFound) {
 			return
 		}
 	}
-	if esmeta.Module == "" && esmeta.Type == "module" {
+	// the esm entry is resolved in the order of `exports` > `module` > `main`,
+	// that is how esbuild resolves the package
+	if module, _ := esmeta.ResolveExport("."); module != "" {
+		esmeta.Module = module
+	} else if esmeta.Module == "" && esmeta.Type == "module" {
 		esmeta.Module = esmeta.Main
 	}
-	if esmeta.Module == "" && esmeta.DefinedExports != nil {
-		v, ok := esmeta.DefinedExports.(map[string]interface{})
-		if ok {
-			m, ok := v["import"]
-			if ok {
-				s, ok := m.(string)
-				if ok && s != "" {
-					esmeta.Module = s
-				}
-			}
-		}
-	}
 	if pkg.submodule != "" {
 		esmeta.Main = pkg.submodule
 		esmeta.Module = ""
@@ -626,13 +1763,37 @@ func initBuild(buildDir string, pkg pkg, install bool, env string) (esmeta *ESMe
 	}
 
 	if install {
-		for n, v := range esmeta.PeerDependencies {
-			installList = append(installList, fmt.Sprintf("%s@%s", n, v))
+		peers := make([]string, 0, len(esmeta.PeerDependencies))
+		for n := range esmeta.PeerDependencies {
+			// the global externals are never bundled, no need to install them
+			if !isGlobalExternal(n) {
+				peers = append(peers, n)
+			}
 		}
-		err = yarnAdd(buildDir, installList...)
+		sort.Strings(peers)
+		for _, n := range peers {
+			installList = append(installList, fmt.Sprintf("%s@%s", n, resolvePeerVersion(n, esmeta.PeerDependencies[n], deps)))
+		}
+		err = getInstaller().Install(ctx, buildDir, installList...)
+		if err != nil {
+			return
+		}
+		esmeta.Installed = installList
+		esmeta.Integrity, err = verifyIntegrity(buildDir)
+		if err != nil {
+			return
+		}
+		esmeta.InstallScripts, err = runInstallScripts(ctx, buildDir)
 		if err != nil {
 			return
 		}
+		// fail early rather than the cryptic resolve errors of esbuild
+		if parseCJS && !isTypesPackage(pkg.name) {
+			err = checkNativeAddon(pkgDir, p)
+			if err != nil {
+				return
+			}
+		}
 	}
 
 	if pkg.submodule != "" {
@@ -657,6 +1818,10 @@ func initBuild(buildDir string, pkg pkg, install bool, env string) (esmeta *ESMe
 			if p.Typings != "" {
 				esmeta.Typings = path.Join(pkg.submodule, p.Typings)
 			}
+		} else if module, main := esmeta.ResolveExport(pkg.submodule); main != "" {
+			// the submodule is defined by the `exports` field rather than a real file
+			esmeta.Main = main
+			esmeta.Module = module
 		} else {
 			exports, esm, e := parseESModuleExports(buildDir, path.Join(esmeta.Name, pkg.submodule))
 			if e != nil && os.IsExist(e) {
@@ -685,13 +1850,66 @@ func initBuild(buildDir string, pkg pkg, install bool, env string) (esmeta *ESMe
 		}
 	}
 
-	if esmeta.Module == "" {
-		ret, err := parseCJSModuleExports(buildDir, pkg.ImportPath(), env)
-		if err != nil {
-			log.Warn(err)
+	if esmeta.Module == "" && parseCJS && !isTypesPackage(pkg.name) {
+		// reuse the exports found by the exports probe or the previous build
+		if exports, ok := getCachedExports(pkg, env); ok {
+			esmeta.Exports = exports
+			return
+		}
+		ret, e := parseCJSModuleExportsContext(ctx, buildDir, pkg.ImportPath(), env)
+		if e != nil {
+			// the parse is killed when the build timeout or canceled
+			if ctx.Err() != nil {
+				err = ctx.Err()
+				return
+			}
+			log.Warn(e)
+		} else if ret.Error == "" {
+			// only the exports that are parsed successfully are cached
+			cacheExports(pkg, env, ret.Exports)
 		}
 		esmeta.Exports = ret.Exports
 		log.Debug(p.Name, len(esmeta.Exports), "exports as cjs")
 	}
 	return
 }
+
+// depSizeCache caches the sizes of the installed deps, it's safe for concurrent use.
+type depSizeCache struct {
+	lock sync.Mutex
+	wd   string
+	m    map[string]int64
+}
+
+// get returns the total size of the js files of the dep, the nested
+// `node_modules` are not counted; returns -1 if the dep is not installed.
+func (c *depSizeCache) get(importPath string) int64 {
+	name, _ := splitPkgPath(importPath)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	size, ok := c.m[name]
+	if !ok {
+		root := path.Join(c.wd, "node_modules", name)
+		if !dirExists(root) {
+			c.m[name] = -1
+			return -1
+		}
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && info.Name() == "node_modules" && p != root {
+				return filepath.SkipDir
+			}
+			switch path.Ext(p) {
+			case ".js", ".mjs", ".cjs":
+				size += info.Size()
+			}
+			return nil
+		})
+		c.m[name] = size
+	}
+	return size
+}
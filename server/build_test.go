@@ -0,0 +1,390 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestEntryCode(t *testing.T) {
+	esmeta := &ESMeta{
+		NpmPackage: &NpmPackage{Name: "fixture", Version: "1.0.0", Module: "index.js"},
+		Exports:    []string{"a", "b", "default"},
+	}
+	task := &buildTask{pkg: pkg{name: "fixture", version: "1.0.0"}}
+
+	code := task.entryCode(esmeta)
+	if !strings.Contains(code, `export const { a,b } = __star;`) || !strings.Contains(code, `export { default } from "fixture";`) {
+		t.Fatalf("unexpected entry code: %s", code)
+	}
+
+	task.exports = []string{"a", "c"}
+	code = task.entryCode(esmeta)
+	if code != `export { a } from "fixture";`+"\n" {
+		t.Fatalf("unexpected entry code: %s", code)
+	}
+}
+
+func TestEscapeEntryPath(t *testing.T) {
+	for entry, escaped := range map[string]string{
+		"dist/index.modern.js": "dist~1index.modern.js",
+		"dist/~1/a_b.js":       "dist~1~01~1a_b.js",
+		"~/a~/b":               "~0~1a~0~1b",
+	} {
+		if s := escapeEntryPath(entry); s != escaped {
+			t.Fatalf("unexpected escaped entry of '%s': %s", entry, s)
+		}
+		if s := unescapeEntryPath(escaped); s != entry {
+			t.Fatalf("unexpected unescaped entry of '%s': %s", escaped, s)
+		}
+	}
+}
+
+func TestShimVersion(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{}
+	task := &buildTask{pkg: pkg{name: "fixture", version: "1.0.0"}, target: "es2020"}
+	if !strings.Contains(task.ID(), fmt.Sprintf("/shim=v%d/es2020/", shimFormat)) {
+		t.Fatalf("the build id should include the shim version: %s", task.ID())
+	}
+
+	esmeta := &ESMeta{
+		NpmPackage: &NpmPackage{Name: "fixture", Version: "1.0.0", Module: "index.js"},
+		Exports:    []string{"a", "default"},
+	}
+	pinned := &buildTask{pkg: pkg{name: "fixture", version: "1.0.0"}, target: "es2020", shim: 1}
+	if pinned.ID() != fmt.Sprintf("v%d/fixture@1.0.0/shim=v1/es2020/fixture", VERSION) {
+		t.Fatalf("unexpected build id of the pinned shim: %s", pinned.ID())
+	}
+	if code := pinned.entryCode(esmeta); code != pinned.entryCodeV1(esmeta) {
+		t.Fatalf("unexpected entry code of the v1 shim: %s", code)
+	}
+}
+
+func TestTreeShakeExports(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testtreeshake")
+	os.RemoveAll(testDir)
+	pkgDir := path.Join(testDir, "node_modules", "fixture")
+	ensureDir(pkgDir)
+	files := map[string]string{
+		"index.js": `export { a } from "./a.js"; export { b } from "./b.js";`,
+		"a.js":     `export const a = "a";`,
+		"b.js":     `globalThis.__b = true; export const b = "b";`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := &buildTask{pkg: pkg{name: "fixture", version: "1.0.0"}, exports: []string{"a"}}
+	esmeta := &ESMeta{
+		NpmPackage: &NpmPackage{Name: "fixture", Version: "1.0.0", Module: "index.js"},
+		Exports:    []string{"a", "b"},
+	}
+	build := func(packageJSON string) string {
+		err := ioutil.WriteFile(path.Join(pkgDir, "package.json"), []byte(packageJSON), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := api.Build(api.BuildOptions{
+			Stdin: &api.StdinOptions{
+				Contents:   task.entryCode(esmeta),
+				ResolveDir: testDir,
+			},
+			Bundle: true,
+			Format: api.FormatESModule,
+		})
+		if len(result.Errors) > 0 {
+			t.Fatal(result.Errors[0].Text)
+		}
+		return string(result.OutputFiles[0].Contents)
+	}
+
+	if code := build(`{"name":"fixture","module":"index.js"}`); !strings.Contains(code, "__b") {
+		t.Fatalf("side effects of 'b.js' should be kept: %s", code)
+	}
+	if code := build(`{"name":"fixture","module":"index.js","sideEffects":false}`); strings.Contains(code, "__b") {
+		t.Fatalf("'b.js' should be tree-shaken: %s", code)
+	}
+}
+
+func TestCheckEntry(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testcheckentry")
+	os.RemoveAll(testDir)
+	pkgDir := path.Join(testDir, "node_modules", "fixture")
+	ensureDir(path.Join(pkgDir, "lib"))
+	err := ioutil.WriteFile(path.Join(pkgDir, "lib", "index.js"), []byte("module.exports = {}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = &Config{}
+	task := &buildTask{wd: testDir, pkg: pkg{name: "fixture", version: "1.0.0"}}
+	if err := task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "./lib"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{}})
+	if err == nil || err.Error() != "package 'fixture@1.0.0' has no entry point for import path 'fixture'" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	task.pkg.submodule = "lib"
+	if err := task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "lib"}}); err != nil {
+		t.Fatal(err)
+	}
+	task.pkg.submodule = "foo"
+	if err := task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "foo"}}); err == nil {
+		t.Fatal("should report the missing submodule")
+	}
+	// the main field of the package doesn't make the missing submodule exist
+	err = task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "lib/index.js"}})
+	if err == nil || err.Error() != "package 'fixture@1.0.0' has no entry point for import path 'fixture/foo'" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestScopedPackageDTS(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testscopeddts")
+	nmDir := path.Join(testDir, "node_modules")
+	os.RemoveAll(testDir)
+	ensureDir(path.Join(nmDir, "@scope", "name"))
+	ensureDir(path.Join(nmDir, "@types", "scope__name"))
+	files := map[string]string{
+		"@scope/name/package.json":        `{"name":"@scope/name","version":"1.0.0","main":"index.js"}`,
+		"@scope/name/index.js":            `module.exports = {}`,
+		"@types/scope__name/package.json": `{"name":"@types/scope__name","version":"1.0.1","types":"index.d.ts"}`,
+		"@types/scope__name/index.d.ts":   `export declare const name: string;`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(nmDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config = &Config{
+		storageDir: testDir,
+		domain:     "cdn.esm.sh",
+	}
+	task := &buildTask{wd: testDir, pkg: pkg{name: "@scope/name", version: "1.0.0"}}
+	esmeta := &ESMeta{NpmPackage: &NpmPackage{Name: "@scope/name", Version: "1.0.0", Main: "index.js"}}
+	err := task.handleDTS(esmeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esmeta.Dts != "/@types/scope__name@1.0.1/index.d.ts" {
+		t.Fatalf("unexpected dts path: %s", esmeta.Dts)
+	}
+}
+
+func TestUMDModule(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testumd")
+	os.RemoveAll(testDir)
+	pkgDir := path.Join(testDir, "node_modules", "fixture")
+	ensureDir(pkgDir)
+	files := map[string]string{
+		"package.json": `{"name":"fixture","version":"1.0.0","main":"fixture.umd.js"}`,
+		"fixture.umd.js": `(function (global, factory) {
+			typeof define === 'function' && define.amd ? define(factory) :
+			typeof exports === 'object' && typeof module !== 'undefined' ? module.exports = factory() :
+			(global.Fixture = factory());
+		}(this, function () { return { version: "1.0.0" }; }));`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{}
+	task := &buildTask{wd: testDir, pkg: pkg{name: "fixture", version: "1.0.0"}}
+	esmeta := &ESMeta{
+		NpmPackage: &NpmPackage{Name: "fixture", Version: "1.0.0", Main: "fixture.umd.js"},
+		Exports:    []string{"version"},
+	}
+	if !isUMDModule(task.mainFile(esmeta)) {
+		t.Fatal("should detect the umd module")
+	}
+
+	result := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   task.entryCode(esmeta),
+			ResolveDir: testDir,
+		},
+		Bundle: true,
+		Format: api.FormatESModule,
+		Define: map[string]string{"define": "undefined"},
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors[0].Text)
+	}
+	err := ioutil.WriteFile(path.Join(testDir, "fixture.mjs"), result.OutputFiles[0].Contents, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the page has an amd loader
+	cmd := exec.Command("node", "--input-type=module", "-e", `
+		globalThis.define = () => {}
+		globalThis.define.amd = true
+		const m = await import("./fixture.mjs")
+		console.log(m.default.version, m.version)
+	`)
+	cmd.Dir = testDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	if strings.TrimSpace(string(output)) != "1.0.0 1.0.0" {
+		t.Fatalf("unexpected exports of the umd module: %s", output)
+	}
+}
+
+func TestTsconfigPaths(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testtsconfigpaths")
+	os.RemoveAll(testDir)
+	pkgDir := path.Join(testDir, "node_modules", "fixture")
+	ensureDir(path.Join(pkgDir, "src"))
+	files := map[string]string{
+		"package.json":  `{"name":"fixture","version":"1.0.0","main":"index.ts"}`,
+		"tsconfig.json": `{"compilerOptions":{"baseUrl":".","paths":{"@/*":["src/*"]}}}`,
+		"index.ts":      `export { a } from "@/a";`,
+		"src/a.ts":      `export const a: string = "fixture-a";`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := &buildTask{wd: testDir, pkg: pkg{name: "fixture", version: "1.0.0"}}
+	tsconfig, err := task.writeTsconfig()
+	if err != nil || tsconfig == "" {
+		t.Fatalf("should write the tsconfig: %v", err)
+	}
+	if !matchTsconfigPaths(task.readTsconfig().CompilerOptions.Paths, "@/a") {
+		t.Fatal("'@/a' should match the paths")
+	}
+
+	result := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   `export * from "fixture";`,
+			ResolveDir: testDir,
+		},
+		Bundle:   true,
+		Format:   api.FormatESModule,
+		Tsconfig: tsconfig,
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors[0].Text)
+	}
+	if !strings.Contains(string(result.OutputFiles[0].Contents), "fixture-a") {
+		t.Fatalf("unexpected output: %s", result.OutputFiles[0].Contents)
+	}
+}
+
+func TestCJSInterop(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testcjsinterop")
+	os.RemoveAll(testDir)
+	fixtures := map[string]struct {
+		index   string
+		exports []string
+		module  string
+		expect  string
+	}{
+		"fn-cjs": {
+			index:   `module.exports = function fn() { return "fn" }; module.exports.helper = "helper";`,
+			exports: []string{"helper"},
+			expect:  "function fn helper",
+		},
+		"object-cjs": {
+			index:   `exports.a = "a"; exports.b = "b";`,
+			exports: []string{"a", "b"},
+			expect:  "object a b",
+		},
+		"esmodule-cjs": {
+			index:   `Object.defineProperty(exports, "__esModule", { value: true }); exports.default = "default"; exports.a = "a";`,
+			exports: []string{"default", "a"},
+			expect:  "string default a",
+		},
+		"esm": {
+			index:   `export default "default"; export const a = "a";`,
+			exports: []string{"default", "a"},
+			module:  "index.js",
+			expect:  "string default a",
+		},
+	}
+	for name, fixture := range fixtures {
+		pkgDir := path.Join(testDir, "node_modules", name)
+		ensureDir(pkgDir)
+		err := ioutil.WriteFile(path.Join(pkgDir, "index.js"), []byte(fixture.index), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		task := &buildTask{wd: testDir, pkg: pkg{name: name, version: "1.0.0"}}
+		esmeta := &ESMeta{
+			NpmPackage: &NpmPackage{Name: name, Version: "1.0.0", Main: "index.js", Module: fixture.module},
+			Exports:    fixture.exports,
+		}
+		result := api.Build(api.BuildOptions{
+			Stdin: &api.StdinOptions{
+				Contents:   task.entryCode(esmeta),
+				ResolveDir: testDir,
+			},
+			Bundle: true,
+			Format: api.FormatESModule,
+		})
+		if len(result.Errors) > 0 {
+			t.Fatal(result.Errors[0].Text)
+		}
+		err = ioutil.WriteFile(path.Join(testDir, name+".mjs"), result.OutputFiles[0].Contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		named := fixture.exports[len(fixture.exports)-1]
+		cmd := exec.Command("node", "--input-type=module", "-e", fmt.Sprintf(`
+			const m = await import("./%s.mjs")
+			const d = typeof m.default === "function" ? m.default() : m.default
+			console.log(typeof m.default === "function" ? "function" : typeof m.default, typeof d === "object" ? Object.keys(d)[0] : d, m.%s)
+		`, name, named))
+		cmd.Dir = testDir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, output)
+		}
+		if strings.TrimSpace(string(output)) != fixture.expect {
+			t.Fatalf("unexpected exports of '%s': %s", name, output)
+		}
+	}
+}
+
+func TestResolvePeerVersion(t *testing.T) {
+	deps := pkgSlice{{name: "react", version: "17.0.1"}}
+	if v := resolvePeerVersion("react", "^16.8.0 || ^17.0.0", deps); v != "17.0.1" {
+		t.Fatalf("the version of the deps should be used, got %s", v)
+	}
+	if v := resolvePeerVersion("react-dom", "17.0.2", deps); v != "17.0.2" {
+		t.Fatalf("the full version should be kept, got %s", v)
+	}
+}
+
+func TestFormatMessage(t *testing.T) {
+	m := api.Message{
+		Text:     `Could not resolve "foo"`,
+		Location: &api.Location{File: "node_modules/fixture/index.js", Line: 1, Column: 7},
+		Notes:    []api.Note{{Text: "You can mark the path \"foo\" as external to exclude it from the bundle"}},
+	}
+	expected := "node_modules/fixture/index.js:1:7: Could not resolve \"foo\"\n  note: You can mark the path \"foo\" as external to exclude it from the bundle"
+	if s := formatMessage(m); s != expected {
+		t.Fatalf("unexpected message %q", s)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildLog records the details of a build, like the output of yarn/nodejs and the
+// esbuild messages, the log is saved only when the build fails.
+type buildLog struct {
+	lock  sync.Mutex
+	buf   bytes.Buffer
+	start time.Time
+}
+
+type buildLogKey struct{}
+
+func newBuildLog() *buildLog {
+	return &buildLog{start: time.Now()}
+}
+
+func withBuildLog(ctx context.Context, l *buildLog) context.Context {
+	return context.WithValue(ctx, buildLogKey{}, l)
+}
+
+// getBuildLog returns the build log of the context, a nil log ignores all the writes.
+func getBuildLog(ctx context.Context) *buildLog {
+	l, _ := ctx.Value(buildLogKey{}).(*buildLog)
+	return l
+}
+
+func (l *buildLog) Printf(format string, v ...interface{}) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	fmt.Fprintf(&l.buf, "[%8.3fs] ", time.Since(l.start).Seconds())
+	l.buf.WriteString(strings.TrimRight(fmt.Sprintf(format, v...), "\n"))
+	l.buf.WriteByte('\n')
+}
+
+// save writes the log to the `logs` dir of the storage, returns the log id.
+func (l *buildLog) save() (id string, err error) {
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	id = hex.EncodeToString(b)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err = writeFileAtomic(buildLogFile(id), bytes.NewReader(l.buf.Bytes()))
+	return
+}
+
+func buildLogFile(id string) string {
+	return path.Join(config.storageDir, "logs", id+".log")
+}
+
+// cleanBuildLogs removes the expired build logs periodically.
+func cleanBuildLogs(retention time.Duration) {
+	dir := path.Join(config.storageDir, "logs")
+	for {
+		entries, err := ioutil.ReadDir(dir)
+		if err == nil {
+			for _, entry := range entries {
+				if !entry.IsDir() && time.Since(entry.ModTime()) > retention {
+					os.Remove(path.Join(dir, entry.Name()))
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
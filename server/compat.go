@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"regexp"
 	"strconv"
 
@@ -9,6 +10,7 @@ import (
 )
 
 var regBrowserVersion = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?$`)
+var regMajorVersion = regexp.MustCompile(`\d+`)
 
 var targets = map[string]api.Target{
 	"deno":   api.ESNext,
@@ -20,6 +22,81 @@ var targets = map[string]api.Target{
 	"es2020": api.ES2020,
 }
 
+// lowerTarget returns the next lower target of the es targets, returns empty
+// string for the lowest one.
+func lowerTarget(target string) string {
+	if target == "deno" {
+		return "es2020"
+	}
+	for i, t := range esTargets {
+		if t == target && i > 0 {
+			return esTargets[i-1]
+		}
+	}
+	return ""
+}
+
+// nodeEngineTarget returns the es target supported by the lowest nodejs version
+// of the `engines.node` range, returns empty string if it can't be determined.
+func nodeEngineTarget(engine string) string {
+	min := -1
+	for _, loc := range regMajorVersion.FindAllStringIndex(engine, -1) {
+		// skip the minor and patch versions
+		if loc[0] > 0 && engine[loc[0]-1] == '.' {
+			continue
+		}
+		major, err := strconv.Atoi(engine[loc[0]:loc[1]])
+		if err == nil && (min < 0 || major < min) {
+			min = major
+		}
+	}
+	switch {
+	case min < 0:
+		return ""
+	case min >= 14:
+		return "es2020"
+	case min >= 12:
+		return "es2019"
+	case min >= 10:
+		return "es2018"
+	case min >= 8:
+		return "es2017"
+	case min >= 7:
+		return "es2016"
+	default:
+		return "es2015"
+	}
+}
+
+// checkNodeEngine returns a warning if the `engines.node` of the package requires
+// a higher es version than the build target.
+func checkNodeEngine(p *NpmPackage, target string) string {
+	engine := p.NodeEngine()
+	required := nodeEngineTarget(engine)
+	if required == "" || esTargetIndex(target) < 0 || esTargetIndex(target) >= esTargetIndex(required) {
+		return ""
+	}
+	return fmt.Sprintf(
+		"package '%s' requires node %s that supports %s, it may use runtime features not available in target %s",
+		p.Name,
+		engine,
+		required,
+		target,
+	)
+}
+
+func esTargetIndex(target string) int {
+	for i, t := range esTargets {
+		if t == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// the es targets in ascending order
+var esTargets = []string{"es2015", "es2016", "es2017", "es2018", "es2019", "es2020"}
+
 var engines = map[string]api.EngineName{
 	"chrome":  api.EngineChrome,
 	"edge":    api.EngineEdge,
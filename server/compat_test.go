@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNodeEngineTarget(t *testing.T) {
+	for engine, expected := range map[string]string{
+		">=14":               "es2020",
+		">=12.20.0":          "es2019",
+		"^12.20.0 || >=14.0": "es2019",
+		">= 10.0.0":          "es2018",
+		"8.x":                "es2017",
+		"*":                  "",
+		"":                   "",
+	} {
+		if target := nodeEngineTarget(engine); target != expected {
+			t.Fatalf("unexpected target of '%s': %s", engine, target)
+		}
+	}
+
+	p := &NpmPackage{Name: "fixture", Engines: map[string]interface{}{"node": ">=12"}}
+	if checkNodeEngine(p, "es2015") == "" {
+		t.Fatal("should warn for the target es2015")
+	}
+	for _, target := range []string{"es2019", "es2020", "deno"} {
+		if w := checkNodeEngine(p, target); w != "" {
+			t.Fatalf("unexpected warning for the target %s: %s", target, w)
+		}
+	}
+}
@@ -3,8 +3,9 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"regexp"
@@ -18,6 +19,7 @@ var (
 	regVersionPath    = regexp.MustCompile(`([^/])@\d+\.\d+\.\d+([a-z0-9\.-]+)?/`)
 	regFromExpr       = regexp.MustCompile(`(}|\s)from\s*("|')`)
 	regImportCallExpr = regexp.MustCompile(`import\((('[^']+')|("[^"]+"))\)`)
+	regRequireExpr    = regexp.MustCompile(`^(export\s+)?import\s+[\w$]+\s*=\s*require\((('[^']+')|("[^"]+"))\)`)
 	regReferenceTag   = regexp.MustCompile(`^<reference\s+(path|types)\s*=\s*('|")([^'"]+)("|')\s*/>$`)
 	regDeclareModule  = regexp.MustCompile(`^declare\s+module\s*('|")([^'"]+)("|')`)
 )
@@ -38,11 +40,11 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 	}
 	defer dtsFile.Close()
 
-	saveFilePath := path.Join(config.storageDir, fmt.Sprintf("types/v%d", VERSION), dts)
-	fi, err := os.Lstat(saveFilePath)
+	saveFilePath := path.Join(fmt.Sprintf("types/v%d", VERSION), dts)
+	fi, err := getStorage().Stat(saveFilePath)
 	if err == nil {
 		if fi.IsDir() {
-			os.Remove(saveFilePath)
+			getStorage().Delete(saveFilePath)
 		} else {
 			// do not repeat
 			return
@@ -106,12 +108,13 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 			if p.Name != "" {
 				importPath = getTypesPath(nodeModulesDir, p, subpath)
 			} else {
-				p, _, err := node.getPackageInfo("@types/"+pkgName, "latest")
-				if err != nil && err.Error() == fmt.Sprintf("npm: package '%s' not found", pkgName) {
-					p, _, err = node.getPackageInfo(pkgName, "latest")
+				p, _, err := getRegistry().PackageInfo("@types/"+pkgName, "latest")
+				if err != nil && errors.Is(err, ErrPackageNotFound) {
+					p, _, err = getRegistry().PackageInfo(pkgName, "latest")
 				}
 				if err == nil {
-					err = yarnAdd(fmt.Sprintf("%s@%s", p.Name, p.Version))
+					// install the missing types into the build dir to resolve the transitive declarations
+					err = getInstaller().Install(context.Background(), path.Dir(nodeModulesDir), fmt.Sprintf("%s@%s", p.Name, p.Version))
 					if err == nil {
 						importPath = getTypesPath(nodeModulesDir, p, subpath)
 					}
@@ -123,11 +126,31 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 			importPath = "/" + importPath
 		}
 		if strings.HasPrefix(importPath, "/") {
-			importPath = fmt.Sprintf("/v%d%s", VERSION, importPath)
+			importPath = fmt.Sprintf("%s/v%d%s", config.basePath, VERSION, importPath)
 		}
 		return importPath
 	}
 
+	// rewrites the quoted path of `import("...")` or `require("...")`
+	rewriteCallExpr := func(callExpr string) string {
+		q := "'"
+		a := strings.Split(callExpr, q)
+		if len(a) != 3 {
+			q = `"`
+			a = strings.Split(callExpr, q)
+		}
+		if len(a) == 3 {
+			buf := bytes.NewBuffer(nil)
+			buf.WriteString(a[0])
+			buf.WriteString(q)
+			buf.WriteString(rewriteFn(a[1]))
+			buf.WriteString(q)
+			buf.WriteString(a[2])
+			return buf.String()
+		}
+		return callExpr
+	}
+
 	buf := bytes.NewBuffer(nil)
 	scanner := bufio.NewScanner(dtsFile)
 	commentScope := false
@@ -174,7 +197,7 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 				}
 				if format == "types" {
 					if path == "node" {
-						path = fmt.Sprintf("/v%d/node.ns.d.ts", VERSION)
+						path = fmt.Sprintf("%s/v%d/node.ns.d.ts", config.basePath, VERSION)
 					} else {
 						path = rewriteFn(path)
 					}
@@ -243,50 +266,20 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 							} else {
 								buf.WriteString(expr)
 							}
+						} else if regRequireExpr.MatchString(expr) {
+							// import foo = require("foo")
+							importExportScope = false
+							buf.WriteString(regRequireExpr.ReplaceAllStringFunc(expr, rewriteCallExpr))
 						} else {
 							if regImportCallExpr.MatchString(expr) {
-								buf.WriteString(regImportCallExpr.ReplaceAllStringFunc(expr, func(importCallExpr string) string {
-									q := "'"
-									a := strings.Split(importCallExpr, q)
-									if len(a) != 3 {
-										q = `"`
-										a = strings.Split(importCallExpr, q)
-									}
-									if len(a) == 3 {
-										buf := bytes.NewBuffer(nil)
-										buf.WriteString(a[0])
-										buf.WriteString(q)
-										buf.WriteString(rewriteFn(a[1]))
-										buf.WriteString(q)
-										buf.WriteString(a[2])
-										return buf.String()
-									}
-									return importCallExpr
-								}))
+								buf.WriteString(regImportCallExpr.ReplaceAllStringFunc(expr, rewriteCallExpr))
 							} else {
 								buf.WriteString(expr)
 							}
 						}
 					} else {
 						if regImportCallExpr.MatchString(expr) {
-							buf.WriteString(regImportCallExpr.ReplaceAllStringFunc(expr, func(importCallExpr string) string {
-								q := "'"
-								a := strings.Split(importCallExpr, q)
-								if len(a) != 3 {
-									q = `"`
-									a = strings.Split(importCallExpr, q)
-								}
-								if len(a) == 3 {
-									buf := bytes.NewBuffer(nil)
-									buf.WriteString(a[0])
-									buf.WriteString(q)
-									buf.WriteString(rewriteFn(a[1]))
-									buf.WriteString(q)
-									buf.WriteString(a[2])
-									return buf.String()
-								}
-								return importCallExpr
-							}))
+							buf.WriteString(regImportCallExpr.ReplaceAllStringFunc(expr, rewriteCallExpr))
 						} else {
 							buf.WriteString(expr)
 						}
@@ -340,14 +333,7 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 		}
 	}
 
-	ensureDir(path.Dir(saveFilePath))
-	saveFile, err := os.Create(saveFilePath)
-	if err != nil {
-		return
-	}
-
-	_, err = io.Copy(saveFile, buf)
-	saveFile.Close()
+	err = getStorage().Put(saveFilePath, buf)
 	if err != nil {
 		return
 	}
@@ -368,7 +354,7 @@ func copyDTS(nodeModulesDir string, dts string) (err error) {
 			err = copyDTS(nodeModulesDir, dep)
 		}
 		if err != nil {
-			os.Remove(saveFilePath)
+			getStorage().Delete(saveFilePath)
 			return
 		}
 	}
@@ -383,11 +369,7 @@ func getTypesPath(nodeModulesDir string, p NpmPackage, subpath string) string {
 		var subtypes string
 		subpkgJSONFile := path.Join(nodeModulesDir, p.Name, subpath, "package.json")
 		if fileExists(subpkgJSONFile) && utils.ParseJSONFile(subpkgJSONFile, &subpkg) == nil {
-			if subpkg.Types != "" {
-				subtypes = subpkg.Types
-			} else if subpkg.Typings != "" {
-				subtypes = subpkg.Typings
-			}
+			subtypes = getTypesField(subpkg)
 		}
 		if subtypes != "" {
 			types = path.Join("/", subpath, subtypes)
@@ -395,16 +377,18 @@ func getTypesPath(nodeModulesDir string, p NpmPackage, subpath string) string {
 			types = subpath
 		}
 	} else {
-		if p.Types != "" {
-			types = p.Types
-		} else if p.Typings != "" {
-			types = p.Typings
-		} else if p.Main != "" {
-			types = strings.TrimSuffix(p.Main, ".js")
+		if t := getTypesField(p); t != "" {
+			types = t
+		} else if p.Main != "" && fileExists(path.Join(nodeModulesDir, p.Name, ensureSuffix(trimJSExt(p.Main), ".d.ts"))) {
+			types = trimJSExt(p.Main)
 		} else {
+			// types-only packages (like `@types/*`) may have no main field
 			types = "index.d.ts"
 		}
 	}
+	if dirExists(path.Join(nodeModulesDir, p.Name, types)) {
+		types = path.Join(types, "index.d.ts")
+	}
 	return fmt.Sprintf("%s@%s%s", p.Name, p.Version, ensureSuffix(path.Join("/", types), ".d.ts"))
 }
 
@@ -7,6 +7,8 @@ import (
 	"path"
 	"strings"
 	"testing"
+
+	"github.com/ije/gox/utils"
 )
 
 func TestCopyDTS(t *testing.T) {
@@ -35,6 +37,7 @@ func TestCopyDTS(t *testing.T) {
 		`export { default as Anchor } from './anchor';`,
 		`export { default as AutoComplete } from './auto-complete';export { default as Alert } from './alert';`,
 		`/* avatar */ export { default as Avatar } from '../avatar';`,
+		`import Button = require('./button');`,
 		`declare module "test" {`,
 		`    export = Component;`,
 		`}`,
@@ -58,6 +61,7 @@ func TestCopyDTS(t *testing.T) {
 		`export { default as Anchor } from './anchor.d.ts';`,
 		`export { default as AutoComplete } from './auto-complete.d.ts';export { default as Alert } from './alert.d.ts';`,
 		`/* avatar */ export { default as Avatar } from '../avatar.d.ts';`,
+		`import Button = require('./button.d.ts');`,
 		`declare module "https://cdn.esm.sh/test" {`,
 		`    export = Component;`,
 		`}`,
@@ -80,6 +84,7 @@ func TestCopyDTS(t *testing.T) {
 		"anchor.d.ts":        `export default interface Anchor { }`,
 		"auto-complete.d.ts": `export default interface AutoComplete { }`,
 		"alert.d.ts":         `export default interface Alert { }`,
+		"button.d.ts":        `export = Button; declare interface Button { }`,
 		"../avatar.d.ts":     `export default interface Avatar { }`,
 		"index.d.ts":         strings.Join(indexDTSRaw, "\n"),
 	}
@@ -108,3 +113,96 @@ func TestCopyDTS(t *testing.T) {
 		t.Fatal("unexpected index.d.ts", string(data))
 	}
 }
+
+func TestCopyTypesPackageDTS(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testcopytypesdts")
+	nmDir := path.Join(testDir, "node_modules")
+	os.RemoveAll(testDir)
+	ensureDir(path.Join(nmDir, "@types", "react"))
+	// a types-only package has no entry fields but the `index.d.ts`
+	files := map[string]string{
+		"package.json": `{"name":"@types/react","version":"17.0.0"}`,
+		"index.d.ts":   `/// <reference path="global.d.ts" />` + "\n" + `export declare const version: string;`,
+		"global.d.ts":  `interface Event {}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(nmDir, "@types", "react", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{
+		storageDir: testDir,
+		domain:     "cdn.esm.sh",
+	}
+	var p NpmPackage
+	err := utils.ParseJSONFile(path.Join(nmDir, "@types/react", "package.json"), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := getTypesPath(nmDir, p, "")
+	if types != "@types/react@17.0.0/index.d.ts" {
+		t.Fatalf("unexpected types path: %s", types)
+	}
+
+	err = copyDTS(nmDir, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"index.d.ts", "global.d.ts"} {
+		if !fileExists(path.Join(testDir, fmt.Sprintf("types/v%d/@types/react@17.0.0", VERSION), name)) {
+			t.Fatalf("missing %s", name)
+		}
+	}
+}
+
+func TestCopyRelativeDTS(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testcopyrelativedts")
+	nmDir := path.Join(testDir, "node_modules")
+	os.RemoveAll(testDir)
+	ensureDir(path.Join(nmDir, "fixture", "lib"))
+	ensureDir(path.Join(nmDir, "fixture", "util"))
+	files := map[string]string{
+		"index.d.ts":      `export { A } from "./lib/a";` + "\n" + `export * from "./shared.js";`,
+		"lib/a.d.ts":      `import { U } from "../util";` + "\n" + `export declare type A = U;`,
+		"util/index.d.ts": `export declare type U = string;`,
+		"shared.d.ts":     `export declare const shared: boolean;`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(nmDir, "fixture", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{
+		storageDir: testDir,
+		domain:     "cdn.esm.sh",
+	}
+	err := copyDTS(nmDir, "fixture@1.0.0/index.d.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the referenced files keep the layout of the package, the relative imports resolve as they are
+	typesDir := path.Join(testDir, fmt.Sprintf("types/v%d/fixture@1.0.0", VERSION))
+	for name, expected := range map[string][]string{
+		"index.d.ts":      {`from "./lib/a.d.ts"`, `from "./shared.d.ts"`},
+		"lib/a.d.ts":      {`from "../util/index.d.ts"`},
+		"util/index.d.ts": {`export declare type U`},
+		"shared.d.ts":     {`export declare const shared`},
+	} {
+		data, err := ioutil.ReadFile(path.Join(typesDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range expected {
+			if !strings.Contains(string(data), s) {
+				t.Fatalf("unexpected %s: %s", name, data)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Kinds of the errors that are returned by the build process,
+// use `errors.Is` to check the kind of an error.
+var (
+	ErrPackageNotFound     = errors.New("package not found")
+	ErrInstallFailed       = errors.New("install failed")
+	ErrBuildFailed         = errors.New("build failed")
+	ErrUnsupportedPackage  = errors.New("unsupported package")
+	ErrUnexpectedExternals = errors.New("unexpected externals")
+	ErrBuildTimeout        = errors.New("build timeout")
+	ErrRegistryUnavailable = errors.New("registry unavailable")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrInternal            = errors.New("internal error")
+)
+
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// loggedError attaches the id of the saved build log to the error.
+type loggedError struct {
+	error
+	logID string
+}
+
+func (e *loggedError) Unwrap() error {
+	return e.error
+}
+
+// withKind marks the error with the kind, the error message is kept.
+func withKind(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// errorStatus returns the http status code of the error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPackageNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInstallFailed):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrUnsupportedPackage), errors.Is(err, ErrUnexpectedExternals):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrBuildTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrRegistryUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
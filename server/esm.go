@@ -2,8 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"path"
+	"sort"
+	"strings"
 
+	"github.com/postui/postdb/post"
 	"github.com/postui/postdb/q"
 )
 
@@ -12,6 +16,34 @@ type ESMeta struct {
 	*NpmPackage
 	Exports []string `json:"exports"`
 	Dts     string   `json:"dts"`
+	// the `@types` package installed for the types, like `@types/react@17.0.11`
+	TypesPackage string `json:"typesPackage,omitempty"`
+	// the platform of the build, empty for the browser
+	Platform string `json:"platform,omitempty"`
+	// packages installed by yarn for the build
+	Installed []string `json:"installed,omitempty"`
+	// the allowed packages whose install scripts ran, like `esbuild@0.12.9`
+	InstallScripts []string `json:"installScripts,omitempty"`
+	// modules can't be resolved by esbuild that are marked as external
+	MissingDeps []string `json:"missingDeps,omitempty"`
+	// deps bundled/externalized by the `inline` query
+	InlinedDeps  []string `json:"inlinedDeps,omitempty"`
+	ExternalDeps []string `json:"externalDeps,omitempty"`
+	// peer deps that are externalized implicitly in the bundle and the inline modes,
+	// it's nil for the builds made before they were recorded
+	PeerExternals []string `json:"peerExternals"`
+	// the target that produced the output if it fell back to a lower one
+	EffectiveTarget string `json:"effectiveTarget,omitempty"`
+	// diagnostics of the build, like the package may not work in the target
+	Warnings []string `json:"warnings,omitempty"`
+	// files emitted by the build, like the `.wasm` files, that are served next to the build file
+	Assets []string `json:"assets,omitempty"`
+	// the content-addressed path of the build file, like `/v43/react@17.0.2/es2020/react.0e6f3d5a4b7c.js`
+	HashedPath string `json:"hashedPath,omitempty"`
+	// subresource integrity of the build file
+	SRI string `json:"sri,omitempty"`
+	// integrity of the installed packages from yarn.lock
+	Integrity map[string]string `json:"integrity,omitempty"`
 }
 
 func findESM(id string) (esm *ESMeta, pkgCSS bool, ok bool) {
@@ -23,15 +55,232 @@ func findESM(id string) (esm *ESMeta, pkgCSS bool, ok bool) {
 			return
 		}
 
-		if !fileExists(path.Join(config.storageDir, "builds", id+".js")) {
+		if !storageFileExists(path.Join("builds", id+".js")) {
 			db.Delete(q.Alias(id))
 			return
 		}
 
 		if val := post.KV["css"]; len(val) == 1 && val[0] == 1 {
-			pkgCSS = fileExists(path.Join(config.storageDir, "builds", id+".css"))
+			pkgCSS = storageFileExists(path.Join("builds", id+".css"))
 		}
 		ok = true
 	}
 	return
 }
+
+// checkExternals returns an `ErrUnexpectedExternals` error if the build
+// externalizes any package implicitly that is not listed in the deps, that is
+// the peer deps of the bundle and the inline modes, and the modules that can't
+// be resolved.
+func (esm *ESMeta) checkExternals(deps pkgSlice) error {
+	listed := newStringSet()
+	for _, dep := range deps {
+		listed.Add(dep.name)
+	}
+	unexpected := []string{}
+	for _, name := range esm.PeerExternals {
+		if !listed.Has(name) {
+			unexpected = append(unexpected, fmt.Sprintf("%s (a peer dependency of %s)", name, esm.Name))
+		}
+	}
+	for _, name := range esm.MissingDeps {
+		if !listed.Has(name) {
+			unexpected = append(unexpected, fmt.Sprintf("%s (can't be resolved)", name))
+		}
+	}
+	if len(unexpected) > 0 {
+		return withKind(ErrUnexpectedExternals, fmt.Errorf(
+			"unexpected externals: %s, list them in the `deps` query to acknowledge",
+			strings.Join(unexpected, ", "),
+		))
+	}
+	return nil
+}
+
+// ensureMJS copies the build file to the `.mjs` file if it doesn't exist, the
+// name is the build id or the content-addressed path without extension.
+func ensureMJS(name string) error {
+	filename := path.Join("builds", name+".mjs")
+	if storageFileExists(filename) {
+		return nil
+	}
+	r, err := getStorage().Get(path.Join("builds", name+".js"))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return getStorage().Put(filename, r)
+}
+
+// BuildRecord defines a stored build that is parsed from the build id
+type BuildRecord struct {
+	ID        string `json:"id"`
+	Version   string `json:"version"`
+	Submodule string `json:"submodule,omitempty"`
+	Target    string `json:"target"`
+	Dev       bool   `json:"dev"`
+	Bundle    bool   `json:"bundle"`
+}
+
+// findBuilds returns the stored builds whose package names are matched, the
+// builds are scanned by their ids since the stored builds have no index of the
+// package names. The keys are the values to select.
+func findBuilds(match func(name string) bool, keys ...string) ([]post.Post, error) {
+	return db.List(q.Filter(func(p post.Post) bool {
+		name, _, ok := parseBuildID(p.Alias)
+		return ok && match(name)
+	}), q.Select(keys...))
+}
+
+// listBuilds returns the stored builds of the package.
+func listBuilds(name string) (records []BuildRecord, err error) {
+	posts, err := findBuilds(func(n string) bool { return n == name })
+	if err != nil {
+		return
+	}
+	records = []BuildRecord{}
+	for _, post := range posts {
+		if _, r, ok := parseBuildID(post.Alias); ok {
+			records = append(records, r)
+		}
+	}
+	return
+}
+
+// purgeBuilds deletes all the stored builds of the package and their files,
+// and the cached exports of the package, returns the number of the purged
+// builds. The declaration files are kept since they may be referenced by the
+// builds of other packages.
+func purgeBuilds(name string) (n int, err error) {
+	posts, err := findBuilds(func(pkgName string) bool { return pkgName == name }, "esmeta")
+	if err != nil {
+		return
+	}
+	fs := getStorage()
+	for _, post := range posts {
+		for _, filename := range buildFiles(post.Alias, post.KV["esmeta"]) {
+			err = fs.Delete(path.Join("builds", filename))
+			if err != nil {
+				return
+			}
+		}
+		var deleted int
+		deleted, err = db.Delete(q.Alias(post.Alias))
+		if err != nil {
+			return
+		}
+		n += deleted
+	}
+	// the exports are probed again by the next builds
+	_, err = db.Delete(q.Filter(func(p post.Post) bool {
+		return strings.HasPrefix(p.Alias, "exports:"+name+"@")
+	}))
+	return
+}
+
+// buildFiles returns the files of the stored build in the `builds` dir, the
+// esmeta is the json stored in the db.
+func buildFiles(id string, esmeta []byte) []string {
+	files := []string{id + ".js", id + ".js.sig", id + ".mjs", id + ".css", id + ".metafile.json", id + ".provenance.json", id + ".js.LEGAL.txt"}
+	var esm ESMeta
+	if json.Unmarshal(esmeta, &esm) == nil {
+		if esm.HashedPath != "" {
+			files = append(files, esm.HashedPath, esm.HashedPath+".sig", strings.TrimSuffix(esm.HashedPath, ".js")+".mjs")
+		}
+		files = append(files, esm.Assets...)
+	}
+	return files
+}
+
+// CachedBuild is a stored build with the total size of its files.
+type CachedBuild struct {
+	Name string `json:"name"`
+	BuildRecord
+	Size int64 `json:"size"`
+	// the unix time of the build
+	BuildTime int64 `json:"buildTime"`
+}
+
+// listCachedBuilds returns the stored builds of the packages whose names start
+// with the prefix, sorted by the `size`(largest first), the `age`(oldest first)
+// or the id.
+func listCachedBuilds(prefix string, sortBy string) (builds []CachedBuild, err error) {
+	posts, err := findBuilds(func(name string) bool { return strings.HasPrefix(name, prefix) }, "esmeta")
+	if err != nil {
+		return
+	}
+	fs := getStorage()
+	builds = []CachedBuild{}
+	for _, p := range posts {
+		name, r, ok := parseBuildID(p.Alias)
+		if !ok {
+			continue
+		}
+		b := CachedBuild{Name: name, BuildRecord: r, BuildTime: int64(p.Crtime)}
+		for _, filename := range buildFiles(p.Alias, p.KV["esmeta"]) {
+			if fi, err := fs.Stat(path.Join("builds", filename)); err == nil {
+				b.Size += fi.Size()
+			}
+		}
+		builds = append(builds, b)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		switch sortBy {
+		case "size":
+			if builds[i].Size != builds[j].Size {
+				return builds[i].Size > builds[j].Size
+			}
+		case "age":
+			if builds[i].BuildTime != builds[j].BuildTime {
+				return builds[i].BuildTime < builds[j].BuildTime
+			}
+		}
+		return builds[i].ID < builds[j].ID
+	})
+	return
+}
+
+// parseBuildID parses the build id like `v43/react@17.0.2/es2020/react.development`.
+func parseBuildID(id string) (name string, r BuildRecord, ok bool) {
+	if !regBuildVersionPath.MatchString("/" + id) {
+		return
+	}
+	a := strings.Split(id, "/")[1:]
+	if strings.HasPrefix(a[0], "@") && len(a) > 1 {
+		a = append([]string{a[0] + "/" + a[1]}, a[2:]...)
+	}
+	i := strings.LastIndexByte(a[0], '@')
+	if i <= 0 || len(a) < 3 {
+		return
+	}
+	name = a[0][:i]
+	r.ID = id
+	r.Version = a[0][i+1:]
+	a = a[1:]
+	for len(a) > 2 && (strings.HasPrefix(a[0], "local=") || strings.HasPrefix(a[0], "gh=") || strings.HasPrefix(a[0], "deps=") || strings.HasPrefix(a[0], "exports=") || strings.HasPrefix(a[0], "entry=") || strings.HasPrefix(a[0], "inline=") || strings.HasPrefix(a[0], "conditions=") || strings.HasPrefix(a[0], "comments=") || strings.HasPrefix(a[0], "types=") || strings.HasPrefix(a[0], "overrides=") || strings.HasPrefix(a[0], "preset=") || strings.HasPrefix(a[0], "banner=") || strings.HasPrefix(a[0], "shim=")) {
+		a = a[1:]
+	}
+	r.Target = a[0]
+	submodule := strings.Join(a[1:], "/")
+	for {
+		ext := path.Ext(submodule)
+		switch ext {
+		case ".development":
+			r.Dev = true
+		case ".bundle":
+			r.Bundle = true
+		case ".standalone", ".nobrowser", ".transform", ".decorators", ".node", ".nominify", ".minify", ".utf8", ".systemjs", ".types", ".nodts":
+		default:
+			ext = ""
+		}
+		if ext == "" {
+			break
+		}
+		submodule = strings.TrimSuffix(submodule, ext)
+	}
+	if submodule != path.Base(name) {
+		r.Submodule = submodule
+	}
+	ok = true
+	return
+}
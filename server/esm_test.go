@@ -0,0 +1,179 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/postui/postdb/q"
+)
+
+func TestParseBuildID(t *testing.T) {
+	for id, expected := range map[string]BuildRecord{
+		"v43/react@17.0.2/es2020/react.development": {Version: "17.0.2", Target: "es2020", Dev: true},
+		"v43/@babel/runtime@7.14.6/deps=react@17.0.2/deno/helpers/esm/extends.bundle": {
+			Version:   "7.14.6",
+			Target:    "deno",
+			Submodule: "helpers/esm/extends",
+			Bundle:    true,
+		},
+		"v43/preact@10.5.13/inline=1024/comments=none/es2015/preact":                      {Version: "10.5.13", Target: "es2015"},
+		"v43/swr@0.5.6/es2020/swr.bundle.standalone":                                      {Version: "0.5.6", Target: "es2020", Bundle: true},
+		"v43/swr@0.5.6/shim=v1/es2020/swr":                                                {Version: "0.5.6", Target: "es2020"},
+		"v43/swr@0.5.6/gh=vercel~swr@0123456789abcdef0123456789abcdef01234567/es2020/swr": {Version: "0.5.6", Target: "es2020"},
+	} {
+		expected.ID = id
+		_, r, ok := parseBuildID(id)
+		if !ok || r != expected {
+			t.Fatalf("unexpected build record of '%s': %+v", id, r)
+		}
+	}
+
+	name, _, _ := parseBuildID("v43/@babel/runtime@7.14.6/es2015/runtime")
+	if name != "@babel/runtime" {
+		t.Fatalf("unexpected package name: %s", name)
+	}
+	if _, _, ok := parseBuildID("react@17.0.2/es2020/react"); ok {
+		t.Fatal("build id without build version should be invalid")
+	}
+}
+
+func TestEnsureMJS(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testensuremjs")
+	os.RemoveAll(testDir)
+	defer func(c *Config) { config = c }(config)
+	config = &Config{storageDir: testDir}
+	fs := getStorage()
+
+	if err := ensureMJS("v43/foo@1.0.0/es2020/foo"); !os.IsNotExist(err) {
+		t.Fatalf("should not exist, got %v", err)
+	}
+	if err := fs.Put("builds/v43/foo@1.0.0/es2020/foo.js", strings.NewReader("export default 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureMJS("v43/foo@1.0.0/es2020/foo"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := fs.Get("builds/v43/foo@1.0.0/es2020/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "export default 1" {
+		t.Fatalf("unexpected content: %s %v", data, err)
+	}
+}
+
+func TestListCachedBuilds(t *testing.T) {
+	useFixtures(t, newFixtures())
+	fs := getStorage()
+	for id, size := range map[string]int{
+		"v43/react@17.0.2/es2020/react":           30,
+		"v43/react-dom@17.0.2/es2020/react-dom":   100,
+		"v43/react@17.0.2/es2020/react.bundle":    10,
+		"v43/preact@10.5.13/es2020/preact":        20,
+		"v43/@scope/react@1.0.0/es2020/react.foo": 5,
+	} {
+		if _, err := db.Put(q.Alias(id), q.KV{"esmeta": []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Put(path.Join("builds", id+".js"), strings.NewReader(strings.Repeat("a", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Put(q.Alias("npm:react@17"), q.KV{"package": []byte("{}")})
+
+	builds, err := listCachedBuilds("react", "size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, b := range builds {
+		ids = append(ids, b.ID)
+	}
+	if strings.Join(ids, ",") != "v43/react-dom@17.0.2/es2020/react-dom,v43/react@17.0.2/es2020/react,v43/react@17.0.2/es2020/react.bundle" {
+		t.Fatalf("unexpected builds %v", ids)
+	}
+	if builds[0].Name != "react-dom" || builds[0].Size != 100 || builds[2].Bundle != true {
+		t.Fatalf("unexpected build %+v", builds[0])
+	}
+
+	builds, err = listCachedBuilds("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 5 || builds[0].ID != "v43/@scope/react@1.0.0/es2020/react.foo" {
+		t.Fatalf("unexpected builds %+v", builds)
+	}
+}
+
+func TestListBuilds(t *testing.T) {
+	useFixtures(t, newFixtures())
+	// the builds stored by the previous versions of the server have no tags
+	for _, id := range []string{
+		"v43/react@17.0.2/es2020/react",
+		"v43/react@16.14.0/es2020/react.development",
+		"v43/react-dom@17.0.2/es2020/react-dom",
+	} {
+		if _, err := db.Put(q.Alias(id), q.KV{"esmeta": []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Put(q.Alias("npm:react@17"), q.KV{"package": []byte("{}")})
+
+	records, err := listBuilds("react")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected builds %+v", records)
+	}
+	for _, r := range records {
+		if r.Version != "17.0.2" && (r.Version != "16.14.0" || !r.Dev) {
+			t.Fatalf("unexpected build %+v", r)
+		}
+	}
+}
+
+func TestPurgeBuilds(t *testing.T) {
+	useFixtures(t, newFixtures())
+	fs := getStorage()
+	// the builds stored by the previous versions of the server have no tags
+	for _, id := range []string{
+		"v43/react@17.0.2/es2020/react",
+		"v43/react@16.14.0/es2020/react.development",
+		"v43/react-dom@17.0.2/es2020/react-dom",
+	} {
+		if _, err := db.Put(q.Alias(id), q.KV{"esmeta": []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Put(path.Join("builds", id+".js"), strings.NewReader("export default 1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cacheExports(pkg{name: "react", version: "17.0.2"}, "production", []string{"default"})
+	cacheExports(pkg{name: "react-dom", version: "17.0.2"}, "production", []string{"default"})
+
+	n, err := purgeBuilds("react")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected purged builds %d", n)
+	}
+	if storageFileExists("builds/v43/react@17.0.2/es2020/react.js") || !storageFileExists("builds/v43/react-dom@17.0.2/es2020/react-dom.js") {
+		t.Fatal("only the build files of the package should be deleted")
+	}
+	if _, ok := getCachedExports(pkg{name: "react", version: "17.0.2"}, "production"); ok {
+		t.Fatal("the cached exports of the package should be deleted")
+	}
+	if _, ok := getCachedExports(pkg{name: "react-dom", version: "17.0.2"}, "production"); !ok {
+		t.Fatal("the cached exports of other packages should be kept")
+	}
+	if n, err = purgeBuilds("react"); err != nil || n != 0 {
+		t.Fatalf("nothing should be purged again, got %d %v", n, err)
+	}
+}
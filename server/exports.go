@@ -2,29 +2,49 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/esbuild-internal/js_ast"
 	"github.com/ije/esbuild-internal/js_parser"
 	"github.com/ije/esbuild-internal/logger"
 	"github.com/ije/esbuild-internal/test"
 	"github.com/ije/gox/utils"
+	"github.com/postui/postdb/q"
 )
 
 var cjsModuleLexerAppDir string
 
+var (
+	regAMDDefineCheck = regexp.MustCompile(`typeof\s+define\s*===?\s*["']function["']`)
+	regAMDDefineProp  = regexp.MustCompile(`define\.amd\b`)
+)
+
 type cjsModuleLexerResult struct {
 	Exports []string `json:"exports"`
 	Error   string   `json:"error"`
+	// the error thrown by the package during the initialization, the exports
+	// found by the lexer are still returned
+	RequireError string `json:"requireError"`
 }
 
 func parseCJSModuleExports(buildDir string, importPath string, env string) (ret cjsModuleLexerResult, err error) {
+	return parseCJSModuleExportsContext(context.Background(), buildDir, importPath, env)
+}
+
+// parseCJSModuleExportsContext parses the exports of the cjs module, the nodejs process
+// will be killed when the context is done.
+func parseCJSModuleExportsContext(ctx context.Context, buildDir string, importPath string, env string) (ret cjsModuleLexerResult, err error) {
 	if cjsModuleLexerAppDir == "" {
 		cjsModuleLexerAppDir = path.Join(os.TempDir(), "esmd-cjs-module-lexer")
 		ensureDir(cjsModuleLexerAppDir)
@@ -76,6 +96,7 @@ func parseCJSModuleExports(buildDir string, importPath string, env string) (ret
 
 			const exports = []
 			const paths = []
+			let requireError = undefined
 
 			try {
 				const jsFile = await resolve('%s', '%s')
@@ -94,22 +115,29 @@ func parseCJSModuleExports(buildDir string, importPath string, env string) (ret
 					}
 				}
 				if (!jsFile.endsWith('.json')) {
-					const mod = require(jsFile)
-					if (typeof mod === 'object' && mod !== null && !Array.isArray(mod)) {
-						for (const key of Object.keys(mod)) {
-							if (typeof key === 'string' && key !== '' && !exports.includes(key)) {
-								exports.push(key)
+					// the package may throw during the initialization, like it expects a DOM
+					try {
+						const mod = require(jsFile)
+						// the properties of a function export, like 'module.exports = fn; fn.helper = ...',
+						// are the named exports too
+						if ((typeof mod === 'object' && mod !== null && !Array.isArray(mod)) || typeof mod === 'function') {
+							for (const key of Object.keys(mod)) {
+								if (typeof key === 'string' && key !== '' && !exports.includes(key)) {
+									exports.push(key)
+								}
 							}
 						}
+					} catch(e) {
+						requireError = String(e && e.message || e)
 					}
 				}
-				return { exports }
+				return { exports, requireError }
 			} catch(e) {
 				return { error: e.message }
 			}
 		}
 
-		getExports().then(ret => {
+		getExports().catch(e => ({ error: String(e && e.message || e) })).then(ret => {
 			const saveDir = join('%s', '%s')
 			if (!fs.existsSync(saveDir)){
 				fs.mkdirSync(saveDir, {recursive: true});
@@ -122,11 +150,17 @@ func parseCJSModuleExports(buildDir string, importPath string, env string) (ret
 		})
 	`, buildDir, importPath, buildDir, importPath))
 
-	cmd := exec.Command("node")
+	release, err := acquireProcess(ctx)
+	if err != nil {
+		return
+	}
+	cmd := exec.CommandContext(ctx, "node")
 	cmd.Stdin = buf
 	cmd.Dir = cjsModuleLexerAppDir
 	cmd.Env = append(os.Environ(), fmt.Sprintf(`NODE_ENV=%s`, env))
 	output, e := cmd.CombinedOutput()
+	release()
+	getBuildLog(ctx).Printf("cjs-module-lexer(%s) in %v: %v\n%s", importPath, time.Now().Sub(start), e, output)
 	if e != nil {
 		err = fmt.Errorf("nodejs: %s", string(output))
 		return
@@ -136,6 +170,14 @@ func parseCJSModuleExports(buildDir string, importPath string, env string) (ret
 	if err != nil {
 		return
 	}
+	if ret.RequireError != "" {
+		log.Warnf("cjs-module-lexer: require('%s') failed: %s", importPath, ret.RequireError)
+		getBuildLog(ctx).Printf("cjs-module-lexer: require('%s') failed: %s", importPath, ret.RequireError)
+	}
+	if ret.Error != "" {
+		log.Warnf("cjs-module-lexer(%s): %s", importPath, ret.Error)
+		getBuildLog(ctx).Printf("cjs-module-lexer(%s): %s", importPath, ret.Error)
+	}
 
 	log.Debug("run cjs-module-lexer in", time.Now().Sub(start))
 	return
@@ -239,3 +281,174 @@ func parseESModuleExports(buildDir string, importPath string) (exports []string,
 	}
 	return
 }
+
+// parseModuleExportsByEsbuild gets the exports of the module from the esbuild metafile,
+// that works for the modules can't be required by nodejs or analyzed statically by
+// `parseESModuleExports`. The exports of cjs modules can't be found this way.
+func parseModuleExportsByEsbuild(buildDir string, importPath string, checkDefault bool) (exports []string, err error) {
+	build := func(code string) (api.BuildResult, error) {
+		result := api.Build(api.BuildOptions{
+			Stdin: &api.StdinOptions{
+				Contents:   code,
+				ResolveDir: buildDir,
+			},
+			Outdir:     "/esbuild",
+			Write:      false,
+			Bundle:     true,
+			Format:     api.FormatESModule,
+			Platform:   api.PlatformNode,
+			MainFields: []string{"module", "main"},
+			Metafile:   true,
+		})
+		if len(result.Errors) > 0 {
+			return result, fmt.Errorf("esbuild: %s", result.Errors[0].Text)
+		}
+		return result, nil
+	}
+
+	result, err := build(fmt.Sprintf(`export * from "%s";`, importPath))
+	if err != nil {
+		return
+	}
+	var metafile struct {
+		Outputs map[string]struct {
+			Exports []string `json:"exports"`
+		} `json:"outputs"`
+	}
+	err = json.Unmarshal([]byte(result.Metafile), &metafile)
+	if err != nil {
+		return
+	}
+	for _, output := range metafile.Outputs {
+		exports = append(exports, output.Exports...)
+	}
+	// `export *` doesn't re-export the default
+	if checkDefault && len(exports) > 0 {
+		if _, e := build(fmt.Sprintf(`export { default } from "%s";`, importPath)); e == nil {
+			exports = append(exports, "default")
+		}
+	}
+	return
+}
+
+// isUMDModule checks if the file is wrapped by the umd pattern that checks the
+// amd loader, like `typeof define === "function" && define.amd`.
+func isUMDModule(filename string) bool {
+	if filename == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	return regAMDDefineCheck.Match(data) && regAMDDefineProp.Match(data)
+}
+
+// exportsCacheKey returns the db key of the cached exports of the package, the
+// exports of the local packages are not cached since they may be changed.
+func exportsCacheKey(pkg pkg, env string) string {
+	if pkg.local != "" {
+		return ""
+	}
+	if pkg.git != "" {
+		return fmt.Sprintf("exports:gh:%s/%s?env=%s", pkg.git, pkg.submodule, env)
+	}
+	return fmt.Sprintf("exports:%s?env=%s", pkg.String(), env)
+}
+
+// getCachedExports returns the exports of the package cached by the previous
+// exports probe or build.
+func getCachedExports(pkg pkg, env string) (exports []string, ok bool) {
+	key := exportsCacheKey(pkg, env)
+	if key == "" {
+		return
+	}
+	post, err := db.Get(q.Alias(key), q.Select("exports"))
+	if err != nil {
+		return
+	}
+	if json.Unmarshal(post.KV["exports"], &exports) != nil {
+		return nil, false
+	}
+	return exports, true
+}
+
+// cacheExports caches the exports of the package permanently, the published
+// versions are immutable.
+func cacheExports(pkg pkg, env string, exports []string) {
+	key := exportsCacheKey(pkg, env)
+	if key == "" {
+		return
+	}
+	if exports == nil {
+		exports = []string{}
+	}
+	kv := q.KV{"exports": utils.MustEncodeJSON(exports)}
+	if _, err := db.Get(q.Alias(key)); err == nil {
+		db.Update(q.Alias(key), kv)
+	} else {
+		db.Put(q.Alias(key), kv)
+	}
+}
+
+// probeExports gets the exports of the package without building it, only the
+// package is installed and parsed, the declaration files and esbuild are skipped.
+func probeExports(pkg pkg, env string) (exports []string, err error) {
+	if exports, ok := getCachedExports(pkg, env); ok {
+		return exports, nil
+	}
+
+	wd, err := ioutil.TempDir("", "esm-exports-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(wd)
+
+	ctx, cancel := withBuildTimeout()
+	defer cancel()
+	esmeta, err := initBuild(ctx, wd, pkg, nil, true, true, "", env)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = withKind(ErrBuildTimeout, fmt.Errorf("exports probe timeout after %v", config.buildTimeout))
+		}
+		return
+	}
+	exports = esmeta.Exports
+	if exports == nil {
+		exports = []string{}
+	}
+	// the cjs exports are cached by initBuild only if they are parsed successfully
+	if esmeta.Module != "" {
+		cacheExports(pkg, env, exports)
+	}
+	return
+}
+
+// diffExports compares the exports of two builds, the results are sorted.
+func diffExports(from []string, to []string) (added []string, removed []string, unchanged []string) {
+	fromSet := newStringSet()
+	for _, name := range from {
+		fromSet.Add(name)
+	}
+	toSet := newStringSet()
+	for _, name := range to {
+		toSet.Add(name)
+	}
+	added, removed, unchanged = []string{}, []string{}, []string{}
+	for _, name := range toSet.Values() {
+		if fromSet.Has(name) {
+			unchanged = append(unchanged, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+	for _, name := range fromSet.Values() {
+		if !toSet.Has(name) {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(unchanged)
+	return
+}
@@ -6,6 +6,8 @@ import (
 	"path"
 	"strings"
 	"testing"
+
+	"github.com/postui/postdb"
 )
 
 func TestParseCJSModuleExports(t *testing.T) {
@@ -58,3 +60,114 @@ func TestParseESModuleExports(t *testing.T) {
 		t.Fatalf("unexpected exports.js: %s", strings.Join(exports, ","))
 	}
 }
+
+func TestParseModuleExportsByEsbuild(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testexportsbyesbuild")
+	os.RemoveAll(testDir)
+	pkgDir := path.Join(testDir, "node_modules", "fixture")
+	ensureDir(pkgDir)
+	files := map[string]string{
+		"package.json": `{"name":"fixture","exports":{"import":"./index.mjs"}}`,
+		"index.mjs":    `export * from "./a.mjs"; export default "fixture";`,
+		"a.mjs":        `export const a = "a"; export function b() {}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exports, err := parseModuleExportsByEsbuild(testDir, "fixture", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(exports, ",") != "a,b,default" {
+		t.Fatalf("unexpected exports: %s", strings.Join(exports, ","))
+	}
+}
+
+func TestExportsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-test-db-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err = postdb.Open(path.Join(dir, "esm.db"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		db = nil
+	}()
+
+	react := pkg{name: "react", version: "17.0.2"}
+	if _, ok := getCachedExports(react, "production"); ok {
+		t.Fatal("unexpected cached exports")
+	}
+	cacheExports(react, "production", []string{"Component", "useState"})
+	exports, ok := getCachedExports(react, "production")
+	if !ok || strings.Join(exports, ",") != "Component,useState" {
+		t.Fatalf("unexpected cached exports %v", exports)
+	}
+	if _, ok := getCachedExports(react, "development"); ok {
+		t.Fatal("the exports should be cached by env")
+	}
+	cacheExports(react, "production", nil)
+	exports, ok = getCachedExports(react, "production")
+	if !ok || len(exports) != 0 {
+		t.Fatalf("unexpected cached exports %v", exports)
+	}
+
+	local := pkg{name: "foo", version: "1.0.0", local: "foo"}
+	cacheExports(local, "production", []string{"foo"})
+	if _, ok := getCachedExports(local, "production"); ok {
+		t.Fatal("the exports of local packages should not be cached")
+	}
+}
+
+func TestDiffExports(t *testing.T) {
+	added, removed, unchanged := diffExports([]string{"b", "a", "c", "a"}, []string{"d", "a", "b"})
+	if strings.Join(added, ",") != "d" || strings.Join(removed, ",") != "c" || strings.Join(unchanged, ",") != "a,b" {
+		t.Fatalf("unexpected diff %v %v %v", added, removed, unchanged)
+	}
+	added, removed, unchanged = diffExports(nil, nil)
+	if added == nil || removed == nil || unchanged == nil {
+		t.Fatal("the empty diff should be empty lists")
+	}
+}
+
+func TestProbeExportsCache(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-esm", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const foo = 1;`,
+	})
+	f.add(NpmPackage{Name: "fixture-broken-cjs", Version: "1.0.0", Main: "index.js"}, map[string]string{
+		"index.js": `module.exports = {`,
+	})
+	useFixtures(t, f)
+	// the lexer app without the deps fails the cjs parse without installing them
+	lexerDir := cjsModuleLexerAppDir
+	dir, err := ioutil.TempDir("", "esm-test-lexer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cjsModuleLexerAppDir = dir
+	defer func() {
+		os.RemoveAll(dir)
+		cjsModuleLexerAppDir = lexerDir
+	}()
+
+	exports, err := probeExports(pkg{name: "fixture-esm", version: "1.0.0"}, "production")
+	if err != nil || strings.Join(exports, ",") != "foo" {
+		t.Fatalf("unexpected exports %v %v", exports, err)
+	}
+	if cached, ok := getCachedExports(pkg{name: "fixture-esm", version: "1.0.0"}, "production"); !ok || strings.Join(cached, ",") != "foo" {
+		t.Fatalf("the exports should be cached, got %v", cached)
+	}
+
+	probeExports(pkg{name: "fixture-broken-cjs", version: "1.0.0"}, "production")
+	if cached, ok := getCachedExports(pkg{name: "fixture-broken-cjs", version: "1.0.0"}, "production"); ok {
+		t.Fatalf("the exports of the failed parse should not be cached, got %v", cached)
+	}
+}
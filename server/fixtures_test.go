@@ -0,0 +1,662 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ije/gox/utils"
+	"github.com/postui/postdb"
+)
+
+// fixtures is a fake registry and installer for the offline build tests, the
+// packages are installed from the in-memory files instead of the npm registry.
+type fixtures struct {
+	records   map[string]*NpmPackageRecords
+	files     map[string]map[string]string
+	lock      sync.Mutex
+	installed []string
+}
+
+func newFixtures() *fixtures {
+	return &fixtures{
+		records: map[string]*NpmPackageRecords{},
+		files:   map[string]map[string]string{},
+	}
+}
+
+// add adds a version of the package, the version added at last is tagged as `latest`.
+func (f *fixtures) add(info NpmPackage, files map[string]string) {
+	r, ok := f.records[info.Name]
+	if !ok {
+		r = &NpmPackageRecords{DistTags: map[string]string{}, Versions: map[string]NpmPackage{}}
+		f.records[info.Name] = r
+	}
+	r.Versions[info.Version] = info
+	r.DistTags["latest"] = info.Version
+	f.files[info.Name+"@"+info.Version] = files
+}
+
+func (f *fixtures) PackageInfo(name string, version string) (info NpmPackage, submodule string, err error) {
+	name, submodule = splitPkgPath(name)
+	r, ok := f.records[name]
+	if ok {
+		info = r.Resolve(version)
+	}
+	if info.Version == "" {
+		err = withKind(ErrPackageNotFound, fmt.Errorf("npm: package '%s@%s' not found", name, version))
+	}
+	return
+}
+
+// Install installs the packages and their dependencies into the flat `node_modules`.
+func (f *fixtures) Install(ctx context.Context, wd string, packages ...string) error {
+	for _, spec := range packages {
+		i := strings.LastIndexByte(spec, '@')
+		if i <= 0 {
+			return fmt.Errorf("invalid package '%s'", spec)
+		}
+		info, _, err := f.PackageInfo(spec[:i], spec[i+1:])
+		if err != nil {
+			return withKind(ErrInstallFailed, err)
+		}
+		pkgDir := path.Join(wd, "node_modules", info.Name)
+		if fileExists(path.Join(pkgDir, "package.json")) {
+			continue
+		}
+		ensureDir(pkgDir)
+		err = ioutil.WriteFile(path.Join(pkgDir, "package.json"), utils.MustEncodeJSON(info), 0644)
+		if err != nil {
+			return err
+		}
+		for name, content := range f.files[info.Name+"@"+info.Version] {
+			ensureDir(path.Dir(path.Join(pkgDir, name)))
+			err = ioutil.WriteFile(path.Join(pkgDir, name), []byte(content), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		f.lock.Lock()
+		f.installed = append(f.installed, info.Name+"@"+info.Version)
+		f.lock.Unlock()
+		deps := []string{}
+		for name, version := range info.Dependencies {
+			deps = append(deps, name+"@"+version)
+		}
+		err = f.Install(ctx, wd, deps...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useFixtures sets up the config, the db and the storage of the offline build
+// tests, the packages are resolved and installed by the fixtures. The config
+// is restored when the test is done.
+func useFixtures(t *testing.T, f *fixtures) {
+	dir, err := ioutil.TempDir("", "esm-test-fixtures-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config
+	config = &Config{
+		storageDir:   path.Join(dir, "storage"),
+		buildTimeout: time.Minute,
+		registry:     f,
+		installer:    f,
+	}
+	db, err = postdb.Open(path.Join(dir, "esm.db"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+		config = cfg
+		os.RemoveAll(dir)
+	})
+}
+
+func TestBuildWithFixtures(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-dep", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const dep = "dep@1.0.0";`,
+	})
+	f.add(NpmPackage{Name: "fixture-dep", Version: "1.1.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const dep = "dep@1.1.0";`,
+	})
+	f.add(NpmPackage{Name: "fixture", Version: "1.0.0", Type: "module", Module: "index.js", Dependencies: map[string]string{"fixture-dep": "~1.0.0"}}, map[string]string{
+		"index.js": `import { dep } from "fixture-dep"; export const foo = "foo:" + dep; export default foo;`,
+	})
+	useFixtures(t, f)
+
+	info, _, err := getRegistry().PackageInfo("fixture-dep", "^1.0.0")
+	if err != nil || info.Version != "1.1.0" {
+		t.Fatalf("unexpected resolved version %s: %v", info.Version, err)
+	}
+
+	task := &buildTask{pkg: pkg{name: "fixture", version: "1.0.0"}, target: "es2020", bundle: true}
+	esm, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(esm.Exports, ",") != "default,foo" && strings.Join(esm.Exports, ",") != "foo,default" {
+		t.Fatalf("unexpected exports %v", esm.Exports)
+	}
+	if strings.Join(f.installed, ",") != "fixture@1.0.0,fixture-dep@1.0.0" {
+		t.Fatalf("unexpected installed packages %v", f.installed)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(code), "dep@1.0.0") {
+		t.Fatalf("the dep should be bundled:\n%s", code)
+	}
+	if _, _, ok := findESM(task.ID()); !ok {
+		t.Fatal("the build should be stored")
+	}
+}
+
+func TestBuildWithInstallScripts(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-postinstall", Version: "1.0.0", Type: "module", Module: "dist/index.js"}, map[string]string{
+		"package.json": `{"name":"fixture-postinstall","version":"1.0.0","type":"module","module":"dist/index.js","scripts":{"postinstall":"node build.cjs"}}`,
+		"build.cjs":    `require("fs").mkdirSync("dist"); require("fs").writeFileSync("dist/index.js", "export const built = " + JSON.stringify(process.env.SECRET || "built"))`,
+	})
+	useFixtures(t, f)
+	os.Setenv("SECRET", "secret")
+	defer os.Unsetenv("SECRET")
+
+	// the scripts are not allowed by default
+	wd, err := ioutil.TempDir("", "esm-test-scripts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wd)
+	err = f.Install(context.Background(), wd, "fixture-postinstall@1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran, err := runInstallScripts(context.Background(), wd)
+	if err != nil || len(ran) != 0 || fileExists(path.Join(wd, "node_modules/fixture-postinstall/dist/index.js")) {
+		t.Fatalf("the scripts should not run, ran %v: %v", ran, err)
+	}
+
+	config.installScripts = []string{"fixture-postinstall"}
+	task := &buildTask{pkg: pkg{name: "fixture-postinstall", version: "1.0.0"}, target: "es2020"}
+	esm, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(esm.InstallScripts, ",") != "fixture-postinstall@1.0.0" || strings.Join(esm.Exports, ",") != "built" {
+		t.Fatalf("unexpected build %v %v", esm.InstallScripts, esm.Exports)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(code), `"built"`) {
+		t.Fatalf("the script should run without the server env:\n%s", code)
+	}
+}
+
+func TestBuildNativeAddon(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-gyp", Version: "1.0.0", Main: "index.js"}, map[string]string{
+		"index.js":    `module.exports = require("./build/Release/addon.node")`,
+		"binding.gyp": `{"targets": [{"target_name": "addon", "sources": ["addon.cc"]}]}`,
+	})
+	f.add(NpmPackage{Name: "fixture-prebuilt", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js":                       `export { default } from "./prebuilds/linux-x64/addon.node"`,
+		"prebuilds/linux-x64/addon.node": "\x7fELF",
+	})
+	f.add(NpmPackage{Name: "fixture-uses-addon", Version: "1.0.0", Type: "module", Module: "index.js", Dependencies: map[string]string{"fixture-prebuilt-dep": "1.0.0"}}, map[string]string{
+		"index.js": `import addon from "fixture-prebuilt-dep/addon.node"; export default addon;`,
+	})
+	f.add(NpmPackage{Name: "fixture-prebuilt-dep", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js":   `export default 1`,
+		"addon.node": "\x7fELF",
+	})
+	useFixtures(t, f)
+
+	for _, name := range []string{"fixture-gyp", "fixture-prebuilt", "fixture-uses-addon"} {
+		task := &buildTask{pkg: pkg{name: name, version: "1.0.0"}, target: "es2020", bundle: true}
+		_, _, err := task.buildESM()
+		if !errors.Is(err, ErrUnsupportedPackage) || !strings.Contains(err.Error(), "native addon") {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if errorStatus(err) != 422 {
+			t.Fatalf("%s: unexpected status %d", name, errorStatus(err))
+		}
+	}
+}
+
+func TestBuildWithBasePath(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-peer", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const peer = "peer";`,
+	})
+	f.add(NpmPackage{Name: "fixture-with-peer", Version: "1.0.0", Type: "module", Module: "index.js", PeerDependencies: map[string]string{"fixture-peer": "^1.0.0"}}, map[string]string{
+		"index.js": `import { peer } from "fixture-peer"; export const foo = Buffer.from(peer);`,
+	})
+	useFixtures(t, f)
+	config.basePath = "/cdn"
+
+	task := &buildTask{pkg: pkg{name: "fixture-with-peer", version: "1.0.0"}, target: "es2020", bundle: true}
+	_, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, importPath := range []string{
+		fmt.Sprintf(`"/cdn/v%d/fixture-peer@1.0.0/es2020/fixture-peer.bundle.js"`, VERSION),
+		fmt.Sprintf(`"/cdn/v%d/node_buffer.js"`, VERSION),
+	} {
+		if !strings.Contains(string(code), importPath) {
+			t.Fatalf("missing the import %s:\n%s", importPath, code)
+		}
+	}
+	if withBasePath("https://esm.sh/react") != "https://esm.sh/react" || withBasePath("//esm.sh/react") != "//esm.sh/react" {
+		t.Fatal("the urls should not be prefixed")
+	}
+}
+
+func TestBuildWithUTF8Charset(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-i18n", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const hello = "你好，世界 🌏";`,
+	})
+	useFixtures(t, f)
+
+	build := func(task *buildTask) string {
+		_, _, err := task.buildESM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		code, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(code)
+	}
+	ascii := build(&buildTask{pkg: pkg{name: "fixture-i18n", version: "1.0.0"}, target: "es2020"})
+	task := &buildTask{pkg: pkg{name: "fixture-i18n", version: "1.0.0"}, target: "es2020", utf8: true}
+	utf8 := build(task)
+	if strings.Contains(ascii, "你好") || !strings.Contains(ascii, `\u4F60\u597D`) {
+		t.Fatalf("the non-ASCII characters should be escaped by default:\n%s", ascii)
+	}
+	if !strings.Contains(utf8, "你好，世界 🌏") || len(utf8) >= len(ascii) {
+		t.Fatalf("the non-ASCII characters should be kept with the utf8 charset:\n%s", utf8)
+	}
+	if !strings.HasSuffix(task.ID(), "/fixture-i18n.utf8") {
+		t.Fatalf("unexpected build id %s", task.ID())
+	}
+	if name, r, ok := parseBuildID(task.ID()); !ok || name != "fixture-i18n" || r.Submodule != "" {
+		t.Fatalf("unexpected build record %s %v", name, r)
+	}
+}
+
+func TestBuildStrictExternals(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-peer", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const peer = "peer";`,
+	})
+	f.add(NpmPackage{Name: "fixture-dep", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const dep = "dep";`,
+	})
+	f.add(NpmPackage{Name: "fixture-with-peer", Version: "1.0.0", Type: "module", Module: "index.js", Dependencies: map[string]string{"fixture-dep": "1.0.0"}, PeerDependencies: map[string]string{"fixture-peer": "^1.0.0"}}, map[string]string{
+		"index.js": `import { peer } from "fixture-peer"; import { dep } from "fixture-dep"; export const foo = peer + dep;`,
+	})
+	useFixtures(t, f)
+
+	p := pkg{name: "fixture-with-peer", version: "1.0.0"}
+	esm, _, err := (&buildTask{pkg: p, target: "es2020", bundle: true}).buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(esm.PeerExternals, ",") != "fixture-peer" {
+		t.Fatalf("unexpected peer externals %v", esm.PeerExternals)
+	}
+	err = esm.checkExternals(nil)
+	if !errors.Is(err, ErrUnexpectedExternals) || !strings.Contains(err.Error(), "fixture-peer (a peer dependency of fixture-with-peer)") || errorStatus(err) != 422 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = esm.checkExternals(pkgSlice{{name: "fixture-peer", version: "1.0.0"}}); err != nil {
+		t.Fatalf("the listed deps should be acknowledged: %v", err)
+	}
+
+	// the deps are external by design without bundling, and the standalone mode bundles the peers
+	for _, task := range []*buildTask{{pkg: p, target: "es2020"}, {pkg: p, target: "es2020", bundle: true, standalone: true}} {
+		esm, _, err = task.buildESM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = esm.checkExternals(nil); err != nil {
+			t.Fatalf("%s: %v", task.ID(), err)
+		}
+		// the nil peer externals mark the builds made before they were recorded
+		if stored, _, ok := findESM(task.ID()); !ok || stored.PeerExternals == nil {
+			t.Fatalf("%s: the peer externals should be recorded", task.ID())
+		}
+	}
+
+	esm = &ESMeta{NpmPackage: &NpmPackage{Name: "fixture-with-peer"}, MissingDeps: []string{"fixture-missing"}}
+	if err = esm.checkExternals(nil); err == nil || !strings.Contains(err.Error(), "fixture-missing (can't be resolved)") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestBuildWithGlobalExternalSubmodule(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-react", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js":       `export const createElement = () => "bundled";`,
+		"jsx-runtime.js": `export const jsx = () => "bundled-jsx";`,
+	})
+	f.add(NpmPackage{Name: "fixture-component", Version: "1.0.0", Type: "module", Module: "index.js", Dependencies: map[string]string{"fixture-react": "1.0.0"}}, map[string]string{
+		"index.js": `import { jsx } from "fixture-react/jsx-runtime"; import { createElement } from "fixture-react"; export const render = () => jsx() + createElement();`,
+	})
+	useFixtures(t, f)
+	config.globalExternals = []string{"fixture-react"}
+	config.globalExternalURL = "https://cdn.example.com/{name}@{version}"
+
+	task := &buildTask{pkg: pkg{name: "fixture-component", version: "1.0.0"}, target: "es2020", bundle: true}
+	_, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(code), "bundled") {
+		t.Fatalf("the global external and its submodule should not be bundled:\n%s", code)
+	}
+	if !strings.Contains(string(code), `"https://cdn.example.com/fixture-react@`) {
+		t.Fatalf("the global external should be imported from the url:\n%s", code)
+	}
+}
+
+func TestBuildImportFlags(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-peer", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const peer = "peer";`,
+	})
+	f.add(NpmPackage{Name: "fixture-with-peer", Version: "1.0.0", Type: "module", Module: "index.js", PeerDependencies: map[string]string{"fixture-peer": "^1.0.0"}}, map[string]string{
+		"index.js": `import { peer } from "fixture-peer"; export const foo = peer;`,
+	})
+	useFixtures(t, f)
+
+	for _, c := range []struct {
+		task  *buildTask
+		flags string
+	}{
+		{&buildTask{}, ""},
+		{&buildTask{isDev: true, bundle: true}, ".development.bundle"},
+		{&buildTask{platform: "node"}, ".node"},
+		{&buildTask{noMinify: true}, ".nominify"},
+		{&buildTask{isDev: true, forceMinify: true}, ".development.minify"},
+		{&buildTask{utf8: true}, ".utf8"},
+	} {
+		task := c.task
+		task.pkg = pkg{name: "fixture-with-peer", version: "1.0.0"}
+		task.target = "es2020"
+		_, _, err := task.buildESM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		importPath := fmt.Sprintf(`"/v%d/fixture-peer@1.0.0/es2020/fixture-peer%s.js"`, VERSION, c.flags)
+		if !strings.Contains(string(code), importPath) {
+			t.Fatalf("%s: missing the import %s:\n%s", task.ID(), importPath, code)
+		}
+	}
+}
+
+func TestBuildWithBrowserField(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-x", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const x = "x-content";`,
+	})
+	f.add(NpmPackage{Name: "fixture-b", Version: "1.0.0", Type: "module", Module: "index.js", Dependencies: map[string]string{"fixture-x": "1.0.0"}}, map[string]string{
+		"index.js": `export { x } from "fixture-x";`,
+	})
+	f.add(NpmPackage{
+		Name:         "fixture-isomorphic",
+		Version:      "1.0.0",
+		Type:         "module",
+		Module:       "index.js",
+		Browser:      map[string]interface{}{"./server.js": "./client.js", "fixture-x": false},
+		Dependencies: map[string]string{"fixture-b": "1.0.0"},
+	}, map[string]string{
+		"index.js":  `export { env } from "./server.js"; export { x } from "fixture-b";`,
+		"server.js": `export const env = "server-content";`,
+		"client.js": `export const env = "client-content";`,
+	})
+	useFixtures(t, f)
+
+	build := func(task *buildTask) string {
+		_, _, err := task.buildESM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		code, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(code)
+	}
+	code := build(&buildTask{pkg: pkg{name: "fixture-isomorphic", version: "1.0.0"}, target: "es2020", bundle: true})
+	if !strings.Contains(code, "client-content") {
+		t.Fatalf("the browser field should be applied:\n%s", code)
+	}
+	// the `browser` field of the package doesn't remap the imports of its deps
+	if !strings.Contains(code, "x-content") {
+		t.Fatalf("the imports of the deps should not be remapped:\n%s", code)
+	}
+	code = build(&buildTask{pkg: pkg{name: "fixture-isomorphic", version: "1.0.0"}, target: "es2020", bundle: true, noBrowser: true})
+	if !strings.Contains(code, "server-content") || strings.Contains(code, "client-content") {
+		t.Fatalf("the browser field should be ignored with the no-browser query:\n%s", code)
+	}
+}
+
+func TestBuildWithBanner(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-buffer", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const foo = Buffer.from(process.env.FOO || "foo");`,
+	})
+	useFixtures(t, f)
+	config.banner = "/*! (c) fixture */"
+
+	task := &buildTask{pkg: pkg{name: "fixture-buffer", version: "1.0.0"}, target: "es2020"}
+	_, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(code), "/*! (c) fixture */\n") || strings.Count(string(code), "(c) fixture") != 1 {
+		t.Fatalf("the banner should be written first:\n%s", code)
+	}
+	if !strings.Contains(string(code), "__Buffer$") || !strings.Contains(string(code), "__process$") {
+		t.Fatalf("the polyfills should be imported:\n%s", code)
+	}
+}
+
+func TestTransformWithBanner(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-transform", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `import { a } from "./a.js"; export default a;`,
+		"a.js":     `export const a = 1;`,
+	})
+	useFixtures(t, f)
+	task := &buildTask{pkg: pkg{name: "fixture-transform", version: "1.0.0"}, target: "es2020", transform: true}
+	unbannered := task.ID()
+	config.banner = "/*! (c) fixture */"
+
+	task = &buildTask{pkg: pkg{name: "fixture-transform", version: "1.0.0"}, target: "es2020", transform: true}
+	if task.ID() == unbannered || !strings.Contains(task.ID(), "/banner="+bannerHash()+"/") {
+		t.Fatalf("the banner should change the build id: %s", task.ID())
+	}
+	if _, r, ok := parseBuildID(task.ID()); !ok || r.Target != "es2020" {
+		t.Fatalf("unexpected build record %v", r)
+	}
+	_, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(code), "/*! (c) fixture */\n/* esm.sh - esbuild transform(") || strings.Count(string(code), "(c) fixture") != 1 {
+		t.Fatalf("the banner should be written before the header:\n%s", code)
+	}
+}
+
+func TestBuildNativeAddonWithBrowserFallback(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-secp", Version: "1.0.0", Type: "module", Main: "index.js", Browser: map[string]interface{}{"./index.js": "./elliptic.js"}}, map[string]string{
+		"index.js":                 `export { default } from "./build/Release/addon.node"`,
+		"elliptic.js":              `export default "elliptic-fallback"`,
+		"binding.gyp":              `{"targets": [{"target_name": "addon", "sources": ["addon.cc"]}]}`,
+		"build/Release/addon.node": "\x7fELF",
+	})
+	useFixtures(t, f)
+
+	task := &buildTask{pkg: pkg{name: "fixture-secp", version: "1.0.0"}, target: "es2020"}
+	_, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(code), "elliptic-fallback") {
+		t.Fatalf("the js fallback of the browser field should be built:\n%s", code)
+	}
+
+	// the browser field is ignored by the no-browser query
+	task = &buildTask{pkg: pkg{name: "fixture-secp", version: "1.0.0"}, target: "es2020", noBrowser: true}
+	_, _, err = task.buildESM()
+	if !errors.Is(err, ErrUnsupportedPackage) || !strings.Contains(err.Error(), "native addon") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestBuildWithWasmAsset(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-wasm", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `import url from "./add.wasm"; export default url;`,
+		"add.wasm": "\x00asm\x01\x00\x00\x00",
+	})
+	useFixtures(t, f)
+	config.domain = "esm.sh"
+	config.cdnDomain = "cdn.esm.sh"
+
+	task := &buildTask{pkg: pkg{name: "fixture-wasm", version: "1.0.0"}, target: "es2020"}
+	esm, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(esm.Assets) != 1 || !storageFileExists(path.Join("builds", esm.Assets[0])) {
+		t.Fatalf("unexpected assets %v", esm.Assets)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the asset url is absolute for the pages of other origins
+	if !strings.Contains(string(code), `"https://cdn.esm.sh`+esm.Assets[0]+`"`) {
+		t.Fatalf("the asset should be imported by the absolute url:\n%s", code)
+	}
+}
+
+func TestBuildWithoutTimeout(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-notimeout", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const foo = 1;`,
+	})
+	useFixtures(t, f)
+	config.buildTimeout = 0
+
+	esm, _, err := (&buildTask{pkg: pkg{name: "fixture-notimeout", version: "1.0.0"}, target: "es2020"}).buildESM()
+	if err != nil {
+		t.Fatalf("the zero build timeout should mean no limit: %v", err)
+	}
+	if strings.Join(esm.Exports, ",") != "foo" {
+		t.Fatalf("unexpected exports %v", esm.Exports)
+	}
+}
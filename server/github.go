@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+	"github.com/postui/postdb"
+	"github.com/postui/postdb/q"
+)
+
+const (
+	githubAPI        = "https://api.github.com/repos/"
+	githubRawContent = "https://raw.githubusercontent.com/"
+)
+
+// parseGitHubPath parses the pathname like `/gh/owner/repo@ref/submodule`, the
+// ref is a commit sha, a tag or a branch, it's empty if not specified.
+func parseGitHubPath(pathname string) (repo string, ref string, submodule string, err error) {
+	a := strings.Split(strings.Trim(strings.TrimPrefix(pathname, "/gh/"), "/"), "/")
+	if len(a) < 2 || a[0] == "" || a[1] == "" {
+		err = errors.New("invalid github path")
+		return
+	}
+	name, ref := utils.SplitByFirstByte(a[1], '@')
+	repo = a[0] + "/" + name
+	submodule = strings.TrimSuffix(strings.Join(a[2:], "/"), ".js")
+	for _, c := range repo {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '/') {
+			err = errors.New("invalid github repo")
+			return
+		}
+	}
+	return
+}
+
+// parseGitHubPkg parses the package of the commit, the name and the version are
+// read from the `package.json` of the commit.
+func parseGitHubPkg(repo string, sha string, submodule string) (*pkg, error) {
+	if !regGitSHA.MatchString(sha) {
+		return nil, errors.New("invalid commit sha")
+	}
+	p, err := fetchGitHubPackageJSON(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	return &pkg{
+		name:      p.Name,
+		version:   p.Version,
+		submodule: submodule,
+		git:       repo + "@" + sha,
+	}, nil
+}
+
+// resolveGitHubRef resolves the tag or the branch of the repo to the commit sha,
+// the result is cached for the `resolve-cache-ttl` like the npm versions.
+func resolveGitHubRef(repo string, ref string) (sha string, err error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	key := fmt.Sprintf("gh:%s@%s", repo, ref)
+	post, err := db.Get(q.Alias(key), q.Select("sha"))
+	if err == nil && time.Unix(int64(post.Modtime), 0).Add(config.resolveCacheTTL).After(time.Now()) {
+		return string(post.KV["sha"]), nil
+	}
+	if err != nil && err != postdb.ErrNotFound {
+		return
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s/commits/%s", githubAPI, repo, ref), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3.sha")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		err = withKind(ErrInstallFailed, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 || resp.StatusCode == 422 {
+		err = withKind(ErrPackageNotFound, fmt.Errorf("github: ref '%s' of '%s' not found", ref, repo))
+		return
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		err = withKind(ErrInstallFailed, fmt.Errorf("github: can't resolve ref '%s' of '%s' (%s: %s)", ref, repo, resp.Status, string(data)))
+		return
+	}
+	sha = strings.TrimSpace(string(data))
+	if !regGitSHA.MatchString(sha) {
+		err = fmt.Errorf("github: unexpected sha '%s'", sha)
+		return
+	}
+
+	if _, err := db.Get(q.Alias(key)); err == nil {
+		db.Update(q.Alias(key), q.KV{"sha": []byte(sha)})
+	} else {
+		db.Put(q.Alias(key), q.KV{"sha": []byte(sha)})
+	}
+	return
+}
+
+// fetchGitHubPackageJSON gets the `package.json` of the commit, it's cached
+// permanently since the commit is immutable. The version is `0.0.0` if the
+// `package.json` doesn't have one.
+func fetchGitHubPackageJSON(repo string, sha string) (p NpmPackage, err error) {
+	key := fmt.Sprintf("gh:%s@%s/package.json", repo, sha)
+	post, err := db.Get(q.Alias(key), q.Select("package"))
+	if err == nil && json.Unmarshal(post.KV["package"], &p) == nil {
+		return
+	}
+	if err != nil && err != postdb.ErrNotFound {
+		return
+	}
+
+	resp, err := httpClient.Get(fmt.Sprintf("%s%s/%s/package.json", githubRawContent, repo, sha))
+	if err != nil {
+		err = withKind(ErrInstallFailed, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		err = withKind(ErrPackageNotFound, fmt.Errorf("github: package.json of '%s@%s' not found", repo, sha))
+		return
+	}
+	if resp.StatusCode != 200 {
+		err = withKind(ErrInstallFailed, fmt.Errorf("github: can't get package.json of '%s@%s' (%s)", repo, sha, resp.Status))
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	if err != nil {
+		return
+	}
+	if p.Name == "" {
+		err = fmt.Errorf("github: package.json of '%s@%s' has no name", repo, sha)
+		return
+	}
+	if p.Version == "" {
+		p.Version = "0.0.0"
+	}
+	db.Put(q.Alias(key), q.KV{"package": utils.MustEncodeJSON(p)})
+	return
+}
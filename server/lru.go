@@ -0,0 +1,84 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache caches the content of the hot files in memory, the least recently
+// used files are evicted when the total size exceeds the limit.
+type lruCache struct {
+	lock     sync.Mutex
+	maxBytes int64
+	size     int64
+	list     *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		list:     list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the cached content of the file, a nil cache caches nothing.
+func (c *lruCache) Get(name string) (data []byte, modTime time.Time, ok bool) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[name]
+	if !ok {
+		return
+	}
+	c.list.MoveToFront(el)
+	e := el.Value.(*lruEntry)
+	return e.data, e.modTime, true
+}
+
+// Set caches the content of the file, the file larger than the limit is not cached.
+func (c *lruCache) Set(name string, data []byte, modTime time.Time) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+	c.items[name] = c.list.PushFront(&lruEntry{name, data, modTime})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.remove(c.list.Back())
+	}
+}
+
+// Delete removes the file from the cache.
+func (c *lruCache) Delete(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	e := c.list.Remove(el).(*lruEntry)
+	delete(c.items, e.name)
+	c.size -= int64(len(e.data))
+}
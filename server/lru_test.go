@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(10)
+	c.Set("a", []byte("aaaa"), time.Now())
+	c.Set("b", []byte("bbbb"), time.Now())
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("'a' should be cached")
+	}
+	// evicts 'b' that is the least recently used
+	c.Set("c", []byte("cccc"), time.Now())
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatal("'b' should be evicted")
+	}
+	if data, _, ok := c.Get("c"); !ok || string(data) != "cccc" {
+		t.Fatal("'c' should be cached")
+	}
+
+	c.Set("d", []byte("too large file"), time.Now())
+	if _, _, ok := c.Get("d"); ok {
+		t.Fatal("the file larger than the limit should not be cached")
+	}
+	c.Delete("a")
+	if _, _, ok := c.Get("a"); ok || c.size != 4 {
+		t.Fatal("'a' should be deleted")
+	}
+}
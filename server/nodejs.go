@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,10 +11,13 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ije/gox/utils"
@@ -22,10 +26,16 @@ import (
 )
 
 const (
-	minNodejsVersion = 14
-	nodejsLatestLTS  = "14.15.2"
-	nodejsDistURL    = "https://nodejs.org/dist/"
-	refreshDuration  = 10 * 60 // 10 minues
+	minNodejsVersion  = 14
+	minYarnVersion    = 1
+	nodejsLatestLTS   = "14.15.2"
+	nodejsDistURL     = "https://nodejs.org/dist/"
+	npmPublicRegistry = "https://registry.npmjs.org/"
+	// the first backoff of the registry retries, it's doubled for every retry
+	registryRetryBackoff = 500 * time.Millisecond
+	// accepts the abbreviated metadata that only has the install info, it's much
+	// smaller than the full metadata of the packages with many versions
+	npmAbbreviatedMetadata = "application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8, */*"
 )
 
 var builtInNodeModules = map[string]bool{
@@ -119,6 +129,52 @@ type NpmPackageRecords struct {
 	Versions map[string]NpmPackage `json:"versions"`
 }
 
+// Resolve returns the package of the version, the version can be a full version,
+// a dist-tag(like `latest` or `next`) or a version prefix(like `17` or `17.0`).
+func (h *NpmPackageRecords) Resolve(version string) (info NpmPackage) {
+	if regFullVersion.MatchString(version) {
+		return h.Versions[version]
+	}
+
+	distVersion, ok := h.DistTags[version]
+	if ok {
+		return h.Versions[distVersion]
+	}
+
+	var majorVerions versionSlice
+	for key := range h.Versions {
+		if regFullVersion.MatchString(key) && strings.HasPrefix(key, version+".") {
+			majorVerions = append(majorVerions, key)
+		}
+	}
+	if l := len(majorVerions); l > 0 {
+		if l > 1 {
+			sort.Sort(majorVerions)
+		}
+		info = h.Versions[majorVerions[0]]
+		return
+	}
+
+	// resolve the max version satisfying the range like `>=16.8.0`, the `latest`
+	// tag is preferred if it satisfies the range, that is how npm does
+	sets, ok := parseSemverRange(version)
+	if !ok {
+		return
+	}
+	if latest, ok := parseSemver(h.DistTags["latest"]); ok && satisfies(latest, sets) {
+		return h.Versions[h.DistTags["latest"]]
+	}
+	var max semver
+	for key := range h.Versions {
+		v, ok := parseSemver(key)
+		if ok && satisfies(v, sets) && (info.Version == "" || compareSemver(v, max) > 0) {
+			info = h.Versions[key]
+			max = v
+		}
+	}
+	return
+}
+
 // NpmPackage defines the package of npm
 type NpmPackage struct {
 	Name             string            `json:"name"`
@@ -130,8 +186,188 @@ type NpmPackage struct {
 	Typings          string            `json:"typings,omitempty"`
 	Dependencies     map[string]string `json:"dependencies,omitempty"`
 	PeerDependencies map[string]string `json:"peerDependencies,omitempty"`
+	// the metadata fields are kept as they are since some packages have the
+	// legacy forms, like `"repository": { "type": "git", "url": "..." }`
+	Homepage   interface{} `json:"homepage,omitempty"`
+	License    interface{} `json:"license,omitempty"`
+	Repository interface{} `json:"repository,omitempty"`
+	// https://github.com/defunctzombie/package-browser-field-spec
+	Browser interface{} `json:"browser,omitempty"`
+	// https://webpack.js.org/guides/tree-shaking/#mark-the-file-as-side-effect-free
+	SideEffects interface{} `json:"sideEffects,omitempty"`
 	// https://nodejs.org/api/esm.html#esm_resolver_algorithm_specification
 	DefinedExports interface{} `json:"exports,omitempty"`
+	// https://docs.npmjs.com/cli/v7/configuring-npm/package-json#engines
+	Engines interface{} `json:"engines,omitempty"`
+	// the deprecation message of the version set by `npm deprecate`, it's only
+	// in the registry metadata
+	Deprecated interface{} `json:"deprecated,omitempty"`
+	// set by npm if the package has a `binding.gyp` file to build the native addon
+	Gypfile bool `json:"gypfile,omitempty"`
+}
+
+// DeprecatedMessage returns the deprecation message of the package, or empty
+// string if the version is not deprecated.
+func (p *NpmPackage) DeprecatedMessage() string {
+	switch v := p.Deprecated.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case bool:
+		if v {
+			return "deprecated"
+		}
+	}
+	return ""
+}
+
+// NodeEngine returns the `engines.node` range of the package.
+func (p *NpmPackage) NodeEngine() string {
+	m, _ := p.Engines.(map[string]interface{})
+	s, _ := m["node"].(string)
+	return s
+}
+
+// HasSideEffects returns false if the package declares `"sideEffects": false`.
+func (p *NpmPackage) HasSideEffects() bool {
+	return p.SideEffects != false
+}
+
+// BrowserMain returns the entry of the `browser` field in string form.
+func (p *NpmPackage) BrowserMain() string {
+	s, _ := p.Browser.(string)
+	return s
+}
+
+// browserRemapsMain checks if the `browser` field replaces the main entry.
+func (p *NpmPackage) browserRemapsMain() bool {
+	if p.BrowserMain() != "" {
+		return true
+	}
+	main := p.Main
+	if main == "" {
+		main = "index.js"
+	}
+	main = strings.TrimSuffix(path.Clean(main), ".js")
+	for key, v := range p.BrowserMap() {
+		if to, ok := v.(string); ok && to != "" && strings.TrimSuffix(path.Clean(key), ".js") == main {
+			return true
+		}
+	}
+	return false
+}
+
+// BrowserMap returns the module mapping of the `browser` field in object form,
+// a value of the map is either a string(replacement) or `false`(ignored).
+func (p *NpmPackage) BrowserMap() map[string]interface{} {
+	m, _ := p.Browser.(map[string]interface{})
+	return m
+}
+
+// ResolveExport returns the target files of the subpath that is defined in the
+// `exports` field, the module is the esm one by the `import` condition. The
+// empty subpath or `.` resolves the main entry of the package. The custom
+// conditions are matched before the built-in ones.
+func (p *NpmPackage) ResolveExport(subpath string, conditions ...string) (module string, main string) {
+	v := p.exportEntry(subpath)
+	if v == nil {
+		return
+	}
+	if s, ok := v.(string); ok {
+		if p.Type == "module" || strings.HasSuffix(s, ".mjs") {
+			return s, s
+		}
+		return "", s
+	}
+	moduleConditions := append(append([]string{}, conditions...), "import", "module")
+	if c, ok := v.(map[string]interface{}); ok {
+		for _, name := range moduleConditions {
+			if module = getExportTarget(c[name], moduleConditions...); module != "" {
+				break
+			}
+		}
+	}
+	main = getExportTarget(v, append(append([]string{}, conditions...), "require", "default")...)
+	if main == "" {
+		main = module
+	}
+	return
+}
+
+// ResolveExportTypes returns the declaration file of the subpath that is defined
+// by the `types` condition in the `exports` field, like
+// `{ "./feature": { "types": "./feature.d.ts", "default": "./feature.js" } }`.
+func (p *NpmPackage) ResolveExportTypes(subpath string) string {
+	return getExportTypes(p.exportEntry(subpath))
+}
+
+// exportEntry returns the entry of the subpath in the `exports` field.
+func (p *NpmPackage) exportEntry(subpath string) interface{} {
+	key := "./" + strings.TrimPrefix(subpath, "./")
+	if subpath == "" || subpath == "." {
+		key = "."
+	}
+	switch t := p.DefinedExports.(type) {
+	case string:
+		// the sugar of `{ ".": "..." }`
+		if key == "." {
+			return t
+		}
+	case map[string]interface{}:
+		if isExportConditions(t) {
+			if key == "." {
+				return t
+			}
+		} else {
+			return t[key]
+		}
+	}
+	return nil
+}
+
+func getExportTypes(v interface{}) string {
+	c, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, name := range []string{"types", "typings"} {
+		if s, ok := c[name].(string); ok {
+			return s
+		}
+	}
+	for _, name := range []string{"import", "module", "require", "default"} {
+		if s := getExportTypes(c[name]); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// isExportConditions checks if the `exports` object is a conditions map of the
+// main entry, like `{ "import": "./index.mjs", "require": "./index.js" }`.
+func isExportConditions(m map[string]interface{}) bool {
+	for key := range m {
+		if strings.HasPrefix(key, ".") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func getExportTarget(v interface{}, conditions ...string) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		for _, c := range conditions {
+			if s := getExportTarget(t[c], conditions...); s != "" {
+				return s
+			}
+		}
+		if c, ok := t["default"]; ok {
+			return getExportTarget(c, conditions...)
+		}
+	}
+	return ""
 }
 
 // NodeEnv defines the nodejs env
@@ -172,16 +408,21 @@ CheckNodejs:
 
 	env = &NodeEnv{
 		version:     version,
-		npmRegistry: "https://registry.npmjs.org/",
+		npmRegistry: npmPublicRegistry,
 	}
 
-	output, err := exec.Command("npm", "config", "get", "registry").CombinedOutput()
-	if err == nil {
-		env.npmRegistry = strings.TrimRight(strings.TrimSpace(string(output)), "/") + "/"
+	var output []byte
+	if config.npmRegistry != "" {
+		env.npmRegistry = strings.TrimRight(config.npmRegistry, "/") + "/"
+	} else {
+		output, err = exec.Command("npm", "config", "get", "registry").CombinedOutput()
+		if err == nil {
+			env.npmRegistry = strings.TrimRight(strings.TrimSpace(string(output)), "/") + "/"
+		}
 	}
 
 CheckYarn:
-	output, err = exec.Command("yarn", "-v").CombinedOutput()
+	_, _, err = getYarnVersion()
 	if err != nil {
 		if errors.Is(err, exec.ErrNotFound) {
 			output, err = exec.Command("npm", "install", "yarn", "-g").CombinedOutput()
@@ -191,27 +432,66 @@ CheckYarn:
 			}
 			goto CheckYarn
 		}
-		err = errors.New("bad yarn version")
+		err = fmt.Errorf("check yarn: %v", err)
+		return
 	}
+
+	err = checkToolchain()
 	return
 }
 
-func (env *NodeEnv) getPackageInfo(name string, version string) (info NpmPackage, submodule string, err error) {
-	slice := strings.Split(name, "/")
-	if l := len(slice); strings.HasPrefix(name, "@") && l > 1 {
-		name = strings.Join(slice[:2], "/")
-		if l > 2 {
-			submodule = strings.Join(slice[2:], "/")
-		}
-	} else {
-		name = slice[0]
-		if l > 1 {
-			submodule = strings.Join(slice[1:], "/")
-		}
+// checkToolchain verifies that the `node` and `yarn` commands run and meet the
+// minimum versions, it doesn't install anything.
+func checkToolchain() (err error) {
+	version, major, err := getNodejsVersion()
+	if err != nil {
+		return fmt.Errorf("node --version: %v", err)
+	}
+	if major < minNodejsVersion {
+		return fmt.Errorf("bad nodejs version %s need %d+", version, minNodejsVersion)
+	}
+	version, major, err = getYarnVersion()
+	if err != nil {
+		return fmt.Errorf("yarn --version: %v", err)
+	}
+	if major < minYarnVersion {
+		return fmt.Errorf("bad yarn version %s need %d+", version, minYarnVersion)
 	}
-	if strings.HasPrefix(version, "^") {
+	return
+}
+
+// toolchainCheckTTL is the interval of the toolchain checks of the readiness probe
+const toolchainCheckTTL = 30 * time.Second
+
+var toolchainCheck struct {
+	lock      sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// checkToolchainCached returns the result of the last `checkToolchain` if it
+// was made within the `toolchainCheckTTL`, that keeps the readiness probes from
+// spawning the node and yarn processes on every request.
+func checkToolchainCached() error {
+	toolchainCheck.lock.Lock()
+	defer toolchainCheck.lock.Unlock()
+	if time.Since(toolchainCheck.checkedAt) > toolchainCheckTTL {
+		toolchainCheck.err = checkToolchain()
+		toolchainCheck.checkedAt = time.Now()
+	}
+	return toolchainCheck.err
+}
+
+// PackageInfo gets the metadata of the package from the npm registry, the
+// result is cached in the db.
+func (env *NodeEnv) PackageInfo(name string, version string) (info NpmPackage, submodule string, err error) {
+	name, submodule = splitPkgPath(name)
+	// the simple caret/tilde ranges are resolved by the version prefix, the caret range
+	// of `0.x` and the compound ranges like `^16.8.0 || ^17.0.0` are resolved as ranges
+	isCompound := strings.ContainsAny(version, " |")
+	if strings.HasPrefix(version, "^") && !strings.HasPrefix(version, "^0.") && !isCompound {
 		version, _ = utils.SplitByFirstByte(version[1:], '.')
-	} else if strings.HasPrefix(version, "~") {
+	} else if strings.HasPrefix(version, "~") && !isCompound {
 		major, rest := utils.SplitByFirstByte(version[1:], '.')
 		minor, _ := utils.SplitByFirstByte(rest, '.')
 		version = major + "." + minor
@@ -220,10 +500,20 @@ func (env *NodeEnv) getPackageInfo(name string, version string) (info NpmPackage
 	key := fmt.Sprintf("npm:%s@%s", name, version)
 	p, err := db.Get(q.Alias(key), q.Select("package"))
 	if err == nil {
-		if isFullVersion || int64(p.Modtime)+refreshDuration > time.Now().Unix() {
-			if json.Unmarshal(p.KV["package"], &info) == nil {
+		var cached NpmPackage
+		if json.Unmarshal(p.KV["package"], &cached) == nil {
+			if isFullVersion || time.Unix(int64(p.Modtime), 0).Add(config.resolveCacheTTL).After(time.Now()) {
+				info = cached
 				return
 			}
+			// revalidate the expired resolution, the stale one is used if the registry fails
+			defer func() {
+				if err != nil && !errors.Is(err, ErrPackageNotFound) {
+					log.Warnf("npm: revalidate %s@%s: %v, use the cached version %s", name, version, err, cached.Version)
+					info = cached
+					err = nil
+				}
+			}()
 		}
 	}
 	if err != nil && err != postdb.ErrNotFound {
@@ -231,76 +521,142 @@ func (env *NodeEnv) getPackageInfo(name string, version string) (info NpmPackage
 	}
 
 	start := time.Now()
-	resp, err := httpClient.Get(env.npmRegistry + name)
+	data, contentType, err := env.fetchRegistryDoc(name, name, npmAbbreviatedMetadata)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 || resp.StatusCode == 401 {
-		err = fmt.Errorf("npm: package '%s' not found", name)
+	var h NpmPackageRecords
+	err = json.Unmarshal(data, &h)
+	if err != nil {
 		return
 	}
-	if resp.StatusCode != 200 {
-		ret, _ := ioutil.ReadAll(resp.Body)
-		err = fmt.Errorf("npm: can't get metadata of package '%s' (%s: %s)", name, resp.Status, string(ret))
+
+	info = h.Resolve(version)
+	if info.Version == "" {
+		err = withKind(ErrPackageNotFound, fmt.Errorf("npm: version '%s' not found", version))
 		return
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err == io.EOF {
-		err = nil
+	// the abbreviated metadata has no entry fields like `module` and `exports`,
+	// get the full manifest of the resolved version, the registry that doesn't
+	// support the abbreviated format returns the full metadata
+	if strings.HasPrefix(contentType, "application/vnd.npm.install-v1+json") {
+		data, _, err = env.fetchRegistryDoc(name, name+"/"+info.Version, "application/json")
+		if err != nil {
+			return
+		}
+		info = NpmPackage{}
+		err = json.Unmarshal(data, &info)
+		if err != nil {
+			return
+		}
+	}
+
+	// update cache
+	if _, err := db.Get(q.Alias(key)); err == nil {
+		db.Update(q.Alias(key), q.KV{"package": utils.MustEncodeJSON(info)})
+	} else {
+		db.Put(q.Alias(key), q.KV{"package": utils.MustEncodeJSON(info)})
 	}
+
+	log.Debugf("get npm package(%s@%s) info in %v", name, info.Version, time.Now().Sub(start))
+	return
+}
+
+// fetchRegistryDoc gets the document of the path from the npm registry, it
+// falls back to the public registry if configured. The name is the package
+// name for the error messages.
+func (env *NodeEnv) fetchRegistryDoc(name string, docPath string, accept string) (data []byte, contentType string, err error) {
+	err = registryBreaker.Allow()
 	if err != nil {
 		return
 	}
 
-	var h NpmPackageRecords
-	err = json.Unmarshal(data, &h)
+	resp, err := fetchRegistry(env.npmRegistry+docPath, accept)
+	if config.npmFallback && env.npmRegistry != npmPublicRegistry && (err != nil || resp.StatusCode >= 500) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		log.Warnf("npm registry %s failed, fall back to the public registry", env.npmRegistry)
+		resp, err = fetchRegistry(npmPublicRegistry+docPath, accept)
+	}
 	if err != nil {
+		registryBreaker.Done(err)
+		err = withKind(ErrInstallFailed, err)
 		return
 	}
+	defer resp.Body.Close()
 
-	if isFullVersion {
-		info = h.Versions[version]
+	if resp.StatusCode >= 500 {
+		registryBreaker.Done(errors.New(resp.Status))
 	} else {
-		distVersion, ok := h.DistTags[version]
-		if ok {
-			info = h.Versions[distVersion]
-		} else {
-			var majorVerions versionSlice
-			for key := range h.Versions {
-				if regFullVersion.MatchString(key) && strings.HasPrefix(key, version+".") {
-					majorVerions = append(majorVerions, key)
-				}
-			}
-			if l := len(majorVerions); l > 0 {
-				if l > 1 {
-					sort.Sort(majorVerions)
-				}
-				info = h.Versions[majorVerions[0]]
-			}
-		}
+		registryBreaker.Done(nil)
 	}
 
-	if info.Version == "" {
-		err = fmt.Errorf("npm: version '%s' not found", version)
+	if resp.StatusCode == 404 || resp.StatusCode == 401 {
+		err = withKind(ErrPackageNotFound, fmt.Errorf("npm: package '%s' not found", name))
+		return
+	}
+	if resp.StatusCode != 200 {
+		ret, _ := ioutil.ReadAll(resp.Body)
+		err = withKind(ErrInstallFailed, fmt.Errorf("npm: can't get metadata of package '%s' (%s: %s)", name, resp.Status, string(ret)))
 		return
 	}
 
-	// update cache
-	if _, err := db.Get(q.Alias(key)); err == nil {
-		db.Update(q.Alias(key), q.KV{"package": utils.MustEncodeJSON(info)})
-	} else {
-		db.Put(q.Alias(key), q.KV{"package": utils.MustEncodeJSON(info)})
+	data, err = ioutil.ReadAll(resp.Body)
+	if err == io.EOF {
+		err = nil
 	}
+	contentType = resp.Header.Get("Content-Type")
+	return
+}
 
-	log.Debugf("get npm package(%s@%s) info in %v", name, info.Version, time.Now().Sub(start))
+// fetchRegistry gets the metadata from the npm registry with the `User-Agent`
+// of the config, the request is bounded by the registry timeout, and retried
+// with backoff on the network errors and the 5xx responses. The response is
+// requested with gzip and decompressed by the transport transparently.
+func fetchRegistry(url string, accept string) (resp *http.Response, err error) {
+	client := &http.Client{
+		Transport: httpClient.Transport,
+		Timeout:   config.registryTimeout,
+	}
+	for i := 0; i <= config.registryRetries; i++ {
+		if i > 0 {
+			if err == nil {
+				resp.Body.Close()
+			}
+			time.Sleep(registryRetryBackoff << (i - 1))
+		}
+		var req *http.Request
+		req, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			return
+		}
+		if config.registryUserAgent != "" {
+			req.Header.Set("User-Agent", config.registryUserAgent)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err = client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return
+		}
+	}
 	return
 }
 
 func getNodejsVersion() (version string, major int, err error) {
-	output, err := exec.Command("node", "--version").CombinedOutput()
+	return getCommandVersion("node")
+}
+
+func getYarnVersion() (version string, major int, err error) {
+	return getCommandVersion("yarn")
+}
+
+func getCommandVersion(name string) (version string, major int, err error) {
+	output, err := exec.Command(name, "--version").CombinedOutput()
 	if err != nil {
 		return
 	}
@@ -350,15 +706,224 @@ func installNodejs(dir string, version string) (err error) {
 	return
 }
 
+// parseYarnLock returns the integrity of packages in the yarn.lock file, keyed by 'name@version'.
+func parseYarnLock(filename string) (integrity map[string]string, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	integrity = map[string]string{}
+	name := ""
+	version := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			// "@babel/core@^7.0.0", "@babel/core@^7.1.0":
+			spec, _ := utils.SplitByFirstByte(strings.TrimSuffix(line, ":"), ',')
+			spec = strings.Trim(strings.TrimSpace(spec), `"`)
+			name, _ = utils.SplitByLastByte(spec[1:], '@')
+			name = spec[:1] + name
+			version = ""
+			continue
+		}
+		key, value := utils.SplitByFirstByte(strings.TrimSpace(line), ' ')
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "version":
+			version = value
+		case "integrity":
+			if name != "" && version != "" {
+				integrity[name+"@"+version] = value
+			}
+		}
+	}
+	return
+}
+
+// verifyIntegrity checks the installed packages with the configured integrity,
+// and returns the integrity of all installed packages.
+func verifyIntegrity(wd string) (integrity map[string]string, err error) {
+	integrity, err = parseYarnLock(path.Join(wd, "yarn.lock"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for key, value := range integrity {
+		expected, ok := config.integrity[key]
+		if ok && expected != value {
+			err = withKind(ErrInstallFailed, fmt.Errorf("integrity mismatch of %s: expected %s, got %s", key, expected, value))
+			return
+		}
+	}
+	return
+}
+
+// acquireProcess waits for a slot to run a yarn/node process, the release
+// function must be called when the process exits.
+func acquireProcess(ctx context.Context) (release func(), err error) {
+	if processSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case processSlots <- struct{}{}:
+		return func() { <-processSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// regYarnRegistryFailure matches the yarn output of the network errors and the
+// 5xx responses of the registry, other failures are of the packages.
+var regYarnRegistryFailure = regexp.MustCompile(`trouble with your network connection|E(NOTFOUND|CONNREFUSED|CONNRESET|TIMEDOUT|AI_AGAIN|SOCKETTIMEDOUT)\b|socket hang up|Request failed \\?"5\d\d`)
+
+// installScriptNames are the npm lifecycle scripts of the install in order.
+var installScriptNames = []string{"preinstall", "install", "postinstall"}
+
+// runInstallScripts runs the install scripts of the allowed packages that are
+// installed in the dir, the packages are installed with `--ignore-scripts` since
+// running the scripts of any package is a security risk. The scripts run with a
+// minimal environment that has no secrets of the server, and they are killed
+// when the context is done. Returns the packages whose scripts ran.
+func runInstallScripts(ctx context.Context, wd string) (ran []string, err error) {
+	for _, name := range config.installScripts {
+		pkgDir := path.Join(wd, "node_modules", name)
+		var p struct {
+			Name    string            `json:"name"`
+			Version string            `json:"version"`
+			Scripts map[string]string `json:"scripts"`
+		}
+		if utils.ParseJSONFile(path.Join(pkgDir, "package.json"), &p) != nil {
+			continue
+		}
+		hasScripts := false
+		for _, script := range installScriptNames {
+			if p.Scripts[script] == "" {
+				continue
+			}
+			hasScripts = true
+			var release func()
+			release, err = acquireProcess(ctx)
+			if err != nil {
+				return
+			}
+			cmd := exec.CommandContext(ctx, "yarn", "run", "--silent", script)
+			cmd.Dir = pkgDir
+			cmd.Env = []string{
+				"PATH=" + os.Getenv("PATH"),
+				"HOME=" + wd,
+				"npm_config_cache=" + path.Join(wd, ".npm"),
+			}
+			var output []byte
+			output, err = cmd.CombinedOutput()
+			release()
+			getBuildLog(ctx).Printf("install script(%s@%s) %s: %v\n%s", p.Name, p.Version, script, err, output)
+			if err != nil {
+				err = withKind(ErrInstallFailed, fmt.Errorf("%s script of '%s@%s' failed: %s", script, p.Name, p.Version, string(output)))
+				return
+			}
+		}
+		if hasScripts {
+			ran = append(ran, p.Name+"@"+p.Version)
+		}
+	}
+	return
+}
+
+// checkNativeAddon returns an `ErrUnsupportedPackage` error if the installed
+// package has a native addon, that is a `binding.gyp` file, the `gypfile` field
+// or any `.node` file, since the native addons can't run in the browser. The
+// packages whose `browser` field remaps the main entry to a js fallback, like
+// `secp256k1`, are not checked, esbuild still reports the `.node` files if they
+// are imported.
+func checkNativeAddon(pkgDir string, p NpmPackage) error {
+	if p.browserRemapsMain() {
+		return nil
+	}
+	reason := ""
+	if p.Gypfile {
+		reason = "the `gypfile` field of package.json"
+	} else if fileExists(path.Join(pkgDir, "binding.gyp")) {
+		reason = "binding.gyp"
+	} else {
+		filepath.Walk(pkgDir, func(filename string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if fi.IsDir() && fi.Name() == "node_modules" {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".node") {
+				reason = strings.TrimPrefix(filename, pkgDir+"/")
+				return io.EOF
+			}
+			return nil
+		})
+	}
+	if reason != "" {
+		return withKind(ErrUnsupportedPackage, fmt.Errorf(
+			"package '%s@%s' has a native addon (%s) that can't be bundled for the browser",
+			p.Name,
+			p.Version,
+			reason,
+		))
+	}
+	return nil
+}
+
 func yarnAdd(wd string, packages ...string) (err error) {
+	return yarnAddContext(context.Background(), wd, packages...)
+}
+
+// yarnAddContext installs the packages, the yarn process will be killed when the context is done.
+func yarnAddContext(ctx context.Context, wd string, packages ...string) (err error) {
 	if len(packages) > 0 {
+		err = registryBreaker.Allow()
+		if err != nil {
+			return
+		}
+		var output []byte
+		defer func() {
+			// only the registry failures count, not the failures of the packages
+			// or the cancellations
+			if err != nil && ctx.Err() == nil && regYarnRegistryFailure.Match(output) {
+				registryBreaker.Done(err)
+			} else {
+				registryBreaker.Done(nil)
+			}
+		}()
+
 		start := time.Now()
-		args := append([]string{"add", "--silent", "--no-progress", "--ignore-scripts"}, packages...)
-		cmd := exec.Command("yarn", args...)
-		cmd.Dir = wd
-		output, err := cmd.CombinedOutput()
+		args := []string{"add", "--silent", "--no-progress", "--ignore-scripts"}
+		registries := []string{config.npmRegistry}
+		if config.npmRegistry != "" && config.npmFallback {
+			registries = append(registries, npmPublicRegistry)
+		}
+		for _, registry := range registries {
+			a := args
+			if registry != "" {
+				a = append(a, "--registry", registry)
+			}
+			var release func()
+			release, err = acquireProcess(ctx)
+			if err != nil {
+				return
+			}
+			cmd := exec.CommandContext(ctx, "yarn", append(a, packages...)...)
+			cmd.Dir = wd
+			output, err = cmd.CombinedOutput()
+			release()
+			getBuildLog(ctx).Printf("yarn %s: %v\n%s", strings.Join(cmd.Args[1:], " "), err, output)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+		}
 		if err != nil {
-			return fmt.Errorf("yarn add %s: %s", strings.Join(packages, " "), string(output))
+			return withKind(ErrInstallFailed, fmt.Errorf("yarn add %s: %s", strings.Join(packages, " "), string(output)))
 		}
 		log.Debug("yarn add", strings.Join(packages, " "), "in", time.Now().Sub(start))
 	}
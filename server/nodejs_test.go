@@ -0,0 +1,352 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/postui/postdb"
+)
+
+func TestParseYarnLock(t *testing.T) {
+	lockRaw := []string{
+		`# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.`,
+		`# yarn lockfile v1`,
+		``,
+		``,
+		`"@babel/runtime@^7.0.0", "@babel/runtime@^7.1.2":`,
+		`  version "7.14.6"`,
+		`  resolved "https://registry.yarnpkg.com/@babel/runtime/-/runtime-7.14.6.tgz#535203bc0892efc7dec60bdc27b2ecf6e409062d"`,
+		`  integrity sha512-/PCB2uJ7oM44tz8YhC4Z/6PeOKXp4K588f+5M3clr1M4zbqztlo0XEfJ2LEzj/FgwfgGcIdl8n7YYjTCI0BYwg==`,
+		`  dependencies:`,
+		`    regenerator-runtime "^0.13.4"`,
+		``,
+		`react@17.0.2:`,
+		`  version "17.0.2"`,
+		`  resolved "https://registry.yarnpkg.com/react/-/react-17.0.2.tgz#d0b5cc516d29eb3eee383f75b62864cfb6800037"`,
+		`  integrity sha512-gnhPt75i/dq/z3/6q/0asP78D0u592D5L1pd7M8P+dck6Fu/jJeL6iVVK23fptSUZj8Vjf++7wXA8UNclGQcbA==`,
+	}
+
+	testDir := path.Join(os.TempDir(), "testyarnlock")
+	os.RemoveAll(testDir)
+	ensureDir(testDir)
+	err := ioutil.WriteFile(path.Join(testDir, "yarn.lock"), []byte(strings.Join(lockRaw, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	integrity, err := parseYarnLock(path.Join(testDir, "yarn.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(integrity) != 2 {
+		t.Fatalf("unexpected integrity: %v", integrity)
+	}
+	if integrity["@babel/runtime@7.14.6"] != "sha512-/PCB2uJ7oM44tz8YhC4Z/6PeOKXp4K588f+5M3clr1M4zbqztlo0XEfJ2LEzj/FgwfgGcIdl8n7YYjTCI0BYwg==" {
+		t.Fatalf("unexpected integrity of @babel/runtime: %s", integrity["@babel/runtime@7.14.6"])
+	}
+	if integrity["react@17.0.2"] != "sha512-gnhPt75i/dq/z3/6q/0asP78D0u592D5L1pd7M8P+dck6Fu/jJeL6iVVK23fptSUZj8Vjf++7wXA8UNclGQcbA==" {
+		t.Fatalf("unexpected integrity of react: %s", integrity["react@17.0.2"])
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	h := NpmPackageRecords{
+		DistTags: map[string]string{
+			"latest": "17.0.2",
+			"next":   "18.0.0-alpha-1",
+		},
+		Versions: map[string]NpmPackage{},
+	}
+	for _, version := range []string{"16.14.0", "17.0.1", "17.0.2", "18.0.0-alpha-1"} {
+		h.Versions[version] = NpmPackage{Name: "react", Version: version}
+	}
+
+	for version, expected := range map[string]string{
+		"latest": "17.0.2",
+		"next":   "18.0.0-alpha-1",
+		"16":     "16.14.0",
+		"17.0":   "17.0.2",
+		"17.0.1": "17.0.1",
+		"canary": "",
+		"15.0.0": "",
+		// the ranges, the latest is preferred if it satisfies
+		">=16.8.0":           "17.0.2",
+		"^16.8.0 || ^17.0.0": "17.0.2",
+		"<17":                "16.14.0",
+		">=18.0.0-alpha-0":   "18.0.0-alpha-1",
+	} {
+		if v := h.Resolve(version).Version; v != expected {
+			t.Fatalf("resolve react@%s: expected '%s', got '%s'", version, expected, v)
+		}
+	}
+}
+
+func TestDeprecatedMessage(t *testing.T) {
+	for raw, expected := range map[string]string{
+		`{"name":"request","version":"2.88.2","deprecated":"request has been deprecated "}`: "request has been deprecated",
+		`{"name":"legacy","version":"1.0.0","deprecated":true}`:                             "deprecated",
+		`{"name":"legacy","version":"1.0.0","deprecated":false}`:                            "",
+		`{"name":"react","version":"17.0.2"}`:                                               "",
+	} {
+		var p NpmPackage
+		err := json.Unmarshal([]byte(raw), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message := p.DeprecatedMessage(); message != expected {
+			t.Fatalf("unexpected deprecated message of %s: '%s'", raw, message)
+		}
+	}
+}
+
+func TestResolveExport(t *testing.T) {
+	var p NpmPackage
+	err := json.Unmarshal([]byte(`{
+		"name": "fixture",
+		"exports": {
+			".": "./index.js",
+			"./feature": {
+				"import": { "types": "./feature.d.ts", "default": "./esm/feature.mjs" },
+				"require": "./cjs/feature.js"
+			},
+			"./util": { "default": "./util.js" },
+			"./esm": "./esm/index.mjs"
+		}
+	}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for subpath, expected := range map[string][2]string{
+		"feature": {"./esm/feature.mjs", "./cjs/feature.js"},
+		"util":    {"", "./util.js"},
+		"esm":     {"./esm/index.mjs", "./esm/index.mjs"},
+		"foo":     {"", ""},
+		".":       {"", "./index.js"},
+	} {
+		module, main := p.ResolveExport(subpath)
+		if module != expected[0] || main != expected[1] {
+			t.Fatalf("unexpected export of '%s': %s, %s", subpath, module, main)
+		}
+	}
+
+	for subpath, expected := range map[string]string{
+		"feature": "./feature.d.ts",
+		"util":    "",
+		".":       "",
+	} {
+		if types := p.ResolveExportTypes(subpath); types != expected {
+			t.Fatalf("unexpected types of '%s': %s", subpath, types)
+		}
+	}
+
+	// the custom conditions are matched first
+	module, main := p.ResolveExport("feature", "require")
+	if module != "./cjs/feature.js" || main != "./cjs/feature.js" {
+		t.Fatalf("unexpected export of 'feature' with conditions: %s, %s", module, main)
+	}
+
+	// the preference order of the main entry is `exports` > `module` > `main`
+	for packageJSON, expected := range map[string]string{
+		`{"exports":{"import":"./exports.mjs","require":"./exports.js"},"module":"module.js","main":"main.js"}`: "./exports.mjs",
+		`{"exports":{".":{"import":"./exports.mjs"}},"module":"module.js"}`:                                     "./exports.mjs",
+		`{"exports":"./exports.js","module":"module.js","main":"main.js"}`:                                      "",
+		`{"module":"module.js","main":"main.js"}`:                                                               "",
+	} {
+		var p NpmPackage
+		if err := json.Unmarshal([]byte(packageJSON), &p); err != nil {
+			t.Fatal(err)
+		}
+		if module, _ := p.ResolveExport("."); module != expected {
+			t.Fatalf("unexpected module of %s: %s", packageJSON, module)
+		}
+	}
+}
+
+func TestFetchRegistry(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("User-Agent") != "esm.sh/test" {
+			t.Errorf("unexpected user agent: %s", r.Header.Get("User-Agent"))
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if requests == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte(`{"name":"react"}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{registryTimeout: 100 * time.Millisecond, registryUserAgent: "esm.sh/test", registryRetries: 1}
+	resp, err := fetchRegistry(server.URL+"/react", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || requests != 2 {
+		t.Fatalf("the 5xx response should be retried, got %d after %d requests", resp.StatusCode, requests)
+	}
+
+	config.registryRetries = 0
+	_, err = fetchRegistry(server.URL+"/slow", "")
+	if err == nil {
+		t.Fatal("the slow request should time out")
+	}
+}
+
+func TestPackageInfoAbbreviatedMetadata(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("unexpected accept encoding: %s", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		switch r.URL.Path {
+		case "/react":
+			if !strings.HasPrefix(r.Header.Get("Accept"), "application/vnd.npm.install-v1+json") {
+				t.Errorf("unexpected accept: %s", r.Header.Get("Accept"))
+			}
+			w.Header().Set("Content-Type", "application/vnd.npm.install-v1+json")
+			gw.Write([]byte(`{"name":"react","dist-tags":{"latest":"17.0.2"},"versions":{"17.0.1":{"name":"react","version":"17.0.1"},"17.0.2":{"name":"react","version":"17.0.2"}}}`))
+		case "/react/17.0.2":
+			w.Header().Set("Content-Type", "application/json")
+			gw.Write([]byte(`{"name":"react","version":"17.0.2","main":"index.js","license":"MIT"}`))
+		case "/legacy":
+			w.Header().Set("Content-Type", "application/json")
+			gw.Write([]byte(`{"name":"legacy","dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"legacy","version":"1.0.0","module":"index.mjs"}}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "esm-test-db-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err = postdb.Open(path.Join(dir, "esm.db"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		db = nil
+	}()
+	config = &Config{}
+	env := &NodeEnv{npmRegistry: server.URL + "/"}
+
+	info, _, err := env.PackageInfo("react", "17")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "17.0.2" || info.Main != "index.js" {
+		t.Fatalf("the manifest of the resolved version should be used, got %+v", info)
+	}
+	if strings.Join(requests, ",") != "/react,/react/17.0.2" {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+
+	// the registry doesn't support the abbreviated metadata
+	info, _, err = env.PackageInfo("legacy", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Module != "index.mjs" || len(requests) != 3 {
+		t.Fatalf("the full metadata should be used, got %+v after %v", info, requests)
+	}
+}
+
+func TestYarnAddBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-test-yarn-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a fake yarn that prints the output of the YARN_OUTPUT env and fails
+	err = ioutil.WriteFile(path.Join(dir, "yarn"), []byte("#!/bin/sh\necho \"$YARN_OUTPUT\"\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+envPath)
+	defer func() {
+		os.Setenv("PATH", envPath)
+		os.Unsetenv("YARN_OUTPUT")
+	}()
+	cfg := config
+	config = &Config{}
+	defer func() {
+		config = cfg
+		registryBreaker = nil
+	}()
+
+	for _, c := range []struct {
+		output   string
+		failures int
+	}{
+		{`error An unexpected error occurred: "https://registry.yarnpkg.com/not-found: Not found".`, 0},
+		{`error Couldn't find any versions for "react" that matches "99.0.0"`, 0},
+		{`info There appears to be trouble with your network connection. Retrying...`, 1},
+		{`error An unexpected error occurred: "https://registry.yarnpkg.com/react: getaddrinfo ENOTFOUND registry.yarnpkg.com".`, 1},
+		{`error An unexpected error occurred: "https://registry.yarnpkg.com/react: Request failed \"503 Service Unavailable\"".`, 1},
+	} {
+		registryBreaker = newCircuitBreaker(3, time.Minute)
+		os.Setenv("YARN_OUTPUT", c.output)
+		err := yarnAddContext(context.Background(), dir, "react")
+		if !errors.Is(err, ErrInstallFailed) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if registryBreaker.failures != c.failures {
+			t.Fatalf("%s: unexpected failures %d", c.output, registryBreaker.failures)
+		}
+	}
+
+	registryBreaker = newCircuitBreaker(3, time.Minute)
+	os.Setenv("YARN_OUTPUT", "ECONNRESET")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	yarnAddContext(ctx, dir, "react")
+	if registryBreaker.failures != 0 {
+		t.Fatalf("the cancellations should not count, got %d failures", registryBreaker.failures)
+	}
+}
+
+func TestCheckToolchainCached(t *testing.T) {
+	defer func() {
+		toolchainCheck.checkedAt = time.Time{}
+		toolchainCheck.err = nil
+	}()
+	cached := errors.New("cached")
+	toolchainCheck.checkedAt = time.Now()
+	toolchainCheck.err = cached
+	if err := checkToolchainCached(); err != cached {
+		t.Fatalf("the result within the ttl should be cached, got %v", err)
+	}
+
+	envPath := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	defer os.Setenv("PATH", envPath)
+	toolchainCheck.checkedAt = time.Now().Add(-toolchainCheckTTL - time.Second)
+	if err := checkToolchainCached(); err == nil || err == cached {
+		t.Fatalf("the expired result should be checked again, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/ije/gox/utils"
+)
+
+// BuildOverride specifies the build options of a package that are always
+// applied by the server, the options are loaded from the `build-overrides-file`.
+//
+// Precedence: the query options always win, the `deps` query pins the versions
+// of the aliased packages too; the `external` list is merged with the global
+// externals; the `define` can't replace the built-in defines like
+// `process.env.NODE_ENV`; the `entry` is ignored when a submodule is requested.
+type BuildOverride struct {
+	// remaps the imports, the aliased modules are always external
+	Alias map[string]string `json:"alias,omitempty"`
+	// modules that are never bundled
+	External []string `json:"external,omitempty"`
+	// extra esbuild defines
+	Define map[string]string `json:"define,omitempty"`
+	// the entry file of the package, like `index.mjs`
+	Entry string `json:"entry,omitempty"`
+}
+
+// Hash returns a short hash of the override that is used as a part of the build id.
+func (o *BuildOverride) Hash() string {
+	sum := sha1.Sum(utils.MustEncodeJSON(o))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func getBuildOverride(name string) *BuildOverride {
+	if o, ok := config.buildOverrides[name]; ok {
+		return &o
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"path"
 	"strings"
 
 	"github.com/ije/gox/utils"
@@ -11,6 +13,12 @@ type pkg struct {
 	name      string
 	version   string
 	submodule string
+	// the dir of the local package relative to the `local-packages-dir`,
+	// the local package is installed from the dir instead of the registry
+	local string
+	// the github repo and the commit sha like `owner/repo@sha`, the package is
+	// installed from the commit instead of the registry
+	git string
 }
 
 func parsePkg(pathname string) (*pkg, error) {
@@ -34,7 +42,7 @@ func parsePkg(pathname string) (*pkg, error) {
 		if version == "" {
 			version = "latest"
 		}
-		info, _, err := node.getPackageInfo(name, version)
+		info, _, err := getRegistry().PackageInfo(name, version)
 		if err != nil {
 			return nil, err
 		}
@@ -49,6 +57,63 @@ func parsePkg(pathname string) (*pkg, error) {
 	}, nil
 }
 
+// parseLocalPkg parses the pathname of the local package in the dir, the dir
+// is relative to the `local-packages-dir` and must be inside of it.
+func parseLocalPkg(pathname string, dir string) (*pkg, error) {
+	if config.localPackagesDir == "" {
+		return nil, errors.New("local packages are disabled")
+	}
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+	if dir == "" {
+		return nil, errors.New("invalid local package dir")
+	}
+	var p NpmPackage
+	err := utils.ParseJSONFile(path.Join(config.localPackagesDir, dir, "package.json"), &p)
+	if err != nil {
+		return nil, withKind(ErrPackageNotFound, fmt.Errorf("local package '%s' not found", dir))
+	}
+	name, submodule := splitPkgPath(strings.Trim(pathname, "/"))
+	if i := strings.LastIndexByte(name, '@'); i > 0 {
+		name = name[:i]
+	}
+	if name != p.Name || p.Version == "" {
+		return nil, fmt.Errorf("local package '%s' is not '%s'", dir, name)
+	}
+	return &pkg{
+		name:      p.Name,
+		version:   p.Version,
+		submodule: strings.TrimSuffix(submodule, ".js"),
+		local:     dir,
+	}, nil
+}
+
+// pathVersion returns the version of the package as written in the pathname,
+// like `latest` of `/react@latest/es2020/react.js`, or empty string if not specified.
+func pathVersion(pathname string) string {
+	name, _ := splitPkgPath(strings.Trim(pathname, "/"))
+	if i := strings.LastIndexByte(name, '@'); i > 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// splitPkgPath splits the import path to the package name and the submodule.
+func splitPkgPath(importPath string) (name string, submodule string) {
+	slice := strings.Split(importPath, "/")
+	if l := len(slice); strings.HasPrefix(importPath, "@") && l > 1 {
+		name = strings.Join(slice[:2], "/")
+		if l > 2 {
+			submodule = strings.Join(slice[2:], "/")
+		}
+	} else {
+		name = slice[0]
+		if l > 1 {
+			submodule = strings.Join(slice[1:], "/")
+		}
+	}
+	return
+}
+
 func (m pkg) Equels(other pkg) bool {
 	return m.name == other.name && m.version == other.version && m.submodule == other.submodule
 }
@@ -78,7 +143,7 @@ func (a pkgSlice) Less(i, j int) bool { return a[i].String() < a[j].String() }
 func (a pkgSlice) Has(name string) bool {
 	for _, m := range a {
 		if m.name == name {
-			return false
+			return true
 		}
 	}
 	return false
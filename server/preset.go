@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+
+	"github.com/ije/gox/utils"
+)
+
+var regPresetName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Preset is a named set of the externals of a framework, like `react`, that is
+// applied by the `preset` query, the presets are loaded from the `presets-file`.
+type Preset struct {
+	// the external packages, their submodules are external too
+	External []string `json:"external"`
+	// the import urls of the externals, like `{"react": "https://esm.sh/react@17.0.2"}`,
+	// the externals without url are imported from esm.sh
+	Imports map[string]string `json:"imports,omitempty"`
+}
+
+// Hash returns a short hash of the preset that is used as a part of the build id,
+// the changes of the preset invalidate the builds.
+func (p *Preset) Hash() string {
+	c := *p
+	c.External = append([]string{}, p.External...)
+	sort.Strings(c.External)
+	sum := sha256.Sum256(utils.MustEncodeJSON(c))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// isExternal returns true if the import path is an external package of the
+// preset or a submodule of it.
+func (p *Preset) isExternal(importPath string) bool {
+	name, _ := splitPkgPath(importPath)
+	for _, external := range p.External {
+		if name == external {
+			return true
+		}
+	}
+	return false
+}
+
+// importURL returns the configured import url of the external, the url of a
+// submodule is the url of the package with the submodule path.
+func (p *Preset) importURL(importPath string) string {
+	if url, ok := p.Imports[importPath]; ok {
+		return url
+	}
+	name, submodule := splitPkgPath(importPath)
+	if url, ok := p.Imports[name]; ok && submodule != "" {
+		return url + "/" + submodule
+	}
+	return ""
+}
+
+func getPreset(name string) *Preset {
+	if p, ok := config.presets[name]; ok {
+		return &p
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPreset(t *testing.T) {
+	a := &Preset{External: []string{"react", "react-dom"}, Imports: map[string]string{"react": "https://esm.sh/react@17.0.2"}}
+	b := &Preset{External: []string{"react-dom", "react"}, Imports: map[string]string{"react": "https://esm.sh/react@17.0.2"}}
+	if a.Hash() != b.Hash() || len(a.Hash()) != 8 {
+		t.Fatalf("the logically identical presets should have the same hash, got %s and %s", a.Hash(), b.Hash())
+	}
+	if a.Hash() == (&Preset{External: []string{"react"}}).Hash() {
+		t.Fatal("the different presets should have different hashes")
+	}
+	for importPath, external := range map[string]bool{"react": true, "react/jsx-runtime": true, "react-dom/server": true, "react-is": false, "preact": false} {
+		if a.isExternal(importPath) != external {
+			t.Fatalf("unexpected external %s: %v", importPath, !external)
+		}
+	}
+	if url := a.importURL("react/jsx-runtime"); url != "https://esm.sh/react@17.0.2/jsx-runtime" {
+		t.Fatalf("unexpected import url %s", url)
+	}
+	if url := a.importURL("react-dom"); url != "" {
+		t.Fatalf("the external without url should be imported from esm.sh, got %s", url)
+	}
+
+	config = &Config{presets: map[string]Preset{"react": *a}}
+	defer func() { config = &Config{} }()
+	task := &buildTask{pkg: pkg{name: "swr", version: "0.5.6"}, target: "es2020", preset: "react"}
+	id := task.ID()
+	if !strings.Contains(id, "/preset=react."+a.Hash()+"/shim=v1/es2020/") {
+		t.Fatalf("unexpected build id %s", id)
+	}
+	if name, r, ok := parseBuildID(id); !ok || name != "swr" || r.Target != "es2020" {
+		t.Fatalf("unexpected build record %s %v", name, r)
+	}
+}
+
+func TestBuildWithPreset(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-react", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const createElement = () => "bundled";`,
+	})
+	f.add(NpmPackage{Name: "fixture-hooks", Version: "1.0.0", Type: "module", Module: "index.js", Dependencies: map[string]string{"fixture-react": "1.0.0"}}, map[string]string{
+		"index.js": `import { createElement } from "fixture-react"; export const useHook = () => createElement();`,
+	})
+	useFixtures(t, f)
+	config.presets = map[string]Preset{
+		"fixture": {External: []string{"fixture-react"}, Imports: map[string]string{"fixture-react": "https://cdn.example.com/react"}},
+	}
+
+	task := &buildTask{pkg: pkg{name: "fixture-hooks", version: "1.0.0"}, target: "es2020", bundle: true, preset: "fixture"}
+	_, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getStorage().Get(path.Join("builds", task.ID()+".js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(code), "bundled") || !strings.Contains(string(code), "https://cdn.example.com/react") {
+		t.Fatalf("the externals of the preset should not be bundled:\n%s", code)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"path"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// BuildProvenance describes how a build file is produced, it's saved as the
+// `.provenance.json` file next to the build file. The build time is not a part
+// of the build file, that keeps the output byte-stable.
+type BuildProvenance struct {
+	ID           string `json:"id"`
+	BuildVersion int    `json:"buildVersion"`
+	Esbuild      string `json:"esbuild"`
+	Target       string `json:"target"`
+	// the installed packages resolved by yarn, like `react@17.0.2`
+	Packages  []string `json:"packages"`
+	BuildTime string   `json:"buildTime"`
+}
+
+// esbuildVersion returns the version of the esbuild module linked in the binary.
+func esbuildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/evanw/esbuild" {
+				return dep.Version
+			}
+		}
+	}
+	return ""
+}
+
+func (task *buildTask) storeProvenance(esmeta *ESMeta) error {
+	target := task.target
+	if esmeta.EffectiveTarget != "" {
+		target = esmeta.EffectiveTarget
+	}
+	packages := make([]string, 0, len(esmeta.Integrity))
+	for key := range esmeta.Integrity {
+		packages = append(packages, key)
+	}
+	sort.Strings(packages)
+	provenance := BuildProvenance{
+		ID:           task.ID(),
+		BuildVersion: VERSION,
+		Esbuild:      esbuildVersion(),
+		Target:       target,
+		Packages:     packages,
+		BuildTime:    time.Now().UTC().Format(time.RFC3339),
+	}
+	return getStorage().Put(path.Join("builds", task.ID()+".provenance.json"), bytes.NewReader(utils.MustEncodeJSON(provenance)))
+}
@@ -2,12 +2,17 @@ package server
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,10 +42,54 @@ var httpClient = &http.Client{
 // esm query middleware for rex
 func query() rex.Handle {
 	startTime := time.Now()
-	queue := newBuildQueue(runtime.NumCPU())
+	queue := newBuildQueue(runtime.NumCPU(), config.maxPackageBuilds)
+
+	if len(config.warmupPackages) > 0 {
+		go warmup(queue)
+	}
 
 	return func(ctx *rex.Context) interface{} {
 		pathname := ctx.Path.String()
+		// the proxy may keep the base path of the requests
+		if config.basePath != "" && strings.HasPrefix(pathname, config.basePath+"/") {
+			pathname = strings.TrimPrefix(pathname, config.basePath)
+		}
+		if strings.HasPrefix(pathname, "/versions/") {
+			name := strings.TrimPrefix(pathname, "/versions/")
+			builds, err := listBuilds(name)
+			if err != nil {
+				return err
+			}
+			versions := newStringSet()
+			for _, r := range builds {
+				versions.Add(r.Version)
+			}
+			versionList := versions.Values()
+			sortVersions(versionList)
+			return map[string]interface{}{
+				"name":     name,
+				"versions": versionList,
+				"builds":   builds,
+			}
+		}
+		if strings.HasPrefix(pathname, "/purge/") {
+			if ctx.R.Method != "POST" {
+				return rex.Err(http.StatusMethodNotAllowed)
+			}
+			if !isAdmin(ctx) {
+				return rex.Err(http.StatusUnauthorized)
+			}
+			name := strings.TrimPrefix(pathname, "/purge/")
+			n, err := purgeBuilds(name)
+			if err != nil {
+				return err
+			}
+			log.Infof("purge %d builds of %s", n, name)
+			return map[string]interface{}{
+				"name":   name,
+				"purged": n,
+			}
+		}
 		switch pathname {
 		case "/":
 			indexHTML, err := embedFS.ReadFile("embed/index.html")
@@ -58,6 +107,22 @@ func query() rex.Handle {
 		case "/favicon.ico":
 			// todo: add esm.sh logo
 			return rex.Err(404)
+		case "/readyz":
+			err := checkToolchainCached()
+			if err != nil {
+				return rex.Status(http.StatusServiceUnavailable, err.Error())
+			}
+			return "ok"
+		case "/build-log":
+			if !isAdmin(ctx) {
+				return rex.Err(http.StatusUnauthorized)
+			}
+			id := ctx.Form.Value("id")
+			if !regBuildLogID.MatchString(id) || !fileExists(buildLogFile(id)) {
+				return rex.Err(404, "build log not found")
+			}
+			ctx.SetHeader("Content-Type", "text/plain; charset=utf-8")
+			return rex.File(buildLogFile(id))
 		case "/status.json":
 			queue.lock.Lock()
 			q := make([]map[string]interface{}, queue.queue.Len())
@@ -66,23 +131,233 @@ func query() rex.Handle {
 				t, ok := el.Value.(*task)
 				if ok {
 					q[i] = map[string]interface{}{
-						"createTime": t.createTime.Unix(),
-						"startTime":  t.startTime.Unix(),
-						"consumers":  len(t.consumers),
-						"pkg":        t.pkg.String(),
-						"deps":       t.deps.String(),
-						"target":     t.target,
-						"inProcess":  t.inProcess,
-						"isDev":      t.isDev,
-						"bundle":     t.bundle,
+						"createTime":  t.createTime.Unix(),
+						"startTime":   t.startTime.Unix(),
+						"consumers":   len(t.consumers),
+						"pkg":         t.pkg.String(),
+						"deps":        t.deps.String(),
+						"target":      t.target,
+						"inProcess":   t.inProcess,
+						"lowPriority": t.lowPriority,
+						"isDev":       t.isDev,
+						"bundle":      t.bundle,
 					}
 					i++
 				}
 			}
 			queue.lock.Unlock()
 			return map[string]interface{}{
-				"queue": q[0:i],
+				"queue":    q[0:i],
+				"registry": registryBreaker.State(),
+			}
+		case "/build-status":
+			id := strings.TrimPrefix(ctx.Form.Value("id"), "/")
+			if id == "" {
+				return rex.Err(400, "missing build id")
+			}
+			if position, ok := queue.Position(id); ok {
+				return map[string]interface{}{
+					"status":        "queued",
+					"position":      position,
+					"estimatedWait": int64(queue.EstimatedWait(id).Seconds()),
+				}
+			}
+			if _, _, ok := findESM(id); ok {
+				return map[string]interface{}{"status": "done"}
+			}
+			return rex.Err(404, "build not found")
+		case "/build/batch":
+			if ctx.R.Method != "POST" {
+				return rex.Err(http.StatusMethodNotAllowed)
+			}
+			var specs []BuildSpec
+			err := json.NewDecoder(ctx.R.Body).Decode(&specs)
+			if err != nil {
+				return rex.Err(400, "invalid build specs")
+			}
+			if len(specs) > config.maxBatchSize {
+				return rex.Err(400, fmt.Sprintf("too many packages in the batch, the limit is %d, please split the request", config.maxBatchSize))
+			}
+			return batchBuild(queue, specs)
+		case "/build-info.json":
+			id := strings.TrimSuffix(strings.TrimPrefix(ctx.Form.Value("id"), "/"), ".js")
+			if !regBuildVersionPath.MatchString("/" + id) {
+				id = fmt.Sprintf("v%d/%s", VERSION, id)
+			}
+			esm, pkgCSS, ok := findESM(id)
+			if !ok {
+				return rex.Err(404, "build not found")
+			}
+			return map[string]interface{}{
+				"id":     id,
+				"esmeta": esm,
+				"css":    pkgCSS,
+			}
+		case "/builds.json":
+			if !isAdmin(ctx) {
+				return rex.Err(http.StatusUnauthorized)
+			}
+			sortBy := ctx.Form.Value("sort")
+			if sortBy != "" && sortBy != "size" && sortBy != "age" {
+				return rex.Err(400, "invalid sort, it should be 'size' or 'age'")
+			}
+			page, limit := 1, 100
+			if v := ctx.Form.Value("page"); v != "" {
+				i, err := strconv.Atoi(v)
+				if err != nil || i < 1 {
+					return rex.Err(400, "invalid page")
+				}
+				page = i
+			}
+			if v := ctx.Form.Value("limit"); v != "" {
+				i, err := strconv.Atoi(v)
+				if err != nil || i < 1 || i > 1000 {
+					return rex.Err(400, "invalid limit, it should be 1-1000")
+				}
+				limit = i
+			}
+			builds, err := listCachedBuilds(ctx.Form.Value("prefix"), sortBy)
+			if err != nil {
+				return err
+			}
+			var totalSize int64
+			for _, b := range builds {
+				totalSize += b.Size
+			}
+			total := len(builds)
+			start := (page - 1) * limit
+			if start > total {
+				start = total
+			}
+			end := start + limit
+			if end > total {
+				end = total
+			}
+			return map[string]interface{}{
+				"total":     total,
+				"totalSize": totalSize,
+				"page":      page,
+				"limit":     limit,
+				"builds":    builds[start:end],
+			}
+		case "/exports.json":
+			name := strings.TrimPrefix(ctx.Form.Value("pkg"), "/")
+			if name == "" {
+				return rex.Err(400, "missing package")
+			}
+			isDev := config.defaultDev
+			if !ctx.Form.IsNil("dev") {
+				v := ctx.Form.Value("dev")
+				isDev = v != "false" && v != "0"
+			}
+			env := "production"
+			if isDev {
+				env = "development"
+			}
+			m, err := parsePkg(name)
+			if err != nil {
+				return rex.Err(errorStatus(err), err.Error())
+			}
+			exports, ok := getCachedExports(*m, env)
+			if !ok {
+				// the probe installs the package, it's limited like the fresh builds
+				if allow, retryAfter := buildLimiter.Allow(ctx.RemoteIP()); !allow {
+					ctx.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					return rex.Err(http.StatusTooManyRequests, "too many builds, please try later")
+				}
+				exports, err = probeExports(*m, env)
+				if err != nil {
+					return rex.Err(errorStatus(err), err.Error())
+				}
+			}
+			return map[string]interface{}{
+				"pkg":     m.String(),
+				"exports": exports,
 			}
+		case "/readme.md":
+			name := strings.TrimPrefix(ctx.Form.Value("pkg"), "/")
+			if name == "" {
+				return rex.Err(400, "missing package")
+			}
+			m, err := parsePkg(name)
+			if err != nil {
+				return rex.Err(errorStatus(err), err.Error())
+			}
+			// installing the package is limited like the fresh builds
+			if !storageFileExists(path.Join("readme", fmt.Sprintf("%s@%s.md", m.name, m.version))) {
+				if allow, retryAfter := buildLimiter.Allow(ctx.RemoteIP()); !allow {
+					ctx.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					return rex.Err(http.StatusTooManyRequests, "too many builds, please try later")
+				}
+			}
+			readme, err := getReadme(*m)
+			if err != nil {
+				return rex.Err(errorStatus(err), err.Error())
+			}
+			if len(readme) == 0 {
+				return rex.Err(404, fmt.Sprintf("package '%s@%s' has no README", m.name, m.version))
+			}
+			// the README of an exact version never changes
+			if regVersionPath.MatchString(name + "/") {
+				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(config.resolveCacheTTL.Seconds())))
+			}
+			ctx.SetHeader("Content-Type", "text/markdown; charset=utf-8")
+			return readme
+		case "/exports-diff.json":
+			// the exports of a build id(like `v43/react@17.0.2/es2020/react`) are read
+			// from the stored build, and the exports of a package(like `react@17.0.2`)
+			// are probed if they are not cached
+			getExports := func(s string) ([]string, error) {
+				s = strings.TrimPrefix(s, "/")
+				if regBuildVersionPath.MatchString("/" + s) {
+					esm, _, ok := findESM(strings.TrimSuffix(s, ".js"))
+					if !ok {
+						return nil, withKind(ErrPackageNotFound, fmt.Errorf("build '%s' not found", s))
+					}
+					return esm.Exports, nil
+				}
+				m, err := parsePkg(s)
+				if err != nil {
+					return nil, err
+				}
+				if exports, ok := getCachedExports(*m, "production"); ok {
+					return exports, nil
+				}
+				if allow, retryAfter := buildLimiter.Allow(ctx.RemoteIP()); !allow {
+					ctx.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					return nil, withKind(ErrRateLimited, errors.New("too many builds, please try later"))
+				}
+				return probeExports(*m, "production")
+			}
+			from, to := ctx.Form.Value("from"), ctx.Form.Value("to")
+			if from == "" || to == "" {
+				return rex.Err(400, "missing the 'from' or 'to' query")
+			}
+			fromExports, err := getExports(from)
+			if err != nil {
+				return rex.Err(errorStatus(err), err.Error())
+			}
+			toExports, err := getExports(to)
+			if err != nil {
+				return rex.Err(errorStatus(err), err.Error())
+			}
+			added, removed, unchanged := diffExports(fromExports, toExports)
+			return map[string]interface{}{
+				"from":      from,
+				"to":        to,
+				"added":     added,
+				"removed":   removed,
+				"unchanged": unchanged,
+			}
+		case "/signing-key.pem":
+			key := signingPublicKey()
+			if key == nil {
+				return rex.Err(404, "signing is disabled")
+			}
+			ctx.SetHeader("Content-Type", "application/x-pem-file")
+			return key
 		case "/error.js":
 			switch ctx.Form.Value("type") {
 			case "resolve":
@@ -111,6 +386,10 @@ func query() rex.Handle {
 			return rex.Content(pathname, startTime, bytes.NewReader(data))
 		}
 
+		if ok, retryAfter := requestLimiter.Allow(ctx.RemoteIP()); !ok {
+			return throwRateLimited(ctx, "too many requests", retryAfter)
+		}
+
 		hasBuildVerPrefix := strings.HasPrefix(pathname, fmt.Sprintf("/v%d/", VERSION))
 		prevBuildVer := ""
 		if hasBuildVerPrefix {
@@ -124,7 +403,7 @@ func query() rex.Handle {
 
 		var storageType string
 		switch path.Ext(pathname) {
-		case ".js":
+		case ".js", ".mjs":
 			if hasBuildVerPrefix {
 				storageType = "builds"
 			}
@@ -134,13 +413,33 @@ func query() rex.Handle {
 			} else if len(strings.Split(pathname, "/")) > 2 {
 				storageType = "raw"
 			}
+		case ".txt":
+			if hasBuildVerPrefix && strings.HasSuffix(pathname, ".js.LEGAL.txt") {
+				storageType = "builds"
+			}
+		case ".sig":
+			if hasBuildVerPrefix && strings.HasSuffix(pathname, ".js.sig") {
+				storageType = "builds"
+			}
 		case ".css":
 			if hasBuildVerPrefix {
 				storageType = "builds"
 			} else if len(strings.Split(pathname, "/")) > 2 {
 				storageType = "raw"
 			}
-		case ".json", ".jsx", ".tsx", ".less", ".sass", ".scss", ".stylus", ".styl", ".wasm", ".xml", ".yaml", ".svg":
+		case ".json":
+			if hasBuildVerPrefix && endsWith(pathname, ".metafile.json", ".provenance.json") {
+				storageType = "builds"
+			} else if len(strings.Split(pathname, "/")) > 2 {
+				storageType = "raw"
+			}
+		case ".wasm":
+			if hasBuildVerPrefix {
+				storageType = "builds"
+			} else if len(strings.Split(pathname, "/")) > 2 {
+				storageType = "raw"
+			}
+		case ".jsx", ".tsx", ".less", ".sass", ".scss", ".stylus", ".styl", ".xml", ".yaml", ".svg":
 			if len(strings.Split(pathname, "/")) > 2 {
 				storageType = "raw"
 			}
@@ -176,16 +475,16 @@ func query() rex.Handle {
 					}
 				}
 				if shouldRedirect {
-					url := fmt.Sprintf("%s://%s/%s", proto, hostname, m.String())
+					url := fmt.Sprintf("%s://%s%s/%s", proto, hostname, config.basePath, m.String())
 					return rex.Redirect(url, http.StatusTemporaryRedirect)
 				}
-				cacheFile := path.Join(config.storageDir, "raw", m.String())
-				if fileExists(cacheFile) {
+				cacheFile := path.Join("raw", m.String())
+				if storageFileExists(cacheFile) {
 					if strings.HasSuffix(pathname, ".ts") {
 						ctx.SetHeader("Content-Type", "application/typescript")
 					}
 					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-					return rex.File(cacheFile)
+					return serveFile(ctx, cacheFile)
 				}
 				unpkgDomain := "unpkg.com"
 				if config.unpkgDomain != "" {
@@ -203,11 +502,7 @@ func query() rex.Handle {
 				if err != nil {
 					return err
 				}
-				err = ensureDir(path.Dir(cacheFile))
-				if err != nil {
-					return err
-				}
-				err = ioutil.WriteFile(cacheFile, data, 0644)
+				err = getStorage().Put(cacheFile, bytes.NewReader(data))
 				if err != nil {
 					return err
 				}
@@ -227,19 +522,34 @@ func query() rex.Handle {
 			var filepath string
 			if hasBuildVerPrefix && (storageType == "builds" || storageType == "types") {
 				if prevBuildVer != "" {
-					filepath = path.Join(config.storageDir, storageType, prevBuildVer, pathname)
+					filepath = path.Join(storageType, prevBuildVer, pathname)
 				} else {
-					filepath = path.Join(config.storageDir, storageType, fmt.Sprintf("v%d", VERSION), pathname)
+					filepath = path.Join(storageType, fmt.Sprintf("v%d", VERSION), pathname)
 				}
 			} else {
-				filepath = path.Join(config.storageDir, storageType, pathname)
+				filepath = path.Join(storageType, pathname)
 			}
-			if fileExists(filepath) {
+			if storageFileExists(filepath) {
 				if storageType == "types" {
 					ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
+				} else if strings.HasSuffix(pathname, ".wasm") {
+					ctx.SetHeader("Content-Type", "application/wasm")
+				} else if strings.HasSuffix(pathname, ".mjs") {
+					ctx.SetHeader("Content-Type", "text/javascript; charset=utf-8")
+				} else if storageType == "builds" && strings.HasSuffix(pathname, ".js") {
+					// the `utf8` builds are only decoded correctly as utf-8
+					ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+				} else if strings.HasSuffix(pathname, ".sig") {
+					ctx.SetHeader("Content-Type", "application/octet-stream")
+				}
+				if storageType == "builds" && config.signingKey != nil && endsWith(pathname, ".js", ".mjs") {
+					if sig := buildSignature(filepath); sig != "" {
+						ctx.SetHeader("X-Signature", sig)
+						ctx.SetHeader("Access-Control-Expose-Headers", "X-Signature")
+					}
 				}
 				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-				return rex.File(filepath)
+				return serveFile(ctx, filepath)
 			}
 		}
 
@@ -250,7 +560,7 @@ func query() rex.Handle {
 			if strings.HasPrefix(ua, "Deno/") {
 				target = "deno"
 			} else {
-				target = "es2015"
+				target = config.defaultTarget
 				name, version := user_agent.New(ua).Browser()
 				if engine, ok := engines[strings.ToLower(name)]; ok {
 					a := strings.Split(version, ".")
@@ -285,7 +595,7 @@ func query() rex.Handle {
 			if p != "" {
 				m, err := parsePkg(p)
 				if err != nil {
-					if strings.HasSuffix(err.Error(), "not found") {
+					if errors.Is(err, ErrPackageNotFound) {
 						continue
 					}
 					return throwErrorJS(ctx, err)
@@ -297,20 +607,187 @@ func query() rex.Handle {
 		}
 
 		isPkgCSS := !ctx.Form.IsNil("css")
-		isDev := !ctx.Form.IsNil("dev")
+		analyze := !ctx.Form.IsNil("analyze")
+		provenance := !ctx.Form.IsNil("provenance")
+		isDev := config.defaultDev
+		if !ctx.Form.IsNil("dev") {
+			v := ctx.Form.Value("dev")
+			isDev = v != "false" && v != "0"
+		}
+		// the `minify` query overrides the default minification of the dev flag
+		noMinify := false
+		forceMinify := false
+		if !ctx.Form.IsNil("minify") {
+			v := ctx.Form.Value("minify")
+			minify := v != "false" && v != "0"
+			noMinify = !isDev && !minify
+			forceMinify = isDev && minify
+		}
+		// the `utf8` charset keeps the non-ASCII characters in the output, that is
+		// smaller for the packages with lots of non-Latin content
+		utf8 := false
+		switch charset := strings.ToLower(ctx.Form.Value("charset")); charset {
+		case "", "ascii":
+		case "utf8", "utf-8":
+			utf8 = true
+		default:
+			return rex.Err(400, fmt.Sprintf("unsupported charset '%s'", charset))
+		}
 		bundleMode := !ctx.Form.IsNil("bundle") || !ctx.Form.IsNil("b")
+		// the strict mode rejects the builds externalizing the packages that are not
+		// listed in the `deps` query, it doesn't change the build output
+		strictExternals := false
+		if !ctx.Form.IsNil("strict-externals") {
+			v := ctx.Form.Value("strict-externals")
+			strictExternals = v != "false" && v != "0"
+		}
+		// the standalone mode bundles the peer deps too
+		standalone := !ctx.Form.IsNil("standalone")
+		// the module format of the build, `esm` by default
+		systemjs := false
+		switch format := ctx.Form.Value("format"); format {
+		case "", "esm":
+		case "systemjs":
+			systemjs = true
+		default:
+			return rex.Err(400, "invalid format")
+		}
+		// the extension of the build file, the `.mjs` file has the same content as the `.js` one
+		mjs := false
+		switch ext := ctx.Form.Value("ext"); ext {
+		case "", "js":
+		case "mjs":
+			mjs = true
+		default:
+			return rex.Err(400, "invalid ext")
+		}
+		typesOnly := !ctx.Form.IsNil("types-only")
+		noDts := !ctx.Form.IsNil("no-dts")
+		// the debug build records the details in the build log, it's only for the admin
+		debug := false
+		if v := ctx.Form.Value("debug"); v != "" && v != "0" && v != "false" {
+			if !isAdmin(ctx) {
+				return rex.Err(http.StatusUnauthorized)
+			}
+			debug = true
+		}
+		integrity := !ctx.Form.IsNil("integrity")
 		noCheck := !ctx.Form.IsNil("no-check")
+		noBrowser := !ctx.Form.IsNil("no-browser")
+		transform := !ctx.Form.IsNil("transform")
+		decorators := !ctx.Form.IsNil("decorators")
+		// the export names are written into the entry code and the build id
+		exports := splitList(ctx.Form.Value("exports"))
+		for _, name := range exports {
+			if !regJSIdentifier.MatchString(name) {
+				return rex.Err(400, fmt.Sprintf("invalid export name '%s'", name))
+			}
+		}
+		var inlineSize int64
+		if v := ctx.Form.Value("inline"); v != "" {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || i < 0 {
+				return rex.Err(400, "invalid inline size")
+			}
+			inlineSize = i
+		}
+		conditions := newStringSet()
+		for _, c := range splitList(ctx.Form.Value("conditions")) {
+			if !regCondition.MatchString(c) {
+				return rex.Err(400, "invalid condition")
+			}
+			conditions.Add(c)
+		}
+		comments := ctx.Form.Value("comments")
+		if _, ok := legalComments[comments]; !ok && comments != "" {
+			return rex.Err(400, "invalid comments mode")
+		}
+		// the version of the `@types` package, like `?types=17.0.11` or `?types=@types/react@17.0.11`
+		typesVersion := ""
+		if v := ctx.Form.Value("types"); v != "" {
+			if i := strings.LastIndexByte(v, '@'); i > 0 {
+				v = v[i+1:]
+			}
+			if !regFullVersion.MatchString(v) {
+				return rex.Err(400, "invalid types version")
+			}
+			typesVersion = v
+		}
+		preset := ctx.Form.Value("preset")
+		if preset != "" && getPreset(preset) == nil {
+			return rex.Err(400, fmt.Sprintf("unknown preset '%s'", preset))
+		}
+		entry := ""
+		if v := ctx.Form.Value("entry"); v != "" {
+			// clean the path to keep it inside of the package
+			entry = strings.TrimPrefix(path.Clean("/"+v), "/")
+		}
+		shim := 0
+		if v := ctx.Form.Value("pin"); v != "" {
+			i, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+			if _, ok := entryShims[i]; err != nil || !ok {
+				return rex.Err(400, "invalid pin version")
+			}
+			shim = i
+		}
+		platform := ""
+		if ctx.Form.Value("platform") == "node" {
+			platform = "node"
+		}
 
-		reqPkg, err := parsePkg(pathname)
+		// the local package is only for the admin to test the unpublished packages
+		var reqPkg *pkg
+		var err error
+		if local := ctx.Form.Value("local"); local != "" {
+			if !isAdmin(ctx) {
+				return rex.Err(http.StatusUnauthorized)
+			}
+			reqPkg, err = parseLocalPkg(pathname, local)
+		} else if strings.HasPrefix(pathname, "/gh/") {
+			repo, ref, submodule, e := parseGitHubPath(pathname)
+			if e != nil {
+				return rex.Err(400, e.Error())
+			}
+			// the tag or the branch is redirected to the commit sha that is cached permanently
+			if !regGitSHA.MatchString(ref) {
+				sha, e := resolveGitHubRef(repo, ref)
+				if e != nil {
+					return throwErrorJS(ctx, e)
+				}
+				url := fmt.Sprintf("%s/gh/%s@%s", config.basePath, repo, sha)
+				if submodule != "" {
+					url += "/" + submodule
+				}
+				if ctx.R.URL.RawQuery != "" {
+					url += "?" + ctx.R.URL.RawQuery
+				}
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(config.resolveCacheTTL.Seconds())))
+				return rex.Redirect(url, http.StatusFound)
+			}
+			reqPkg, err = parseGitHubPkg(repo, ref, submodule)
+		} else {
+			reqPkg, err = parsePkg(pathname)
+		}
 		if err != nil {
-			if strings.HasSuffix(err.Error(), "not found") {
+			if errors.Is(err, ErrPackageNotFound) {
 				return throwErrorJS(ctx, err)
 			}
 			return throwErrorJS(ctx, err)
 		}
 
+		// the bare path of a floating version, like `/react@latest/es2020/react.js`, is redirected
+		// to the build of the resolved version
+		floatingVersion := !regFullVersion.MatchString(pathVersion(pathname))
+		unprefixedBare := false
+		if !hasBuildVerPrefix && floatingVersion && endsWith(pathname, ".js", ".mjs") {
+			a := strings.Split(reqPkg.submodule, "/")
+			if _, ok := targets[a[0]]; ok && len(a) > 1 {
+				unprefixedBare = true
+			}
+		}
+
 		isBare := false
-		if hasBuildVerPrefix && endsWith(pathname, ".js") {
+		if (hasBuildVerPrefix || unprefixedBare) && endsWith(pathname, ".js", ".mjs") {
 			a := strings.Split(reqPkg.submodule, "/")
 			if len(a) > 1 {
 				if strings.HasPrefix(a[0], "deps=") {
@@ -323,7 +800,7 @@ func query() rex.Handle {
 							}
 							m, err := parsePkg(p)
 							if err != nil {
-								if strings.HasSuffix(err.Error(), "not found") {
+								if errors.Is(err, ErrPackageNotFound) {
 									continue
 								}
 								return throwErrorJS(ctx, err)
@@ -336,21 +813,115 @@ func query() rex.Handle {
 					a = a[1:]
 				}
 			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "exports=") {
+				exports = splitList(strings.TrimPrefix(a[0], "exports="))
+				for _, name := range exports {
+					if !regJSIdentifier.MatchString(name) {
+						return rex.Err(400, fmt.Sprintf("invalid export name '%s'", name))
+					}
+				}
+				a = a[1:]
+			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "entry=") {
+				entry = strings.TrimPrefix(path.Clean("/"+unescapeEntryPath(strings.TrimPrefix(a[0], "entry="))), "/")
+				a = a[1:]
+			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "inline=") {
+				i, err := strconv.ParseInt(strings.TrimPrefix(a[0], "inline="), 10, 64)
+				if err != nil || i < 0 {
+					return rex.Err(400, "invalid inline size")
+				}
+				inlineSize = i
+				a = a[1:]
+			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "conditions=") {
+				conditions = newStringSet()
+				for _, c := range splitList(strings.TrimPrefix(a[0], "conditions=")) {
+					if regCondition.MatchString(c) {
+						conditions.Add(c)
+					}
+				}
+				a = a[1:]
+			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "comments=") {
+				if v := strings.TrimPrefix(a[0], "comments="); legalComments[v] != api.LegalCommentsDefault {
+					comments = v
+				}
+				a = a[1:]
+			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "types=") {
+				if v := strings.TrimPrefix(a[0], "types="); regFullVersion.MatchString(v) {
+					typesVersion = v
+				}
+				a = a[1:]
+			}
+			// the overrides hash is computed by the server, ignore the one in path
+			if len(a) > 1 && strings.HasPrefix(a[0], "overrides=") {
+				a = a[1:]
+			}
+			// so does the preset hash
+			if len(a) > 1 && strings.HasPrefix(a[0], "preset=") {
+				if name, _ := utils.SplitByLastByte(strings.TrimPrefix(a[0], "preset="), '.'); getPreset(name) != nil {
+					preset = name
+				}
+				a = a[1:]
+			}
+			// so does the banner hash
+			if len(a) > 1 && strings.HasPrefix(a[0], "banner=") {
+				a = a[1:]
+			}
+			if len(a) > 1 && strings.HasPrefix(a[0], "shim=v") {
+				i, err := strconv.Atoi(strings.TrimPrefix(a[0], "shim=v"))
+				if _, ok := entryShims[i]; err != nil || !ok {
+					return rex.Err(400, "invalid shim version")
+				}
+				shim = i
+				a = a[1:]
+			}
 			if len(a) > 1 {
 				if _, ok := targets[a[0]]; ok || a[0] == "esnext" {
 					submodule := strings.TrimSuffix(strings.Join(a[1:], "/"), ".js")
-					if endsWith(submodule, ".bundle") {
-						submodule = strings.TrimSuffix(submodule, ".bundle")
-						bundleMode = true
+					if strings.HasSuffix(submodule, ".mjs") {
+						submodule = strings.TrimSuffix(submodule, ".mjs")
+						mjs = true
 					}
-					if endsWith(submodule, ".development") {
-						submodule = strings.TrimSuffix(submodule, ".development")
-						isDev = true
+					nodePlatform := false
+					// the dev and minify flags of the bare path are only specified by the filename
+					isDev = false
+					noMinify = false
+					forceMinify = false
+					utf8 = false
+					// the build flags are encoded in the filename, like `react.development.bundle.js`
+					buildFlags := map[string]*bool{
+						".development": &isDev,
+						".bundle":      &bundleMode,
+						".standalone":  &standalone,
+						".nobrowser":   &noBrowser,
+						".transform":   &transform,
+						".decorators":  &decorators,
+						".node":        &nodePlatform,
+						".nominify":    &noMinify,
+						".minify":      &forceMinify,
+						".utf8":        &utf8,
+						".systemjs":    &systemjs,
+						".types":       &typesOnly,
+						".nodts":       &noDts,
+					}
+					for {
+						flag, ok := buildFlags[path.Ext(submodule)]
+						if !ok {
+							break
+						}
+						*flag = true
+						submodule = strings.TrimSuffix(submodule, path.Ext(submodule))
 					}
 					pkgName := path.Base(reqPkg.name)
 					if submodule == pkgName || (strings.HasSuffix(pkgName, ".js") && submodule+".js" == pkgName) {
 						submodule = ""
 					}
+					if nodePlatform {
+						platform = "node"
+					}
 					reqPkg.submodule = submodule
 					target = a[0]
 					isBare = true
@@ -358,18 +929,51 @@ func query() rex.Handle {
 			}
 		}
 
+		if systemjs && transform {
+			return rex.Err(400, "the systemjs format is not supported in the transform mode")
+		}
+
 		task := &buildTask{
-			pkg:    *reqPkg,
-			deps:   deps,
-			target: target,
-			isDev:  isDev,
-			bundle: bundleMode,
+			pkg:          *reqPkg,
+			deps:         deps,
+			exports:      exports,
+			entry:        entry,
+			inlineSize:   inlineSize,
+			conditions:   conditions.Values(),
+			comments:     comments,
+			preset:       preset,
+			typesVersion: typesVersion,
+			target:       target,
+			platform:     platform,
+			isDev:        isDev,
+			bundle:       bundleMode || standalone,
+			standalone:   standalone,
+			noBrowser:    noBrowser,
+			transform:    transform,
+			decorators:   decorators,
+			noMinify:     noMinify,
+			forceMinify:  forceMinify,
+			utf8:         utf8,
+			systemjs:     systemjs,
+			typesOnly:    typesOnly,
+			noDts:        noDts,
+			debug:        debug,
+			shim:         shim,
 		}
 
 		taskID := task.ID()
 		esm, pkgCSS, ok := findESM(taskID)
+		// the debug build and the local build always rebuild
+		if debug || reqPkg.local != "" {
+			ok = false
+		}
+		// the builds made before the peer externals were recorded can't be checked
+		// by the `strict-externals` query, rebuild them
+		if ok && strictExternals && esm.PeerExternals == nil {
+			ok = false
+		}
 		if !ok {
-			if !isBare {
+			if !isBare && !debug && reqPkg.local == "" && !strictExternals {
 				// find previous build version
 				for i := 0; i < VERSION; i++ {
 					id := fmt.Sprintf("v%d/%s", VERSION-(i+1), taskID[len(fmt.Sprintf("v%d/", VERSION)):])
@@ -380,10 +984,18 @@ func query() rex.Handle {
 					}
 				}
 			}
+			// the fresh builds are limited separately since they are much more expensive than the cache hits,
+			// the previous build is still served when the client is over the limit
+			allowBuild, retryAfter := buildLimiter.Allow(ctx.RemoteIP())
+			if !allowBuild && !ok {
+				return throwRateLimited(ctx, "too many builds", retryAfter)
+			}
 			// if the previous build exists and not in bare mode, then build current module in backgound,
 			// or wait the current build task for 30 seconds
 			if ok {
-				queue.Add(task)
+				if allowBuild {
+					queue.Add(task)
+				}
 			} else {
 				select {
 				case output := <-queue.Add(task):
@@ -392,12 +1004,30 @@ func query() rex.Handle {
 					}
 					esm = output.esm
 					pkgCSS = output.pkgCSS
+					if output.logID != "" {
+						ctx.SetHeader("X-Build-Log-Id", output.logID)
+						ctx.SetHeader("Access-Control-Expose-Headers", "X-Build-Log-Id")
+					}
 				case <-time.After(30 * time.Second):
+					if position, ok := queue.Position(task.ID()); ok {
+						ctx.SetHeader("X-Build-Queue-Position", strconv.Itoa(position))
+						ctx.SetHeader("Access-Control-Expose-Headers", "X-Build-Queue-Position")
+						if wait := queue.EstimatedWait(task.ID()); wait > 0 {
+							ctx.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+						}
+					}
 					return rex.Err(http.StatusRequestTimeout, "timeout, please try later")
 				}
 			}
 		}
 
+		// the check runs for the cached builds too
+		if strictExternals {
+			if err := esm.checkExternals(deps); err != nil {
+				return throwErrorJS(ctx, err)
+			}
+		}
+
 		if isPkgCSS {
 			if pkgCSS {
 				hostname := ctx.R.Host
@@ -405,7 +1035,7 @@ func query() rex.Handle {
 				if ctx.R.TLS != nil {
 					proto = "https"
 				}
-				url := fmt.Sprintf("%s://%s/%s.css", proto, hostname, taskID)
+				url := fmt.Sprintf("%s://%s%s/%s.css", proto, hostname, config.basePath, taskID)
 				code := http.StatusTemporaryRedirect
 				if regVersionPath.MatchString(pathname) {
 					code = http.StatusPermanentRedirect
@@ -415,35 +1045,108 @@ func query() rex.Handle {
 			return throwErrorJS(ctx, fmt.Errorf("css not found"))
 		}
 
-		if isBare {
-			fp := path.Join(
-				config.storageDir,
-				"builds",
-				taskID+".js",
-			)
-			if fileExists(fp) {
+		if analyze {
+			if storageFileExists(path.Join("builds", taskID+".metafile.json")) {
+				hostname := ctx.R.Host
+				proto := "http"
+				if ctx.R.TLS != nil {
+					proto = "https"
+				}
+				url := fmt.Sprintf("%s://%s%s/%s.metafile.json", proto, hostname, config.basePath, taskID)
+				return rex.Redirect(url, http.StatusTemporaryRedirect)
+			}
+			return rex.Err(404, "metafile not found")
+		}
+
+		if provenance {
+			if storageFileExists(path.Join("builds", taskID+".provenance.json")) {
+				hostname := ctx.R.Host
+				proto := "http"
+				if ctx.R.TLS != nil {
+					proto = "https"
+				}
+				url := fmt.Sprintf("%s://%s%s/%s.provenance.json", proto, hostname, config.basePath, taskID)
+				return rex.Redirect(url, http.StatusTemporaryRedirect)
+			}
+			return rex.Err(404, "provenance not found")
+		}
+
+		if integrity && esm.SRI != "" {
+			ctx.SetHeader("X-Integrity", esm.SRI)
+			ctx.SetHeader("Access-Control-Expose-Headers", "X-Integrity")
+		}
+
+		buildExt := ".js"
+		if mjs {
+			buildExt = ".mjs"
+		}
+
+		// the facade module is an es module, so the systemjs module is redirected to the build file
+		if isBare || systemjs {
+			if floatingVersion || !isBare {
+				hostname := ctx.R.Host
+				proto := "http"
+				if ctx.R.TLS != nil {
+					proto = "https"
+				}
+				url := fmt.Sprintf("%s://%s%s/%s%s", proto, hostname, config.basePath, taskID, buildExt)
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(config.resolveCacheTTL.Seconds())))
+				return rex.Redirect(url, http.StatusFound)
+			}
+			fp := path.Join("builds", taskID+buildExt)
+			if mjs {
+				err = ensureMJS(taskID)
+				if err != nil {
+					return throwErrorJS(ctx, err)
+				}
+				ctx.SetHeader("Content-Type", "text/javascript; charset=utf-8")
+			} else {
+				ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+			}
+			if storageFileExists(fp) {
 				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-				return rex.File(fp)
+				return serveFile(ctx, fp)
 			}
 			return rex.Err(404)
 		}
 
 		buf := bytes.NewBuffer(nil)
-		importPrefix := "/"
-		importSuffix := ".js"
+		importPrefix := config.basePath + "/"
+		importSuffix := buildExt
 		if config.cdnDomain != "" {
-			importPrefix = fmt.Sprintf("https://%s/", config.cdnDomain)
+			importPrefix = fmt.Sprintf("https://%s%s/", config.cdnDomain, config.basePath)
 		}
 		if config.cdnDomainChina != "" {
 			var record Record
 			err = mmdbr.Lookup(net.ParseIP(ctx.RemoteIP()), &record)
 			if err == nil && record.Country.ISOCode == "CN" {
-				importPrefix = fmt.Sprintf("https://%s/", config.cdnDomainChina)
+				importPrefix = fmt.Sprintf("https://%s%s/", config.cdnDomainChina, config.basePath)
+			}
+		}
+
+		if typesOnly {
+			if esm.Dts == "" {
+				return rex.Err(404, "types not found")
+			}
+			return map[string]interface{}{
+				"dts": importPrefix + strings.TrimPrefix(path.Join("/", fmt.Sprintf("v%d", VERSION), esm.Dts), "/"),
+			}
+		}
+
+		// import the content-addressed build file if it's written
+		modulePath := taskID
+		if esm.HashedPath != "" {
+			modulePath = strings.TrimSuffix(strings.TrimPrefix(esm.HashedPath, "/"), ".js")
+		}
+		if mjs {
+			err = ensureMJS(modulePath)
+			if err != nil {
+				return throwErrorJS(ctx, err)
 			}
 		}
 
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, "\n")
-		fmt.Fprintf(buf, `export * from "%s%s%s";%s`, importPrefix, taskID, importSuffix, "\n")
+		fmt.Fprintf(buf, `export * from "%s%s%s";%s`, importPrefix, modulePath, importSuffix, "\n")
 
 		if esm.Module != "" {
 			for _, name := range esm.Exports {
@@ -452,7 +1155,7 @@ func query() rex.Handle {
 						buf,
 						`export { default } from "%s%s%s";%s`,
 						importPrefix,
-						taskID,
+						modulePath,
 						importSuffix,
 						"\n",
 					)
@@ -464,7 +1167,7 @@ func query() rex.Handle {
 				buf,
 				`export { default } from "%s%s%s";%s`,
 				importPrefix,
-				taskID,
+				modulePath,
 				importSuffix,
 				"\n",
 			)
@@ -481,23 +1184,75 @@ func query() rex.Handle {
 			ctx.SetHeader("X-TypeScript-Types", value)
 			ctx.SetHeader("Access-Control-Expose-Headers", "X-TypeScript-Types")
 		}
-		ctx.SetHeader("Cache-Control", fmt.Sprintf("private, max-age=%d", refreshDuration))
+		ctx.SetHeader("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(config.resolveCacheTTL.Seconds())))
 		ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
 		return buf
 	}
 }
 
+// isAdmin checks the `token` query of the request with the admin token.
+func isAdmin(ctx *rex.Context) bool {
+	token := ctx.Form.Value("token")
+	return config.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.adminToken)) == 1
+}
+
+// serveFile serves the stored file with the range requests support, a range
+// request is served without compression since the ranges are of the raw content.
+func serveFile(ctx *rex.Context, name string) interface{} {
+	if ctx.R.Header.Get("Range") != "" {
+		ctx.R.Header.Del("Accept-Encoding")
+	}
+	ctx.SetHeader("Accept-Ranges", "bytes")
+	if data, modTime, ok := artifactCache.Get(name); ok {
+		return rex.Content(name, modTime, bytes.NewReader(data))
+	}
+	fs := getStorage()
+	if dir, ok := fs.(localStorage); ok {
+		return rex.File(path.Join(string(dir), name))
+	}
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	r, err := fs.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if artifactCache != nil {
+		artifactCache.Set(name, data, fi.ModTime())
+	}
+	return rex.Content(name, fi.ModTime(), bytes.NewReader(data))
+}
+
+// throwRateLimited responds an error with the `Retry-After` header in seconds.
+func throwRateLimited(ctx *rex.Context, message string, retryAfter time.Duration) interface{} {
+	ctx.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return throwErrorJS(ctx, withKind(ErrRateLimited, fmt.Errorf("%s, please try later", message)))
+}
+
 func throwErrorJS(ctx *rex.Context, err error) interface{} {
 	buf := bytes.NewBuffer(nil)
+	message := err.Error()
+	var le *loggedError
+	if errors.As(err, &le) {
+		message += fmt.Sprintf(" (build log: %s)", le.logID)
+		ctx.SetHeader("X-Build-Log-Id", le.logID)
+		ctx.SetHeader("Access-Control-Expose-Headers", "X-Build-Log-Id")
+	}
 	fmt.Fprintf(buf, "/* esm.sh - error */\n")
 	fmt.Fprintf(
 		buf,
 		`throw new Error("[esm.sh] " + %s);%s`,
-		strings.TrimSpace(string(utils.MustEncodeJSON(err.Error()))),
+		strings.TrimSpace(string(utils.MustEncodeJSON(message))),
 		"\n",
 	)
 	fmt.Fprintf(buf, "export default null;\n")
 	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 	ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
-	return rex.Status(500, buf)
+	return rex.Status(errorStatus(err), buf)
 }
@@ -13,28 +13,37 @@ type buildQueue struct {
 	current      []*task
 	tasks        map[string]*task
 	maxProcesses int
+	// max in-process tasks of the same package, 0 means no limit, that keeps
+	// the builds of many versions of a package from starving the others
+	maxPackageBuilds int
+	// moving average of the recent build durations
+	avgBuildTime time.Duration
 }
 
 type buildOutput struct {
 	esm    *ESMeta
 	pkgCSS bool
 	err    error
+	// the id of the saved build log of the debug build
+	logID string
 }
 
 type task struct {
 	*buildTask
-	inProcess  bool
-	el         *list.Element
-	createTime time.Time
-	startTime  time.Time
-	consumers  []chan *buildOutput
+	inProcess   bool
+	lowPriority bool
+	el          *list.Element
+	createTime  time.Time
+	startTime   time.Time
+	consumers   []chan *buildOutput
 }
 
-func newBuildQueue(maxProcesses int) *buildQueue {
+func newBuildQueue(maxProcesses int, maxPackageBuilds int) *buildQueue {
 	q := &buildQueue{
-		queue:        list.New(),
-		tasks:        map[string]*task{},
-		maxProcesses: maxProcesses,
+		queue:            list.New(),
+		tasks:            map[string]*task{},
+		maxProcesses:     maxProcesses,
+		maxPackageBuilds: maxPackageBuilds,
 	}
 	return q
 }
@@ -49,20 +58,36 @@ func (q *buildQueue) Len() int {
 
 // Add adds a new build task.
 func (q *buildQueue) Add(build *buildTask) chan *buildOutput {
+	return q.add(build, false)
+}
+
+// AddLowPriority adds a new build task that runs only when there are no other waiting tasks.
+func (q *buildQueue) AddLowPriority(build *buildTask) chan *buildOutput {
+	return q.add(build, true)
+}
+
+func (q *buildQueue) add(build *buildTask, lowPriority bool) chan *buildOutput {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
 	c := make(chan *buildOutput, 1)
 	t, ok := q.tasks[build.ID()]
 	if ok {
+		if !lowPriority {
+			t.lowPriority = false
+		}
+		if build.debug && !t.inProcess {
+			t.debug = true
+		}
 		t.consumers = append(t.consumers, c)
 		return c
 	}
 
 	t = &task{
-		buildTask:  build,
-		createTime: time.Now(),
-		consumers:  []chan *buildOutput{c},
+		buildTask:   build,
+		lowPriority: lowPriority,
+		createTime:  time.Now(),
+		consumers:   []chan *buildOutput{c},
 	}
 	t.el = q.queue.PushBack(t)
 	q.tasks[build.ID()] = t
@@ -71,14 +96,88 @@ func (q *buildQueue) Add(build *buildTask) chan *buildOutput {
 	return c
 }
 
+// Position returns the number of the waiting tasks that run before the task,
+// the position of an in-process task is 0.
+func (q *buildQueue) Position(id string) (position int, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t, ok := q.tasks[id]
+	if !ok || t.inProcess {
+		return
+	}
+	position = q.waitingAhead(t, func(*task) bool { return true })
+	return
+}
+
+// EstimatedWait estimates the duration until the task is done based on the
+// recent build durations, returns 0 if there is no build done. The waiting
+// tasks run `maxProcesses` at a time, and the tasks of the same package run
+// `maxPackageBuilds` at a time, the task waits for the slower of them.
+func (q *buildQueue) EstimatedWait(id string) time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t, ok := q.tasks[id]
+	if !ok {
+		return 0
+	}
+	if t.inProcess {
+		return q.avgBuildTime
+	}
+	rounds := 1
+	if q.maxProcesses > 0 {
+		rounds = q.waitingAhead(t, func(*task) bool { return true })/q.maxProcesses + 1
+	}
+	if q.maxPackageBuilds > 0 {
+		sibling := func(_t *task) bool { return _t.pkg.name == t.pkg.name }
+		// the in-process siblings hold the slots of the package
+		n := q.waitingAhead(t, sibling)
+		for _, _t := range q.current {
+			if sibling(_t) {
+				n++
+			}
+		}
+		if r := n/q.maxPackageBuilds + 1; r > rounds {
+			rounds = r
+		}
+	}
+	return q.avgBuildTime * time.Duration(rounds)
+}
+
+// waitingAhead returns the number of the matched waiting tasks that run before
+// the task, the low priority tasks run after all the other waiting tasks.
+func (q *buildQueue) waitingAhead(t *task, match func(*task) bool) (n int) {
+	for el := q.queue.Front(); el != nil && el != t.el; el = el.Next() {
+		if _t, ok := el.Value.(*task); ok && !_t.inProcess && (t.lowPriority || !_t.lowPriority) && match(_t) {
+			n++
+		}
+	}
+	if !t.lowPriority {
+		return
+	}
+	for el := t.el.Next(); el != nil; el = el.Next() {
+		if _t, ok := el.Value.(*task); ok && !_t.inProcess && !_t.lowPriority && match(_t) {
+			n++
+		}
+	}
+	return
+}
+
 func (q *buildQueue) next() {
 	var nextTask *task
 	if len(q.current) < q.maxProcesses {
 		for el := q.queue.Front(); el != nil; el = el.Next() {
 			t, ok := el.Value.(*task)
-			if ok && !t.inProcess {
-				nextTask = t
-				break
+			// the task waits for the running builds of its package
+			if ok && !t.inProcess && !q.packageBusy(t.pkg.name) {
+				if !t.lowPriority {
+					nextTask = t
+					break
+				}
+				if nextTask == nil {
+					nextTask = t
+				}
 			}
 		}
 	}
@@ -94,6 +193,21 @@ func (q *buildQueue) next() {
 	q.lock.Lock()
 }
 
+// packageBusy returns true if the in-process tasks of the package reach the
+// `maxPackageBuilds` limit.
+func (q *buildQueue) packageBusy(name string) bool {
+	if q.maxPackageBuilds <= 0 {
+		return false
+	}
+	n := 0
+	for _, t := range q.current {
+		if t.pkg.name == name {
+			n++
+		}
+	}
+	return n >= q.maxPackageBuilds
+}
+
 func (q *buildQueue) wait(t *task) {
 	t.startTime = time.Now()
 	esm, pkgCSS, err := t.buildESM()
@@ -110,11 +224,18 @@ func (q *buildQueue) wait(t *task) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	if d := time.Now().Sub(t.startTime); q.avgBuildTime == 0 {
+		q.avgBuildTime = d
+	} else {
+		q.avgBuildTime = (q.avgBuildTime*4 + d) / 5
+	}
+
 	for _, c := range t.consumers {
 		c <- &buildOutput{
 			esm:    esm,
 			pkgCSS: pkgCSS,
 			err:    err,
+			logID:  t.logID,
 		}
 	}
 
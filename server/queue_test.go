@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildQueuePosition(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{}
+	// no task runs with zero processes
+	q := newBuildQueue(0, 0)
+	a := &buildTask{pkg: pkg{name: "a", version: "1.0.0"}, target: "es2020"}
+	b := &buildTask{pkg: pkg{name: "b", version: "1.0.0"}, target: "es2020"}
+	c := &buildTask{pkg: pkg{name: "c", version: "1.0.0"}, target: "es2020"}
+	q.AddLowPriority(a)
+	q.Add(b)
+	q.Add(c)
+
+	for task, expected := range map[*buildTask]int{a: 2, b: 0, c: 1} {
+		position, ok := q.Position(task.ID())
+		if !ok || position != expected {
+			t.Fatalf("unexpected position of %s: %d", task.pkg.name, position)
+		}
+	}
+	if _, ok := q.Position("v1/unknown@1.0.0/es2020/unknown.js"); ok {
+		t.Fatal("unknown task should not be found")
+	}
+}
+
+func TestBuildQueueEstimatedWait(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{}
+	// no task runs with zero processes, then the limits are set to estimate
+	q := newBuildQueue(0, 0)
+	var tasks []*buildTask
+	for _, name := range []string{"a", "a", "b", "c", "d"} {
+		task := &buildTask{pkg: pkg{name: name, version: fmt.Sprintf("1.0.%d", len(tasks))}, target: "es2020"}
+		q.Add(task)
+		tasks = append(tasks, task)
+	}
+	q.maxProcesses = 2
+	q.maxPackageBuilds = 1
+	if wait := q.EstimatedWait(tasks[0].ID()); wait != 0 {
+		t.Fatalf("the wait should be 0 without the build durations, got %v", wait)
+	}
+	q.avgBuildTime = 10 * time.Second
+
+	// the second `a` waits for its sibling, `d` waits for two rounds of two processes
+	for i, expected := range []time.Duration{10, 20, 20, 20, 30} {
+		if wait := q.EstimatedWait(tasks[i].ID()); wait != expected*time.Second {
+			t.Fatalf("unexpected wait of the task %d: %v", i, wait)
+		}
+	}
+	if wait := q.EstimatedWait("v1/unknown@1.0.0/es2020/unknown.js"); wait != 0 {
+		t.Fatalf("unexpected wait of unknown task: %v", wait)
+	}
+}
+
+// blockingInstaller blocks the installs until they are released, that keeps
+// the builds in process.
+type blockingInstaller struct {
+	*fixtures
+	started chan string
+	release chan struct{}
+}
+
+func (b *blockingInstaller) Install(ctx context.Context, wd string, packages ...string) error {
+	b.started <- packages[0]
+	<-b.release
+	return b.fixtures.Install(ctx, wd, packages...)
+}
+
+func TestBuildQueuePackageLimit(t *testing.T) {
+	f := newFixtures()
+	for _, p := range []NpmPackage{
+		{Name: "fixture-matrix", Version: "1.0.0"},
+		{Name: "fixture-matrix", Version: "2.0.0"},
+		{Name: "fixture-other", Version: "1.0.0"},
+	} {
+		p.Type = "module"
+		p.Module = "index.js"
+		f.add(p, map[string]string{"index.js": `export default 1`})
+	}
+	useFixtures(t, f)
+	installer := &blockingInstaller{f, make(chan string, 3), make(chan struct{})}
+	config.installer = installer
+
+	q := newBuildQueue(2, 1)
+	var outputs []chan *buildOutput
+	for _, p := range []pkg{{name: "fixture-matrix", version: "1.0.0"}, {name: "fixture-matrix", version: "2.0.0"}, {name: "fixture-other", version: "1.0.0"}} {
+		outputs = append(outputs, q.Add(&buildTask{pkg: p, target: "es2020"}))
+	}
+
+	started := []string{<-installer.started, <-installer.started}
+	sort.Strings(started)
+	if strings.Join(started, ",") != "fixture-matrix@1.0.0,fixture-other@1.0.0" {
+		t.Fatalf("the other package should not wait for the siblings, started %v", started)
+	}
+	select {
+	case name := <-installer.started:
+		t.Fatalf("%s should wait for its sibling", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	installer.release <- struct{}{}
+	installer.release <- struct{}{}
+	if name := <-installer.started; name != "fixture-matrix@2.0.0" {
+		t.Fatalf("unexpected started build %s", name)
+	}
+	installer.release <- struct{}{}
+	for _, c := range outputs {
+		if output := <-c; output.err != nil {
+			t.Fatal(output.err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the number of calls of every client in a fixed time window.
+type rateLimiter struct {
+	lock   sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		start:  time.Now(),
+		counts: map[string]int{},
+	}
+}
+
+// Allow reports whether the client can make a call, returns the duration to wait
+// until the next window if it can't. A nil limiter always allows.
+func (l *rateLimiter) Allow(client string) (bool, time.Duration) {
+	if l == nil || l.limit <= 0 {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	elapsed := time.Since(l.start)
+	if elapsed >= l.window {
+		l.start = time.Now()
+		l.counts = map[string]int{}
+		elapsed = 0
+	}
+	if l.counts[client] >= l.limit {
+		return false, l.window - elapsed
+	}
+	l.counts[client]++
+	return true, 0
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("1.1.1.1"); !ok {
+			t.Fatal("should allow the calls under the limit")
+		}
+	}
+	ok, retryAfter := l.Allow("1.1.1.1")
+	if ok || retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Fatalf("should reject the call over the limit, got %v %v", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("2.2.2.2"); !ok {
+		t.Fatal("other clients should not be limited")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := l.Allow("1.1.1.1"); !ok {
+		t.Fatal("should allow the calls in the next window")
+	}
+
+	var nl *rateLimiter
+	if ok, _ := nl.Allow("1.1.1.1"); !ok {
+		t.Fatal("nil limiter should always allow")
+	}
+}
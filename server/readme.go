@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// readmeNames are the filenames of the README in the order of preference, they
+// are matched case-insensitively like npm does.
+var readmeNames = []string{"readme.md", "readme.markdown", "readme", "readme.txt"}
+
+// getReadme returns the README of the package, the package is installed if the
+// README is not cached. The README is empty if the package has no README, that
+// is cached too.
+func getReadme(pkg pkg) (readme []byte, err error) {
+	filename := path.Join("readme", fmt.Sprintf("%s@%s.md", pkg.name, pkg.version))
+	if r, e := getStorage().Get(filename); e == nil {
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	wd, err := ioutil.TempDir("", "esm-readme-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(wd)
+
+	ctx, cancel := withBuildTimeout()
+	defer cancel()
+	err = getInstaller().Install(ctx, wd, fmt.Sprintf("%s@%s", pkg.name, pkg.version))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = withKind(ErrBuildTimeout, fmt.Errorf("install timeout after %v", config.buildTimeout))
+		}
+		return
+	}
+
+	readme, err = findReadme(path.Join(wd, "node_modules", pkg.name))
+	if err != nil {
+		return
+	}
+	err = getStorage().Put(filename, bytes.NewReader(readme))
+	return
+}
+
+// findReadme reads the README in the package dir, returns nil if not found.
+func findReadme(pkgDir string) ([]byte, error) {
+	entries, err := ioutil.ReadDir(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files[strings.ToLower(entry.Name())] = entry.Name()
+		}
+	}
+	for _, name := range readmeNames {
+		if filename, ok := files[name]; ok {
+			return ioutil.ReadFile(path.Join(pkgDir, filename))
+		}
+	}
+	return nil, nil
+}
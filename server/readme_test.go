@@ -0,0 +1,39 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetReadme(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-docs", Version: "1.0.0", Main: "index.js"}, map[string]string{
+		"index.js":  `module.exports = 1`,
+		"Readme.md": "# fixture-docs\n",
+		"readme":    "plain readme",
+	})
+	f.add(NpmPackage{Name: "fixture-nodocs", Version: "1.0.0", Main: "index.js"}, map[string]string{
+		"index.js": `module.exports = 1`,
+	})
+	useFixtures(t, f)
+
+	readme, err := getReadme(pkg{name: "fixture-docs", version: "1.0.0"})
+	if err != nil || string(readme) != "# fixture-docs\n" {
+		t.Fatalf("unexpected README %q: %v", readme, err)
+	}
+	readme, err = getReadme(pkg{name: "fixture-nodocs", version: "1.0.0"})
+	if err != nil || len(readme) != 0 {
+		t.Fatalf("unexpected README %q: %v", readme, err)
+	}
+
+	// the READMEs are cached, including the missing ones
+	f.installed = nil
+	for _, name := range []string{"fixture-docs", "fixture-nodocs"} {
+		if _, err = getReadme(pkg{name: name, version: "1.0.0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.installed) != 0 {
+		t.Fatalf("the cached READMEs should not install the packages again, installed %s", strings.Join(f.installed, ","))
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+)
+
+// Registry gets the metadata of the packages, the name may contain a submodule
+// like `react-dom/server`, and the version can be a full version, a range or a
+// dist-tag. The `ErrPackageNotFound` kind is returned if the package or the
+// version doesn't exist.
+type Registry interface {
+	PackageInfo(name string, version string) (info NpmPackage, submodule string, err error)
+}
+
+// Installer installs the packages like `react@17.0.2` into the `node_modules`
+// of the dir, the install should be stopped when the context is done.
+type Installer interface {
+	Install(ctx context.Context, wd string, packages ...string) error
+}
+
+// getRegistry returns the registry of the server, it's the npm registry of the
+// nodejs env by default.
+func getRegistry() Registry {
+	if config.registry != nil {
+		return config.registry
+	}
+	return node
+}
+
+// getInstaller returns the installer of the server, it's yarn by default.
+func getInstaller() Installer {
+	if config.installer != nil {
+		return config.installer
+	}
+	return yarnInstaller{}
+}
+
+// yarnInstaller installs the packages by `yarn add`.
+type yarnInstaller struct{}
+
+func (yarnInstaller) Install(ctx context.Context, wd string, packages ...string) error {
+	return yarnAddContext(ctx, wd, packages...)
+}
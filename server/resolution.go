@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PlatformEntry specifies how the entry of a package is resolved for a platform,
+// the fields of `package.json` and the conditions of the `exports` field are
+// matched in order. The empty main fields enforce the `exports` field.
+type PlatformEntry struct {
+	MainFields []string `json:"mainFields,omitempty"`
+	Conditions []string `json:"conditions,omitempty"`
+}
+
+// EntryResolution specifies the entry resolution of the packages, it's loaded
+// from the `entry-resolution-file`, the omitted parts keep the defaults.
+type EntryResolution struct {
+	Browser *PlatformEntry `json:"browser,omitempty"`
+	Deno    *PlatformEntry `json:"deno,omitempty"`
+	Node    *PlatformEntry `json:"node,omitempty"`
+	// the fields of the declaration file, `types` and `typings`
+	Types []string `json:"types,omitempty"`
+}
+
+var defaultEntryResolution = EntryResolution{
+	Browser: &PlatformEntry{MainFields: []string{"browser", "module", "main"}},
+	Deno:    &PlatformEntry{MainFields: []string{"module", "main"}},
+	Node:    &PlatformEntry{MainFields: []string{"module", "main"}, Conditions: []string{"node"}},
+	Types:   []string{"types", "typings"},
+}
+
+// platformEntry returns the entry resolution of the platform(`browser`, `deno`
+// or `node`), the receiver may be nil.
+func (r *EntryResolution) platformEntry(platform string) PlatformEntry {
+	var entry, def *PlatformEntry
+	switch platform {
+	case "node":
+		def = defaultEntryResolution.Node
+		if r != nil {
+			entry = r.Node
+		}
+	case "deno":
+		def = defaultEntryResolution.Deno
+		if r != nil {
+			entry = r.Deno
+		}
+	default:
+		def = defaultEntryResolution.Browser
+		if r != nil {
+			entry = r.Browser
+		}
+	}
+	ret := *def
+	if entry != nil {
+		if entry.MainFields != nil {
+			ret.MainFields = entry.MainFields
+		}
+		if entry.Conditions != nil {
+			ret.Conditions = entry.Conditions
+		}
+	}
+	return ret
+}
+
+// typesFields returns the fields of the declaration file in order, the receiver
+// may be nil.
+func (r *EntryResolution) typesFields() []string {
+	if r != nil && r.Types != nil {
+		return r.Types
+	}
+	return defaultEntryResolution.Types
+}
+
+func (r *EntryResolution) validate() error {
+	if r.Types != nil && len(r.Types) == 0 {
+		return errors.New("the types fields can't be empty")
+	}
+	for _, name := range r.Types {
+		if name != "types" && name != "typings" {
+			return fmt.Errorf("invalid types field '%s'", name)
+		}
+	}
+	return nil
+}
+
+// getTypesField returns the declaration file of the package by the types fields.
+func getTypesField(p NpmPackage) string {
+	for _, name := range config.entryResolution.typesFields() {
+		if name == "types" && p.Types != "" {
+			return p.Types
+		}
+		if name == "typings" && p.Typings != "" {
+			return p.Typings
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPlatformEntry(t *testing.T) {
+	var r *EntryResolution
+	for platform, fields := range map[string]string{
+		"browser": "browser,module,main",
+		"deno":    "module,main",
+		"node":    "module,main",
+	} {
+		if s := strings.Join(r.platformEntry(platform).MainFields, ","); s != fields {
+			t.Fatalf("unexpected main fields of %s: %s", platform, s)
+		}
+	}
+	if s := strings.Join(r.platformEntry("node").Conditions, ","); s != "node" {
+		t.Fatalf("unexpected conditions of node: %s", s)
+	}
+
+	r = &EntryResolution{
+		Browser: &PlatformEntry{MainFields: []string{"module", "main"}},
+		Node:    &PlatformEntry{Conditions: []string{}},
+	}
+	if s := strings.Join(r.platformEntry("browser").MainFields, ","); s != "module,main" {
+		t.Fatalf("unexpected main fields of browser: %s", s)
+	}
+	if s := strings.Join(r.platformEntry("node").MainFields, ","); s != "module,main" {
+		t.Fatalf("the omitted main fields should keep the default: %s", s)
+	}
+	if c := r.platformEntry("node").Conditions; len(c) != 0 {
+		t.Fatalf("unexpected conditions of node: %v", c)
+	}
+	if defaultEntryResolution.Node.Conditions[0] != "node" {
+		t.Fatal("the default resolution should not be changed")
+	}
+}
+
+func TestEntryResolutionValidate(t *testing.T) {
+	for _, r := range []EntryResolution{
+		{Types: []string{}},
+		{Types: []string{"main"}},
+	} {
+		if r.validate() == nil {
+			t.Fatalf("invalid resolution %+v passed the validation", r)
+		}
+	}
+	r := EntryResolution{Deno: &PlatformEntry{MainFields: []string{"browser", "main"}}, Types: []string{"typings"}}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	r = EntryResolution{Browser: &PlatformEntry{MainFields: []string{}}}
+	if err := r.validate(); err != nil {
+		t.Fatalf("the empty main fields should enforce the exports field: %v", err)
+	}
+}
+
+func TestExportsOnlyEntry(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testexportsonlyentry")
+	os.RemoveAll(testDir)
+	pkgDir := path.Join(testDir, "node_modules", "fixture")
+	ensureDir(pkgDir)
+	if err := ioutil.WriteFile(path.Join(pkgDir, "index.js"), []byte("export default 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{entryResolution: &EntryResolution{Browser: &PlatformEntry{MainFields: []string{}}}}
+	task := &buildTask{wd: testDir, pkg: pkg{name: "fixture", version: "1.0.0"}, target: "es2020"}
+	err := task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "index.js"}})
+	if !errors.Is(err, ErrUnsupportedPackage) {
+		t.Fatalf("the package without the exports field should be unsupported, got %v", err)
+	}
+	if err := task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "index.js", DefinedExports: "./index.js"}}); err != nil {
+		t.Fatal(err)
+	}
+	// the other platforms keep the main fields
+	task.target = "deno"
+	if err := task.checkEntry(&ESMeta{NpmPackage: &NpmPackage{Main: "index.js"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTypesField(t *testing.T) {
+	config = &Config{}
+	defer func() { config.entryResolution = nil }()
+	p := NpmPackage{Types: "index.d.ts", Typings: "typings.d.ts"}
+	if s := getTypesField(p); s != "index.d.ts" {
+		t.Fatalf("unexpected types %s", s)
+	}
+	config.entryResolution = &EntryResolution{Types: []string{"typings", "types"}}
+	if s := getTypesField(p); s != "typings.d.ts" {
+		t.Fatalf("unexpected types %s", s)
+	}
+	config.entryResolution = &EntryResolution{Types: []string{"typings"}}
+	if s := getTypesField(NpmPackage{Types: "index.d.ts"}); s != "" {
+		t.Fatalf("unexpected types %s", s)
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// semver is a parsed version like `1.2.3-beta.1`, the build metadata is dropped.
+type semver struct {
+	major int
+	minor int
+	patch int
+	pre   string
+}
+
+type semverComparator struct {
+	op string
+	v  semver
+}
+
+// parseSemver parses the full version, a leading `v` or `=` is allowed.
+func parseSemver(s string) (v semver, ok bool) {
+	parts, n, pre := parsePartialVersion(s)
+	if n != 3 {
+		return
+	}
+	return semver{parts[0], parts[1], parts[2], pre}, true
+}
+
+// parsePartialVersion parses the version that may miss the minor and the patch
+// parts, like `1.2`, the `x`, `X` and `*` parts are treated as missing.
+// The n is -1 if the version is invalid.
+func parsePartialVersion(s string) (parts [3]int, n int, pre string) {
+	s = strings.TrimLeft(strings.TrimSpace(s), "=v")
+	s, _ = utils.SplitByFirstByte(s, '+')
+	s, pre = utils.SplitByFirstByte(s, '-')
+	if s == "" || s == "x" || s == "X" || s == "*" {
+		return
+	}
+	for i, p := range strings.Split(s, ".") {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		num, err := strconv.Atoi(p)
+		if i > 2 || err != nil || num < 0 {
+			n = -1
+			return
+		}
+		parts[i] = num
+		n = i + 1
+	}
+	if n < 3 {
+		pre = ""
+	}
+	return
+}
+
+// sortVersions sorts the versions in the ascending order of semver, the
+// invalid versions are put at the end in the string order.
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		a, aok := parseSemver(versions[i])
+		b, bok := parseSemver(versions[j])
+		if aok && bok {
+			return compareSemver(a, b) < 0
+		}
+		if aok != bok {
+			return aok
+		}
+		return versions[i] < versions[j]
+	})
+}
+
+// compareSemver returns -1, 0 or 1 like the `semver.compare` of npm, the
+// prerelease versions are lower than the release of the same version.
+func compareSemver(a semver, b semver) int {
+	for _, d := range []int{a.major - b.major, a.minor - b.minor, a.patch - b.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	if a.pre == b.pre {
+		return 0
+	}
+	if a.pre == "" {
+		return 1
+	}
+	if b.pre == "" {
+		return -1
+	}
+	ap := strings.Split(a.pre, ".")
+	bp := strings.Split(b.pre, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if ap[i] == bp[i] {
+			continue
+		}
+		an, aErr := strconv.Atoi(ap[i])
+		bn, bErr := strconv.Atoi(bp[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case aErr == nil:
+			// the numeric identifiers are lower than the alphanumeric ones
+			return -1
+		case bErr == nil:
+			return 1
+		case ap[i] < bp[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	if len(ap) < len(bp) {
+		return -1
+	}
+	if len(ap) > len(bp) {
+		return 1
+	}
+	return 0
+}
+
+// parseSemverRange parses the npm version range to the comparator sets of the
+// `||` unions, it supports the comparators(`>`, `>=`, `<`, `<=`, `=`), the
+// caret and tilde ranges, the x-ranges like `1.2.x` and the hyphen ranges like
+// `1.2.3 - 2.3.4`.
+func parseSemverRange(r string) (sets [][]semverComparator, ok bool) {
+	for _, or := range strings.Split(r, "||") {
+		fields := strings.Fields(or)
+		// join the operators separated from the versions by spaces, like `>= 1.2.3`
+		tokens := []string{}
+		for i := 0; i < len(fields); i++ {
+			f := fields[i]
+			if strings.Trim(f, "<>=^~") == "" && i+1 < len(fields) {
+				f += fields[i+1]
+				i++
+			}
+			tokens = append(tokens, f)
+		}
+		set := []semverComparator{}
+		if len(tokens) == 3 && tokens[1] == "-" {
+			low, ok := expandSemverRange(">=" + tokens[0])
+			if !ok {
+				return nil, false
+			}
+			high, ok := expandSemverRange("<=" + tokens[2])
+			if !ok {
+				return nil, false
+			}
+			set = append(append(set, low...), high...)
+		} else {
+			for _, t := range tokens {
+				c, ok := expandSemverRange(t)
+				if !ok {
+					return nil, false
+				}
+				set = append(set, c...)
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets, true
+}
+
+// expandSemverRange expands a single range token to the primitive comparators.
+func expandSemverRange(t string) ([]semverComparator, bool) {
+	op := ""
+	for _, o := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(t, o) {
+			op = o
+			break
+		}
+	}
+	parts, n, pre := parsePartialVersion(t[len(op):])
+	if n < 0 {
+		return nil, false
+	}
+	major, minor, patch := parts[0], parts[1], parts[2]
+	v := semver{major, minor, patch, pre}
+	// the upper bound excludes the prereleases of the next version, like `<2.0.0-0`
+	upper := func(major int, minor int, patch int) semverComparator {
+		return semverComparator{"<", semver{major, minor, patch, "0"}}
+	}
+	anyVersion := []semverComparator{{">=", semver{}}}
+	switch op {
+	case "^":
+		switch {
+		case n == 0:
+			return anyVersion, true
+		case major > 0 || n == 1:
+			return []semverComparator{{">=", v}, upper(major+1, 0, 0)}, true
+		case minor > 0 || n == 2:
+			return []semverComparator{{">=", v}, upper(0, minor+1, 0)}, true
+		default:
+			return []semverComparator{{">=", v}, upper(0, 0, patch+1)}, true
+		}
+	case "~":
+		switch {
+		case n == 0:
+			return anyVersion, true
+		case n == 1:
+			return []semverComparator{{">=", v}, upper(major+1, 0, 0)}, true
+		default:
+			return []semverComparator{{">=", v}, upper(major, minor+1, 0)}, true
+		}
+	case ">":
+		switch n {
+		case 0:
+			// nothing is greater than any version
+			return []semverComparator{{"<", semver{}}}, true
+		case 1:
+			return []semverComparator{{">=", semver{major + 1, 0, 0, ""}}}, true
+		case 2:
+			return []semverComparator{{">=", semver{major, minor + 1, 0, ""}}}, true
+		}
+		return []semverComparator{{">", v}}, true
+	case ">=":
+		return []semverComparator{{">=", v}}, true
+	case "<":
+		if n < 3 {
+			return []semverComparator{upper(major, minor, 0)}, true
+		}
+		return []semverComparator{{"<", v}}, true
+	case "<=":
+		switch n {
+		case 0:
+			return anyVersion, true
+		case 1:
+			return []semverComparator{upper(major+1, 0, 0)}, true
+		case 2:
+			return []semverComparator{upper(major, minor+1, 0)}, true
+		}
+		return []semverComparator{{"<=", v}}, true
+	default:
+		switch n {
+		case 0:
+			return anyVersion, true
+		case 1:
+			return []semverComparator{{">=", v}, upper(major+1, 0, 0)}, true
+		case 2:
+			return []semverComparator{{">=", v}, upper(major, minor+1, 0)}, true
+		}
+		return []semverComparator{{"=", v}}, true
+	}
+}
+
+// satisfies checks if the version satisfies the comparator sets, a prerelease
+// version is only matched if a comparator of the set has the prerelease of the
+// same `major.minor.patch`, that is how npm does.
+func satisfies(v semver, sets [][]semverComparator) bool {
+	for _, set := range sets {
+		matched := true
+		preAllowed := v.pre == ""
+		for _, c := range set {
+			d := compareSemver(v, c.v)
+			switch c.op {
+			case ">":
+				matched = d > 0
+			case ">=":
+				matched = d >= 0
+			case "<":
+				matched = d < 0
+			case "<=":
+				matched = d <= 0
+			default:
+				matched = d == 0
+			}
+			if !matched {
+				break
+			}
+			if c.v.pre != "" && c.v.pre != "0" && c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+				preAllowed = true
+			}
+		}
+		if matched && preAllowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSatisfies(t *testing.T) {
+	for r, cases := range map[string]map[string]bool{
+		"^16.8.0":            {"16.8.0": true, "16.14.0": true, "17.0.2": false, "16.7.0": false, "17.0.0-rc.1": false},
+		"^0.3.1":             {"0.3.1": true, "0.3.9": true, "0.4.0": false},
+		"^0.0.3":             {"0.0.3": true, "0.0.4": false},
+		"~1.2.3":             {"1.2.9": true, "1.3.0": false},
+		">=16.8.0":           {"16.8.0": true, "18.0.0": true, "16.7.9": false},
+		">= 1.2 < 2":         {"1.2.0": true, "1.9.9": true, "2.0.0": false, "1.1.0": false},
+		"^16.8.0 || ^17.0.0": {"16.14.0": true, "17.0.2": true, "18.0.0": false},
+		"1.2.3 - 2.3":        {"1.2.3": true, "2.3.9": true, "2.4.0": false},
+		"1.x":                {"1.0.0": true, "1.9.0": true, "2.0.0": false},
+		"*":                  {"0.0.1": true, "18.0.0": true, "18.0.0-alpha.1": false},
+		"^18.0.0-rc.0":       {"18.0.0-rc.3": true, "18.0.0": true, "18.1.0-rc.0": false},
+	} {
+		sets, ok := parseSemverRange(r)
+		if !ok {
+			t.Fatalf("invalid range '%s'", r)
+		}
+		for version, expected := range cases {
+			v, ok := parseSemver(version)
+			if !ok {
+				t.Fatalf("invalid version '%s'", version)
+			}
+			if satisfies(v, sets) != expected {
+				t.Fatalf("'%s' satisfies '%s': expected %v", version, r, expected)
+			}
+		}
+	}
+	if _, ok := parseSemverRange("next"); ok {
+		t.Fatal("the dist-tag should not be a range")
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	versions := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0"}
+	for i := 1; i < len(versions); i++ {
+		a, _ := parseSemver(versions[i-1])
+		b, _ := parseSemver(versions[i])
+		if compareSemver(a, b) != -1 || compareSemver(b, a) != 1 {
+			t.Fatalf("expected %s < %s", versions[i-1], versions[i])
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []string{"1.10.0", "invalid", "1.2.0", "1.0.0", "1.2.0-rc.1", "10.0.0", "2.0.0"}
+	sortVersions(versions)
+	if strings.Join(versions, ",") != "1.0.0,1.2.0-rc.1,1.2.0,1.10.0,2.0.0,10.0.0,invalid" {
+		t.Fatalf("unexpected order %v", versions)
+	}
+}
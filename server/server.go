@@ -1,17 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"embed"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	logx "github.com/ije/gox/log"
+	"github.com/ije/gox/utils"
 	"github.com/ije/rex"
 	"github.com/oschwald/maxminddb-golang"
 	"github.com/postui/postdb"
@@ -24,15 +28,62 @@ var (
 	db      *postdb.DB
 	log     *logx.Logger
 	embedFS *embed.FS
+	// guards the npm registry calls, nil means disabled
+	registryBreaker *circuitBreaker
+	// limit the module requests and the fresh builds of every client, nil means no limit
+	requestLimiter *rateLimiter
+	buildLimiter   *rateLimiter
+	// limits the concurrent yarn/node processes of all the builds, nil means no limit
+	processSlots chan struct{}
+	// caches the hot build files in memory, nil means disabled
+	artifactCache *lruCache
 )
 
 // Server Config
 type Config struct {
-	storageDir     string
-	domain         string
-	cdnDomain      string
-	cdnDomainChina string
-	unpkgDomain    string
+	storageDir        string
+	storage           Storage
+	domain            string
+	basePath          string
+	cdnDomain         string
+	cdnDomainChina    string
+	unpkgDomain       string
+	sharedStorage     bool
+	warmupPackages    []string
+	warmupTargets     []string
+	warmupDev         bool
+	maxResolveRetries int
+	globalExternals   []string
+	globalExternalURL string
+	installScripts    []string
+	integrity         map[string]string
+	buildTimeout      time.Duration
+	buildOverrides    map[string]BuildOverride
+	presets           map[string]Preset
+	entryResolution   *EntryResolution
+	// the registry and the installer of the packages, the npm registry and yarn
+	// are used if they are nil
+	registry          Registry
+	installer         Installer
+	npmRegistry       string
+	npmFallback       bool
+	defaultTarget     string
+	defaultDev        bool
+	banner            string
+	footer            string
+	buildLogRetention time.Duration
+	adminToken        string
+	targetFallback    bool
+	resolveCacheTTL   time.Duration
+	contentHash       bool
+	signingKey        ed25519.PrivateKey
+	localPackagesDir  string
+	maxBatchSize      int
+	maxPackageBuilds  int
+	registryTimeout   time.Duration
+	registryUserAgent string
+	registryRetries   int
+	keepBuildDir      bool
 }
 
 // Serve serves esmd server
@@ -41,20 +92,100 @@ func Serve(fs *embed.FS) {
 	var httpsPort int
 	var etcDir string
 	var domain string
+	var basePath string
 	var cdnDomain string
 	var cdnDomainChina string
 	var unpkgDomain string
 	var logLevel string
+	var sharedStorage bool
+	var warmupPackages string
+	var warmupTargets string
+	var warmupDev bool
+	var maxResolveRetries int
+	var globalExternals string
+	var globalExternalURL string
+	var installScripts string
+	var integrityFile string
+	var buildOverridesFile string
+	var presetsFile string
+	var entryResolutionFile string
+	var npmRegistry string
+	var npmFallback bool
+	var defaultTarget string
+	var defaultDev bool
+	var banner string
+	var footer string
+	var breakerThreshold int
+	var breakerCoolDown time.Duration
+	var buildLogRetention time.Duration
+	var adminToken string
+	var targetFallback bool
+	var requestRateLimit int
+	var resolveCacheTTL time.Duration
+	var storageURL string
+	var maxProcesses int
+	var artifactCacheSize int64
+	var buildRateLimit int
+	var contentHash bool
+	var signingKeyFile string
+	var localPackagesDir string
+	var maxBatchSize int
+	var maxPackageBuilds int
+	var registryTimeout time.Duration
+	var registryUserAgent string
+	var registryRetries int
+	var keepBuildDir bool
+	var buildTimeout time.Duration
 	var isDev bool
 
 	flag.IntVar(&port, "port", 80, "http server port")
 	flag.IntVar(&httpsPort, "https-port", 443, "https server port")
 	flag.StringVar(&etcDir, "etc-dir", "/usr/local/etc/esmd", "etc dir")
 	flag.StringVar(&domain, "domain", "esm.sh", "main domain")
+	flag.StringVar(&basePath, "base-path", "", "the path prefix of the served import urls, like '/cdn' if the server is mounted under it behind a reverse proxy, the cached builds must be purged after changing it")
 	flag.StringVar(&cdnDomain, "cdn-domain", "", "cdn domain")
 	flag.StringVar(&cdnDomainChina, "cdn-domain-china", "", "cdn domain for china")
 	flag.StringVar(&unpkgDomain, "unpkg-domain", "", "proxy domain for unpkg.com")
 	flag.StringVar(&logLevel, "log", "info", "log level")
+	flag.BoolVar(&sharedStorage, "shared-storage", false, "the storage dir is shared by multiple server processes")
+	flag.StringVar(&warmupPackages, "warmup", "", "packages to build in background after startup, separated by commas")
+	flag.StringVar(&warmupTargets, "warmup-targets", "es2020,deno", "build targets of the warmup packages, separated by commas")
+	flag.BoolVar(&warmupDev, "warmup-dev", false, "build the development version of the warmup packages")
+	flag.IntVar(&maxResolveRetries, "max-resolve-retries", 5, "max times to rebuild when esbuild can't resolve some modules")
+	flag.StringVar(&globalExternals, "global-externals", "", "packages that are always external in all builds, separated by commas")
+	flag.StringVar(&globalExternalURL, "global-external-url", "", "import url template of the global externals, supports {name} and {version}")
+	flag.StringVar(&installScripts, "install-scripts", "", "trusted packages that are allowed to run the install scripts(like 'postinstall'), separated by commas")
+	flag.DurationVar(&buildTimeout, "build-timeout", 10*time.Minute, "max duration of a build, 0 means no limit")
+	flag.StringVar(&integrityFile, "integrity-file", "", "a json file maps 'name@version' to the expected integrity of installed packages")
+	flag.StringVar(&buildOverridesFile, "build-overrides-file", "", "a json file maps package name to the build overrides")
+	flag.StringVar(&presetsFile, "presets-file", "", "a json file maps preset name to the externals that the 'preset' query applies")
+	flag.StringVar(&entryResolutionFile, "entry-resolution-file", "", "a json file specifies the main fields and the conditions of each platform to resolve the package entries")
+	flag.StringVar(&npmRegistry, "npm-registry", "", "npm registry(mirror) url, defaults to the registry of npm config")
+	flag.BoolVar(&npmFallback, "npm-registry-fallback", false, "fall back to the public npm registry when the configured one fails")
+	flag.StringVar(&defaultTarget, "default-target", "es2015", "build target used when it can't be determined by the query or the user agent")
+	flag.BoolVar(&defaultDev, "default-dev", false, "build the development version when the request omits the dev query")
+	flag.StringVar(&banner, "banner", "", "text prepended to the js builds, like a license header")
+	flag.StringVar(&footer, "footer", "", "text appended to the js builds")
+	flag.IntVar(&breakerThreshold, "registry-breaker-threshold", 5, "consecutive npm registry failures to stop calling the registry, 0 to disable")
+	flag.DurationVar(&breakerCoolDown, "registry-breaker-cooldown", time.Minute, "duration to fast-fail the npm registry calls after the breaker trips")
+	flag.DurationVar(&buildLogRetention, "build-log-retention", 72*time.Hour, "duration to keep the logs of the failed builds")
+	flag.StringVar(&adminToken, "admin-token", "", "token to access the admin endpoints like '/build-log', the endpoints are disabled if it's empty")
+	flag.BoolVar(&targetFallback, "target-fallback", false, "retry with the lower targets when the build fails")
+	flag.Int64Var(&artifactCacheSize, "artifact-cache-size", 0, "max megabytes of the hot build files cached in memory, 0 to disable")
+	flag.IntVar(&maxProcesses, "max-processes", 0, "max concurrent yarn/node processes of all the builds, 0 means no limit")
+	flag.StringVar(&storageURL, "storage", "", "storage url of the build artifacts like 's3://bucket/prefix?region=us-east-1', defaults to the storage dir")
+	flag.DurationVar(&resolveCacheTTL, "resolve-cache-ttl", 10*time.Minute, "duration to cache the versions resolved from the semver ranges or tags")
+	flag.IntVar(&requestRateLimit, "rate-limit", 0, "max module requests per minute of a client, 0 means no limit")
+	flag.IntVar(&buildRateLimit, "build-rate-limit", 0, "max fresh builds per minute triggered by a client, 0 means no limit")
+	flag.BoolVar(&contentHash, "content-hash", false, "write the build files under the content hash filenames too, the module imports them")
+	flag.StringVar(&signingKeyFile, "signing-key-file", "", "a PEM file of the ed25519 private key to sign the build files, the signing is disabled if it's empty")
+	flag.StringVar(&localPackagesDir, "local-packages-dir", "", "dir of the local packages that the admin can build with the 'local' query, disabled if it's empty")
+	flag.IntVar(&maxBatchSize, "max-batch-size", 100, "max packages of a batch build request")
+	flag.IntVar(&maxPackageBuilds, "max-package-builds", 0, "max concurrent builds of the same package, the others wait in the queue, 0 means no limit")
+	flag.DurationVar(&registryTimeout, "registry-timeout", 30*time.Second, "timeout of a npm registry metadata request, 0 means no timeout")
+	flag.StringVar(&registryUserAgent, "registry-user-agent", fmt.Sprintf("esm.sh/v%d", VERSION), "user agent of the npm registry metadata requests")
+	flag.IntVar(&registryRetries, "registry-retries", 2, "times to retry a npm registry metadata request on the network errors and the 5xx responses")
+	flag.BoolVar(&keepBuildDir, "keep-build-dir", false, "keep the build dir of the failed builds for debugging, the path is logged")
 	flag.BoolVar(&isDev, "dev", false, "run server in development mode")
 	flag.Parse()
 
@@ -69,15 +200,121 @@ func Serve(fs *embed.FS) {
 	}
 
 	config = &Config{
-		storageDir:     path.Join(etcDir, "storage"),
-		domain:         domain,
-		cdnDomain:      cdnDomain,
-		cdnDomainChina: cdnDomainChina,
-		unpkgDomain:    unpkgDomain,
+		storageDir:        path.Join(etcDir, "storage"),
+		domain:            domain,
+		basePath:          strings.TrimSuffix("/"+strings.Trim(basePath, "/"), "/"),
+		cdnDomain:         cdnDomain,
+		cdnDomainChina:    cdnDomainChina,
+		unpkgDomain:       unpkgDomain,
+		sharedStorage:     sharedStorage,
+		warmupPackages:    splitList(warmupPackages),
+		warmupTargets:     splitList(warmupTargets),
+		warmupDev:         warmupDev,
+		maxResolveRetries: maxResolveRetries,
+		globalExternals:   splitList(globalExternals),
+		installScripts:    splitList(installScripts),
+		globalExternalURL: globalExternalURL,
+		integrity:         map[string]string{},
+		buildTimeout:      buildTimeout,
+		buildOverrides:    map[string]BuildOverride{},
+		presets:           map[string]Preset{},
+		npmRegistry:       npmRegistry,
+		npmFallback:       npmFallback,
+		defaultTarget:     defaultTarget,
+		defaultDev:        defaultDev,
+		banner:            banner,
+		footer:            footer,
+		buildLogRetention: buildLogRetention,
+		adminToken:        adminToken,
+		targetFallback:    targetFallback,
+		resolveCacheTTL:   resolveCacheTTL,
+		contentHash:       contentHash,
+		localPackagesDir:  localPackagesDir,
+		maxBatchSize:      maxBatchSize,
+		maxPackageBuilds:  maxPackageBuilds,
+		registryTimeout:   registryTimeout,
+		registryUserAgent: registryUserAgent,
+		registryRetries:   registryRetries,
+		keepBuildDir:      keepBuildDir,
 	}
 	embedFS = fs
+	registryBreaker = newCircuitBreaker(breakerThreshold, breakerCoolDown)
+	if requestRateLimit > 0 {
+		requestLimiter = newRateLimiter(requestRateLimit, time.Minute)
+	}
+	if buildRateLimit > 0 {
+		buildLimiter = newRateLimiter(buildRateLimit, time.Minute)
+	}
+	if maxProcesses > 0 {
+		processSlots = make(chan struct{}, maxProcesses)
+	}
+	if artifactCacheSize > 0 {
+		artifactCache = newLRUCache(artifactCacheSize << 20)
+	}
 
 	var err error
+	config.storage, err = newStorage(storageURL)
+	if err != nil {
+		fmt.Printf("initiate storage: %v\n", err)
+		os.Exit(1)
+	}
+	if integrityFile != "" {
+		err = utils.ParseJSONFile(integrityFile, &config.integrity)
+		if err != nil {
+			fmt.Printf("load integrity file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if buildOverridesFile != "" {
+		err = utils.ParseJSONFile(buildOverridesFile, &config.buildOverrides)
+		if err != nil {
+			fmt.Printf("load build overrides file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if signingKeyFile != "" {
+		config.signingKey, err = loadSigningKey(signingKeyFile)
+		if err != nil {
+			fmt.Printf("load signing key file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if presetsFile != "" {
+		err = utils.ParseJSONFile(presetsFile, &config.presets)
+		if err != nil {
+			fmt.Printf("load presets file: %v\n", err)
+			os.Exit(1)
+		}
+		for name := range config.presets {
+			if !regPresetName.MatchString(name) {
+				fmt.Printf("invalid preset name '%s'\n", name)
+				os.Exit(1)
+			}
+		}
+	}
+	if entryResolutionFile != "" {
+		var r EntryResolution
+		err = utils.ParseJSONFile(entryResolutionFile, &r)
+		if err == nil {
+			err = r.validate()
+		}
+		if err != nil {
+			fmt.Printf("load entry resolution file: %v\n", err)
+			os.Exit(1)
+		}
+		config.entryResolution = &r
+	}
+	if _, ok := targets[config.defaultTarget]; !ok {
+		fmt.Printf("invalid default target '%s'\n", config.defaultTarget)
+		os.Exit(1)
+	}
+	for _, target := range config.warmupTargets {
+		if _, ok := targets[target]; !ok {
+			fmt.Printf("invalid warmup target '%s'\n", target)
+			os.Exit(1)
+		}
+	}
+
 	log, err = logx.New(fmt.Sprintf("file:%s?buffer=32k", path.Join(logDir, "main.log")))
 	if err != nil {
 		fmt.Printf("initiate logger: %v\n", err)
@@ -94,6 +331,8 @@ func Serve(fs *embed.FS) {
 	ensureDir(path.Join(config.storageDir, fmt.Sprintf("builds/v%d", VERSION)))
 	ensureDir(path.Join(config.storageDir, fmt.Sprintf("types/v%d", VERSION)))
 	ensureDir(path.Join(config.storageDir, "raw"))
+	ensureDir(path.Join(config.storageDir, "logs"))
+	go cleanBuildLogs(config.buildLogRetention)
 
 	db, err = postdb.Open(path.Join(etcDir, "esm.db"), 0666)
 	if err != nil {
@@ -106,22 +345,35 @@ func Serve(fs *embed.FS) {
 	}
 	for _, entry := range polyfills {
 		name := entry.Name()
-		filename := path.Join(config.storageDir, fmt.Sprintf("builds/v%d/%s", VERSION, name))
-		if !fileExists(filename) {
+		filename := fmt.Sprintf("builds/v%d/%s", VERSION, name)
+		if !storageFileExists(filename) {
 			file, err := embedFS.Open(fmt.Sprintf("embed/polyfills/%s", name))
 			if err != nil {
 				log.Fatal(err)
 			}
-			f, err := os.Create(filename)
+			err = getStorage().Put(filename, file)
+			file.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Debugf("%s added", name)
+		}
+		// the systemjs builds import the systemjs variants of the polyfills
+		filename = systemjsPath(filename)
+		if !storageFileExists(filename) {
+			data, err := embedFS.ReadFile(fmt.Sprintf("embed/polyfills/%s", name))
 			if err != nil {
 				log.Fatal(err)
 			}
-			_, err = io.Copy(f, file)
-			f.Close()
+			code, err := systemjsModule(data, false)
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			err = getStorage().Put(filename, bytes.NewReader(code))
 			if err != nil {
 				log.Fatal(err)
 			}
-			log.Debugf("%s added", name)
+			log.Debugf("%s added", path.Base(filename))
 		}
 	}
 
@@ -131,18 +383,14 @@ func Serve(fs *embed.FS) {
 	}
 	for _, entry := range types {
 		name := entry.Name()
-		filename := path.Join(config.storageDir, fmt.Sprintf("types/v%d/%s", VERSION, name))
-		if !fileExists(filename) {
+		filename := fmt.Sprintf("types/v%d/%s", VERSION, name)
+		if !storageFileExists(filename) {
 			file, err := embedFS.Open(fmt.Sprintf("embed/types/%s", name))
 			if err != nil {
 				log.Fatal(err)
 			}
-			f, err := os.Create(filename)
-			if err != nil {
-				log.Fatal(err)
-			}
-			_, err = io.Copy(f, file)
-			f.Close()
+			err = getStorage().Put(filename, file)
+			file.Close()
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -171,7 +419,7 @@ func Serve(fs *embed.FS) {
 		rex.Header("Server", domain),
 		rex.Cors(rex.CORS{
 			AllowAllOrigins: true,
-			AllowMethods:    []string{"GET"},
+			AllowMethods:    []string{"GET", "POST"},
 			AllowHeaders:    []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding"},
 			MaxAge:          3600,
 		}),
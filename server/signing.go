@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// loadSigningKey loads the ed25519 private key of the PKCS #8 PEM file, like the
+// key generated by `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(filename string) (key ed25519.PrivateKey, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		err = errors.New("no PKCS #8 private key found")
+		return
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		err = errors.New("the signing key is not an ed25519 key")
+	}
+	return
+}
+
+// signingPublicKey returns the PEM encoded public key of the signing key, or
+// nil if the signing is disabled.
+func signingPublicKey() []byte {
+	if config.signingKey == nil {
+		return nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(config.signingKey.Public())
+	if err != nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// signBuild returns the raw ed25519 signature of the build file content, or nil
+// if the signing is disabled. The signature is over the exact bytes that are
+// served, that is the content hashed by the `contentHash` and the SRI.
+func signBuild(content ...[]byte) []byte {
+	if config.signingKey == nil {
+		return nil
+	}
+	n := 0
+	for _, b := range content {
+		n += len(b)
+	}
+	msg := make([]byte, 0, n)
+	for _, b := range content {
+		msg = append(msg, b...)
+	}
+	return ed25519.Sign(config.signingKey, msg)
+}
+
+// encodeSignature encodes the signature for the `X-Signature` header.
+func encodeSignature(sig []byte) string {
+	return "ed25519-" + base64.StdEncoding.EncodeToString(sig)
+}
+
+// buildSignature returns the encoded signature of the stored build file, the
+// `.mjs` copy shares the signature of the `.js` file. Returns empty string if
+// the build file is not signed.
+func buildSignature(filename string) string {
+	if strings.HasSuffix(filename, ".mjs") {
+		filename = strings.TrimSuffix(filename, ".mjs") + ".js"
+	}
+	r, err := getStorage().Get(filename + ".sig")
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	sig, err := ioutil.ReadAll(r)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ""
+	}
+	return encodeSignature(sig)
+}
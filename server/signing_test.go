@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoadSigningKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "esm-test-signing-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	f.Close()
+
+	loaded, err := loadSigningKey(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatal("the loaded key should equal the generated key")
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("not a key"), 0644)
+	if _, err = loadSigningKey(f.Name()); err == nil {
+		t.Fatal("the invalid key file should be rejected")
+	}
+}
+
+func TestBuildSigning(t *testing.T) {
+	f := newFixtures()
+	f.add(NpmPackage{Name: "fixture-signed", Version: "1.0.0", Type: "module", Module: "index.js"}, map[string]string{
+		"index.js": `export const signed = true;`,
+	})
+	useFixtures(t, f)
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.signingKey = key
+	config.contentHash = true
+
+	task := &buildTask{pkg: pkg{name: "fixture-signed", version: "1.0.0"}, target: "es2020"}
+	esm, _, err := task.buildESM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) []byte {
+		r, err := getStorage().Get(path.Join("builds", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	code := read(task.ID() + ".js")
+	sig := read(task.ID() + ".js.sig")
+	if !ed25519.Verify(pub, code, sig) {
+		t.Fatal("the signature should be verified by the public key")
+	}
+	if !ed25519.Verify(pub, read(strings.TrimPrefix(esm.HashedPath, "/")), read(strings.TrimPrefix(esm.HashedPath, "/")+".sig")) {
+		t.Fatal("the content-addressed copy should be signed too")
+	}
+	if ed25519.Verify(pub, append(code, ';'), sig) {
+		t.Fatal("the tampered build should not be verified")
+	}
+	if s := buildSignature(path.Join("builds", task.ID()+".mjs")); s != "ed25519-"+base64.StdEncoding.EncodeToString(sig) {
+		t.Fatalf("unexpected signature header %s", s)
+	}
+	block, _ := pem.Decode(signingPublicKey())
+	if block == nil || block.Type != "PUBLIC KEY" {
+		t.Fatal("the public key should be PEM encoded")
+	}
+
+	config.signingKey = nil
+	if signBuild(code) != nil || signingPublicKey() != nil {
+		t.Fatal("the signing should be disabled without the key")
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage stores the build artifacts like the build files and the declaration
+// files, a name is a slash-separated path relative to the storage root, like
+// `builds/v43/react@17.0.2/es2020/react.js`. The `Get`/`Stat` methods return
+// an error that `os.IsNotExist` reports if the file is not found.
+type Storage interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	Delete(name string) error
+}
+
+// getStorage returns the storage of the server, it's the local storage dir by default.
+func getStorage() Storage {
+	var s Storage = localStorage(config.storageDir)
+	if config.storage != nil {
+		s = config.storage
+	}
+	if artifactCache != nil {
+		return cachingStorage{s, artifactCache}
+	}
+	return s
+}
+
+// storageFileExists checks if the file exists in the storage.
+func storageFileExists(name string) bool {
+	fi, err := getStorage().Stat(name)
+	return err == nil && !fi.IsDir()
+}
+
+// newStorage creates a storage by the url, like `s3://bucket/prefix?region=us-east-1`,
+// the credentials of s3 are read from the `AWS_ACCESS_KEY_ID` and the
+// `AWS_SECRET_ACCESS_KEY` environment variables. The local storage dir is used
+// if the url is empty.
+func newStorage(storageURL string) (Storage, error) {
+	if storageURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return localStorage(u.Path), nil
+	case "s3":
+		s := &s3Storage{
+			endpoint:  u.Query().Get("endpoint"),
+			region:    u.Query().Get("region"),
+			bucket:    u.Host,
+			prefix:    strings.Trim(u.Path, "/"),
+			accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if s.endpoint == "" {
+			s.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+		}
+		s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+		if s.bucket == "" {
+			return nil, errors.New("missing s3 bucket")
+		}
+		if s.accessKey == "" || s.secretKey == "" {
+			return nil, errors.New("missing s3 credentials")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage '%s'", u.Scheme)
+	}
+}
+
+// localStorage stores the files in the local dir.
+type localStorage string
+
+func (s localStorage) Put(name string, r io.Reader) error {
+	return writeFileAtomic(path.Join(string(s), name), r)
+}
+
+func (s localStorage) Get(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(string(s), name))
+}
+
+func (s localStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(path.Join(string(s), name))
+}
+
+func (s localStorage) Delete(name string) error {
+	err := os.Remove(path.Join(string(s), name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// cachingStorage invalidates the cached content of the files that are changed.
+type cachingStorage struct {
+	Storage
+	cache *lruCache
+}
+
+func (s cachingStorage) Put(name string, r io.Reader) error {
+	defer s.cache.Delete(name)
+	return s.Storage.Put(name, r)
+}
+
+func (s cachingStorage) Delete(name string) error {
+	defer s.cache.Delete(name)
+	return s.Storage.Delete(name)
+}
+
+// s3Storage stores the files in a bucket of the s3 compatible service, the
+// requests are signed with the AWS signature version 4.
+type s3Storage struct {
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return false }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+
+func (s *s3Storage) Put(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Stat(name string) (os.FileInfo, error) {
+	resp, err := s.do("HEAD", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3FileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	resp, err := s.do("DELETE", name, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) do(method string, name string, body []byte) (resp *http.Response, err error) {
+	key := path.Join(s.prefix, name)
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, s3EscapePath(key)), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	s3SignRequest(req, body, s.accessKey, s.secretKey, s.region, time.Now())
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: name, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		ret, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s %s", method, key, resp.Status, string(ret))
+	}
+	return
+}
+
+// s3EscapePath escapes the path as the AWS signature version 4 requires, the
+// unreserved characters and the slashes are kept.
+func s3EscapePath(p string) string {
+	buf := strings.Builder{}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3SignRequest signs the request with the AWS signature version 4, all the
+// headers of the request are signed.
+func s3SignRequest(req *http.Request, body []byte, accessKey string, secretKey string, region string, now time.Time) {
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	hash = sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+secretKey), date), region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/utils"
+)
+
+// systemjsPath returns the path of the SystemJS variant of the build file,
+// like `/v43/node_process.systemjs.js` of `/v43/node_process.js`.
+func systemjsPath(importPath string) string {
+	return strings.TrimSuffix(importPath, ".js") + ".systemjs.js"
+}
+
+// systemjsModule wraps the ES module into a `System.register` module. The code is
+// rebuilt in the CommonJS format first, then the static imports become the
+// dependency list of the register, the modules set by the setters are returned
+// by the `require` function, and the dynamic imports are loaded by `_context.import`.
+// The imported build files are replaced with their SystemJS variants. The exports
+// are set at the end of the execution, so the live bindings are not kept.
+func systemjsModule(code []byte, minify bool) ([]byte, error) {
+	deps := []string{}
+	depSet := newStringSet()
+	result := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents: string(code),
+		},
+		Write:             false,
+		Bundle:            true,
+		Format:            api.FormatCommonJS,
+		Target:            api.ESNext,
+		MinifyWhitespace:  minify,
+		MinifyIdentifiers: minify,
+		MinifySyntax:      minify,
+		Define: map[string]string{
+			"import.meta": "__meta$",
+		},
+		Plugins: []api.Plugin{{
+			Name: "systemjs",
+			Setup: func(build api.PluginBuild) {
+				build.OnResolve(
+					api.OnResolveOptions{Filter: ".*"},
+					func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+						importPath := args.Path
+						if isFileImportPath(importPath) && strings.HasSuffix(importPath, ".js") && !strings.HasSuffix(importPath, ".systemjs.js") {
+							importPath = systemjsPath(importPath)
+						}
+						if args.Kind == api.ResolveJSDynamicImport {
+							return api.OnResolveResult{Path: "__ESM_SH_SYSTEMJS_IMPORT__:" + importPath, External: true}, nil
+						}
+						if !depSet.Has(importPath) {
+							depSet.Add(importPath)
+							deps = append(deps, importPath)
+						}
+						return api.OnResolveResult{Path: importPath, External: true}, nil
+					},
+				)
+			},
+		}},
+	})
+	if len(result.Errors) > 0 {
+		return nil, errors.New("systemjs: " + result.Errors[0].Text)
+	}
+	if len(result.OutputFiles) == 0 {
+		return nil, errors.New("systemjs: no output")
+	}
+	output := bytes.ReplaceAll(result.OutputFiles[0].Contents, []byte(`import("__ESM_SH_SYSTEMJS_IMPORT__:`), []byte(`_context.import("`))
+
+	eol := "\n"
+	indent := "  "
+	if minify {
+		eol = ""
+		indent = ""
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, `System.register(%s, function (_export, _context) {%s`, strings.TrimSpace(string(utils.MustEncodeJSON(deps))), eol)
+	fmt.Fprintf(buf, `%svar __deps$ = {};%s`, indent, eol)
+	// the namespace is copied with the `__esModule` mark, that lets the cjs interop get the default export
+	fmt.Fprintf(buf, `%svar __esm$ = function (m) { return Object.defineProperty(Object.assign({}, m), "__esModule", { value: true }); };%s`, indent, eol)
+	fmt.Fprintf(buf, `%sreturn {%s`, indent, eol)
+	fmt.Fprintf(buf, `%s%ssetters: [`, indent, indent)
+	for i, dep := range deps {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(buf, `function (m) { __deps$[%s] = __esm$(m); }`, strings.TrimSpace(string(utils.MustEncodeJSON(dep))))
+	}
+	fmt.Fprintf(buf, `],%s`, eol)
+	fmt.Fprintf(buf, `%s%sexecute: function () {%s`, indent, indent, eol)
+	fmt.Fprintf(buf, `var module = { exports: {} }, exports = module.exports, __meta$ = _context.meta;%s`, eol)
+	fmt.Fprintf(buf, `var require = function (p) { if (p in __deps$) return __deps$[p]; throw new Error("Cannot find module '" + p + "'"); };%s`, eol)
+	buf.Write(bytes.TrimSpace(output))
+	buf.WriteString(eol)
+	fmt.Fprintf(buf, `_export(module.exports);%s`, eol)
+	fmt.Fprintf(buf, `%s%s}%s`, indent, indent, eol)
+	fmt.Fprintf(buf, `%s};%s`, indent, eol)
+	buf.WriteString("});\n")
+	return buf.Bytes(), nil
+}
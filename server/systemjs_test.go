@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSystemjsPath(t *testing.T) {
+	if p := systemjsPath("/v43/node_process.js"); p != "/v43/node_process.systemjs.js" {
+		t.Fatalf("unexpected systemjs path: %s", p)
+	}
+	if p := systemjsPath("/v43/react@17.0.2/es2020/react.development.js"); p != "/v43/react@17.0.2/es2020/react.development.systemjs.js" {
+		t.Fatalf("unexpected systemjs path: %s", p)
+	}
+}
+
+func TestSystemjsModule(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testsystemjs")
+	os.RemoveAll(testDir)
+	ensureDir(testDir)
+
+	for _, minify := range []bool{false, true} {
+		code, err := systemjsModule([]byte(`
+			import React, { version } from "/v43/react@17.0.2/es2020/react.js";
+			import * as utils from "./utils.js";
+			export * from "https://cdn.example.com/lib.js";
+			export const url = import.meta.url;
+			export const lazy = () => import("/v43/lazy@1.0.0/es2020/lazy.js");
+			export default React.name + " " + version + " " + utils.name;
+		`), minify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path.Join(testDir, "mod.js"), code, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("node", "-e", `
+			const mods = {
+				"/v43/react@17.0.2/es2020/react.systemjs.js": { default: { name: "react" }, version: "17.0.2" },
+				"./utils.systemjs.js": { name: "utils" },
+				"https://cdn.example.com/lib.js": { lib: "lib" },
+			}
+			globalThis.System = {
+				register(deps, declare) {
+					const ns = {}
+					const m = declare(o => Object.assign(ns, o), { meta: { url: "https://esm.sh/mod.js" }, import: p => Promise.resolve(p) })
+					m.setters.forEach((setter, i) => setter(mods[deps[i]]))
+					m.execute()
+					ns.lazy().then(p => console.log(deps.join(","), ns.default, ns.lib, ns.url, p))
+				}
+			}
+			require("./mod.js")
+		`)
+		cmd.Dir = testDir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, output)
+		}
+		expect := "/v43/react@17.0.2/es2020/react.systemjs.js,./utils.systemjs.js,https://cdn.example.com/lib.js react 17.0.2 utils lib https://esm.sh/mod.js /v43/lazy@1.0.0/es2020/lazy.systemjs.js"
+		if strings.TrimSpace(string(output)) != expect {
+			t.Fatalf("unexpected output(minify=%v): %s", minify, output)
+		}
+	}
+}
+
+func TestSystemjsPolyfills(t *testing.T) {
+	polyfills, err := ioutil.ReadDir("../embed/polyfills")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range polyfills {
+		data, err := ioutil.ReadFile(path.Join("../embed/polyfills", fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := systemjsModule(data, false)
+		if err != nil {
+			t.Fatalf("%s: %v", fi.Name(), err)
+		}
+		if !strings.HasPrefix(string(code), "System.register(") {
+			t.Fatalf("%s: unexpected output", fi.Name())
+		}
+	}
+}
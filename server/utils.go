@@ -1,11 +1,20 @@
 package server
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/ije/gox/utils"
 )
@@ -13,6 +22,10 @@ import (
 var (
 	regFullVersion      = regexp.MustCompile(`^\d+\.\d+\.\d+(\-[a-zA-Z0-9\.]+)*$`)
 	regBuildVersionPath = regexp.MustCompile(`^/v\d+/`)
+	regBuildLogID       = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	regCondition        = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
+	regGitSHA           = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	regJSIdentifier     = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*$`)
 )
 
 // A Country of mmdb record.
@@ -100,19 +113,36 @@ func (s versionSlice) Less(i, j int) bool {
 	return a0 > b0
 }
 
+// identify returns a js identifier of the import path, a short hash of the path
+// is appended if any character is replaced, that keeps the identifiers of the
+// paths like `foo-bar`, `foo.bar` and `foo/bar` distinct.
 func identify(importPath string) string {
 	p := []byte(importPath)
+	replaced := false
 	for i, c := range p {
-		switch c {
-		case '/', '-', '@', '.':
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$') {
 			p[i] = '_'
-		default:
-			p[i] = c
+			replaced = true
 		}
 	}
+	if replaced {
+		sum := sha1.Sum([]byte(importPath))
+		return string(p) + "_" + hex.EncodeToString(sum[:3])
+	}
 	return string(p)
 }
 
+// withBasePath prefixes the absolute path with the `base-path` of the server,
+// like `/cdn/v43/react@17.0.2/es2020/react.js`, the urls are kept as they are.
+// The prefix is not a part of the build ID, the cached builds keep the prefix
+// they were built with until they are purged or the `VERSION` is bumped.
+func withBasePath(p string) string {
+	if strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") {
+		return config.basePath + p
+	}
+	return p
+}
+
 func isFileImportPath(importPath string) bool {
 	return strings.HasPrefix(importPath, "/") || strings.HasPrefix(importPath, "./") || strings.HasPrefix(importPath, "../") || importPath == "." || importPath == ".."
 }
@@ -142,6 +172,90 @@ func ensureSuffix(path string, ext string) string {
 	return path
 }
 
+// splitList splits the comma separated list and ignores the empty items.
+func splitList(s string) []string {
+	a := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			a = append(a, item)
+		}
+	}
+	return a
+}
+
+func trimJSExt(path string) string {
+	for _, ext := range []string{".js", ".mjs", ".cjs"} {
+		if strings.HasSuffix(path, ext) {
+			return strings.TrimSuffix(path, ext)
+		}
+	}
+	return path
+}
+
+// isTypesPackage returns true if the package only contains type definitions, like `@types/react`.
+func isTypesPackage(name string) bool {
+	return strings.HasPrefix(name, "@types/")
+}
+
+// sriHash returns the subresource integrity of the content with sha384 and
+// sha256 digests, like `sha384-... sha256-...`.
+func sriHash(content ...[]byte) string {
+	h384 := sha512.New384()
+	h256 := sha256.New()
+	for _, b := range content {
+		h384.Write(b)
+		h256.Write(b)
+	}
+	return "sha384-" + base64.StdEncoding.EncodeToString(h384.Sum(nil)) + " sha256-" + base64.StdEncoding.EncodeToString(h256.Sum(nil))
+}
+
+// contentHash returns a short hex sha256 digest of the content that is used in the filenames.
+func contentHash(content ...[]byte) string {
+	h := sha256.New()
+	for _, c := range content {
+		h.Write(c)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// getTypesPackageName returns the DefinitelyTyped package name of the package,
+// the scoped `@scope/name` is mangled to `@types/scope__name` like typescript does.
+func getTypesPackageName(name string) string {
+	if strings.HasPrefix(name, "@") {
+		return "@types/" + strings.Replace(name[1:], "/", "__", 1)
+	}
+	return "@types/" + name
+}
+
+// isGlobalExternal returns true if the import path is a global external
+// package or a submodule of it.
+func isGlobalExternal(importPath string) bool {
+	for _, name := range config.globalExternals {
+		if importPath == name || strings.HasPrefix(importPath, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFile returns the existing file of the import path without extension.
+func resolveFile(filename string) string {
+	for _, f := range []string{
+		filename,
+		filename + ".js",
+		filename + ".mjs",
+		filename + ".cjs",
+		path.Join(filename, "index.js"),
+		path.Join(filename, "index.mjs"),
+	} {
+		if fileExists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
 func fileExists(filepath string) bool {
 	fi, err := os.Lstat(filepath)
 	return err == nil && !fi.IsDir()
@@ -159,3 +273,62 @@ func ensureDir(dir string) (err error) {
 	}
 	return
 }
+
+// writeFileAtomic writes the readers to a temporary file in the same directory
+// then renames it to the filename, so a partial file is never observed.
+func writeFileAtomic(filename string, readers ...io.Reader) (err error) {
+	err = ensureDir(path.Dir(filename))
+	if err != nil {
+		return
+	}
+
+	tmpFile, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+
+	for _, r := range readers {
+		_, err = io.Copy(tmpFile, r)
+		if err != nil {
+			tmpFile.Close()
+			return
+		}
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(tmpFile.Name(), 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// lockFile acquires an exclusive lock of the file that is shared between processes,
+// it blocks until the lock is released by the holder.
+func lockFile(filename string) (unlock func(), err error) {
+	err = ensureDir(path.Dir(filename))
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	unlock = func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+)
+
+func TestGetTypesPackageName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"react":           "@types/react",
+		"@babel/core":     "@types/babel__core",
+		"@emotion/styled": "@types/emotion__styled",
+	} {
+		if typesName := getTypesPackageName(name); typesName != expected {
+			t.Fatalf("unexpected types package name of '%s': %s", name, typesName)
+		}
+	}
+}
+
+func TestSRIHash(t *testing.T) {
+	// echo -n "export default 1;" | openssl dgst -sha384 -binary | base64
+	expected := "sha384-6suxL03OA+o34JTHN80IuUKolVKUO6SuwSAcWwv+/cyKZUhgJdmnEZ0gCqufE0lU sha256-VjMuClVzS8K3PfVqLfhjXtXFskttekVrQd58q5ovOBQ="
+	if sri := sriHash([]byte("export "), []byte("default 1;")); sri != expected {
+		t.Fatalf("unexpected sri: %s", sri)
+	}
+}
+
+func TestPathVersion(t *testing.T) {
+	for pathname, expected := range map[string]string{
+		"/react@latest/es2020/react.js":      "latest",
+		"/react@17.0.2/es2020/react.js":      "17.0.2",
+		"/react/es2020/react.js":             "",
+		"/@scope/name@^1.0.0/es2020/name.js": "^1.0.0",
+		"/@scope/name/es2020/name.js":        "",
+	} {
+		if version := pathVersion(pathname); version != expected {
+			t.Fatalf("unexpected version of '%s': %s", pathname, version)
+		}
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	// echo -n "export default 1;" | sha256sum
+	if hash := contentHash([]byte("export "), []byte("default 1;")); hash != "56332e0a5573" {
+		t.Fatalf("unexpected content hash: %s", hash)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	if id := identify("react"); id != "react" {
+		t.Fatalf("unexpected identifier of 'react': %s", id)
+	}
+	ids := map[string]string{}
+	for _, importPath := range []string{"foo-bar", "foo.bar", "foo/bar", "foo_bar", "@foo/bar", "foo@bar"} {
+		id := identify(importPath)
+		if !regexp.MustCompile(`^[a-zA-Z0-9_$]+$`).MatchString(id) {
+			t.Fatalf("invalid identifier of '%s': %s", importPath, id)
+		}
+		if p, ok := ids[id]; ok {
+			t.Fatalf("identifiers of '%s' and '%s' collide: %s", p, importPath, id)
+		}
+		ids[id] = importPath
+	}
+}
+
+func TestParseGitHubPath(t *testing.T) {
+	for pathname, expected := range map[string][3]string{
+		"/gh/vercel/swr":          {"vercel/swr", "", ""},
+		"/gh/vercel/swr@v0.5.6":   {"vercel/swr", "v0.5.6", ""},
+		"/gh/vercel/swr@main/esm": {"vercel/swr", "main", "esm"},
+		"/gh/vercel/swr@0123456789abcdef0123456789abcdef01234567/esm/index.js": {"vercel/swr", "0123456789abcdef0123456789abcdef01234567", "esm/index"},
+	} {
+		repo, ref, submodule, err := parseGitHubPath(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if [3]string{repo, ref, submodule} != expected {
+			t.Fatalf("unexpected github path of '%s': %s %s %s", pathname, repo, ref, submodule)
+		}
+	}
+	for _, pathname := range []string{"/gh/vercel", "/gh/vercel/swr$"} {
+		if _, _, _, err := parseGitHubPath(pathname); err == nil {
+			t.Fatalf("'%s' should be invalid", pathname)
+		}
+	}
+	if _, err := parseGitHubPkg("vercel/swr", "main", ""); err == nil {
+		t.Fatal("the branch should not be parsed as a commit")
+	}
+}
+
+func TestParseLocalPkg(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "testlocalpkg")
+	os.RemoveAll(testDir)
+	ensureDir(path.Join(testDir, "fixture"))
+	err := ioutil.WriteFile(path.Join(testDir, "fixture", "package.json"), []byte(`{"name":"fixture","version":"0.0.1"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{localPackagesDir: testDir}
+	m, err := parseLocalPkg("/fixture/lib/foo", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.name != "fixture" || m.version != "0.0.1" || m.submodule != "lib/foo" || m.local != "fixture" {
+		t.Fatalf("unexpected local package: %+v", *m)
+	}
+	// the dir can't be outside of the local packages dir
+	if _, err := parseLocalPkg("/fixture", "../testlocalpkg/fixture"); err == nil {
+		t.Fatal("should not find the package outside of the local packages dir")
+	}
+	if _, err := parseLocalPkg("/react", "fixture"); err == nil {
+		t.Fatal("should check the package name")
+	}
+}
+
+func TestJSIdentifier(t *testing.T) {
+	for _, name := range []string{"default", "useState", "_private", "$", "h1"} {
+		if !regJSIdentifier.MatchString(name) {
+			t.Fatalf("%s should be a valid export name", name)
+		}
+	}
+	for _, name := range []string{"", "1a", "a-b", "a/b", `a"`, `a}from"x";import"/etc/passwd";export{b`} {
+		if regJSIdentifier.MatchString(name) {
+			t.Fatalf("%s should be an invalid export name", name)
+		}
+	}
+}
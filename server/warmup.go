@@ -0,0 +1,44 @@
+package server
+
+import (
+	"time"
+)
+
+// warmup builds the configured packages in background with low priority,
+// then the first requests of these packages will hit the cache.
+func warmup(queue *buildQueue) {
+	start := time.Now()
+	devModes := []bool{false}
+	if config.warmupDev {
+		devModes = append(devModes, true)
+	}
+
+	n := 0
+	for _, name := range config.warmupPackages {
+		pkg, err := parsePkg(name)
+		if err != nil {
+			log.Warnf("warmup(%s): %v", name, err)
+			continue
+		}
+		for _, target := range config.warmupTargets {
+			for _, isDev := range devModes {
+				task := &buildTask{
+					pkg:    *pkg,
+					target: target,
+					isDev:  isDev,
+				}
+				if _, _, ok := findESM(task.ID()); ok {
+					continue
+				}
+				output := <-queue.AddLowPriority(task)
+				if output.err != nil {
+					log.Warnf("warmup(%s): %v", task.ID(), output.err)
+					continue
+				}
+				log.Debugf("warmup(%s) done", task.ID())
+				n++
+			}
+		}
+	}
+	log.Infof("warmup %d builds in %v", n, time.Now().Sub(start))
+}